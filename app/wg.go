@@ -252,6 +252,8 @@ func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wg
 			AtomicNoizeConfig,
 			preflightPort,        // extracted port for preflight packets
 			100*time.Millisecond, // minimum interval between preflights (reduced from 1 second)
+			// Presets are complete; a zero Jc (minimal) means no junk
+			preflightbind.WithConfigDefaults(false),
 		)
 		if err != nil {
 			l.Error("failed to create AtomicNoize bind", "error", err)
@@ -179,6 +179,18 @@ func (cl *ConfigLoader) mergeAtomicNoizeConfig(base, override *preflightbind.Ato
 	if override.S2 != 0 {
 		base.S2 = override.S2
 	}
+	if override.H1 != 0 {
+		base.H1 = override.H1
+	}
+	if override.H2 != 0 {
+		base.H2 = override.H2
+	}
+	if override.H3 != 0 {
+		base.H3 = override.H3
+	}
+	if override.H4 != 0 {
+		base.H4 = override.H4
+	}
 	if override.Jc != 0 {
 		base.Jc = override.Jc
 	}
@@ -204,6 +216,9 @@ func (cl *ConfigLoader) mergeAtomicNoizeConfig(base, override *preflightbind.Ato
 	if override.HandshakeDelay != 0 {
 		base.HandshakeDelay = override.HandshakeDelay
 	}
+	if override.AdaptiveJunk {
+		base.AdaptiveJunk = true
+	}
 }
 
 // mergeNoizeConfig merges MASQUE Noize configurations
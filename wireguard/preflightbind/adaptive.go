@@ -0,0 +1,128 @@
+package preflightbind
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// Thresholds for AtomicNoizeConfig.AdaptiveJunk.
+const (
+	adaptiveSlowRTT   = 200 * time.Millisecond // halve junk counts above this
+	adaptiveFastRTT   = 20 * time.Millisecond  // double junk counts below this
+	adaptiveMaxJunk   = 128                    // upper bound for a doubled count
+	rttSmoothingShift = 3                      // EWMA weight 1/8, as in TCP's SRTT
+)
+
+// latencyProbe sends a timestamped datagram to host ("ip:port") from a fresh
+// socket and waits for any reply, returning the round-trip time. A reply is
+// folded into the destination's rolling average. WireGuard servers never
+// answer the probe, so it is only used by ProbeReachability; AdaptiveJunk
+// measures handshakes instead (see noteInitSent). Servers that never answer
+// unknown datagrams yield a context error.
+func (b *Bind) latencyProbe(ctx context.Context, host string) (time.Duration, error) {
+	dst, err := netip.ParseAddrPort(host)
+	if err != nil {
+		return 0, err
+	}
+	c, err := b.dial(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	} else {
+		_ = c.SetDeadline(time.Now().Add(preflightDialTimeout))
+	}
+
+	probe := make([]byte, 8)
+	start := time.Now()
+	binary.BigEndian.PutUint64(probe, uint64(start.UnixNano()))
+	if _, err := c.Write(probe); err != nil {
+		return 0, err
+	}
+	if _, err := c.Read(make([]byte, 1500)); err != nil {
+		return 0, fmt.Errorf("%w: no probe response from %s: %w", ErrDialFailed, host, err)
+	}
+	rtt := time.Since(start)
+	b.recordRTT(dst.Addr(), rtt)
+	return rtt, nil
+}
+
+// recordRTT folds sample into dst's exponentially weighted average RTT.
+func (b *Bind) recordRTT(dst netip.Addr, sample time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rtt == nil {
+		b.rtt = make(map[netip.Addr]time.Duration)
+	}
+	avg, ok := b.rtt[dst]
+	if !ok {
+		b.rtt[dst] = sample
+		return
+	}
+	b.rtt[dst] = avg + (sample-avg)>>rttSmoothingShift
+}
+
+// AverageRTT returns the smoothed round-trip time measured to dst, if any.
+func (b *Bind) AverageRTT(dst netip.Addr) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rtt, ok := b.rtt[dst]
+	return rtt, ok
+}
+
+// adaptJunkCount scales a configured junk count for dst according to the
+// measured RTT when AdaptiveJunk is enabled.
+func (b *Bind) adaptJunkCount(config *AtomicNoizeConfig, dst netip.Addr, n int) int {
+	if !config.AdaptiveJunk || n <= 0 {
+		return n
+	}
+	rtt, ok := b.AverageRTT(dst)
+	switch {
+	case !ok:
+		return n
+	case rtt > adaptiveSlowRTT:
+		return max(n/2, 1)
+	case rtt < adaptiveFastRTT:
+		// Counts already above the cap are left alone rather than lowered
+		return max(n, min(n*2, adaptiveMaxJunk))
+	default:
+		return n
+	}
+}
+
+// noteInitSent records when bufs hand a handshake initiation for ep to the
+// inner Bind, so the response can be timed by handshakeRTT.
+func (b *Bind) noteInitSent(ep conn.Endpoint, bufs [][]byte) {
+	for _, buf := range bufs {
+		if b.classifier.IsHandshakeInit(buf) {
+			b.mu.Lock()
+			if b.initSent == nil {
+				b.initSent = make(map[netip.Addr]time.Time)
+			}
+			b.initSent[ep.DstIP()] = time.Now()
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// handshakeRTT folds the time between the last initiation sent to dst and
+// its response into dst's average RTT. The handshake is the one exchange a
+// WireGuard server always answers, so no extra probe is needed.
+func (b *Bind) handshakeRTT(dst netip.Addr) {
+	b.mu.Lock()
+	sent, ok := b.initSent[dst]
+	delete(b.initSent, dst)
+	b.mu.Unlock()
+	if ok {
+		b.recordRTT(dst, time.Since(sent))
+	}
+}
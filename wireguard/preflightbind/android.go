@@ -0,0 +1,98 @@
+package preflightbind
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// androidAmneziaKeys are the AmneziaWG fields read from Android app JSON.
+var androidAmneziaKeys = []string{
+	"jc", "jmin", "jmax", "s1", "s2",
+	"h1", "h2", "h3", "h4",
+	"i1", "i2", "i3", "i4", "i5",
+}
+
+// ParseAndroidAmneziaConfig decodes the JSON config exported by the AmneziaWG
+// Android app (and carried in its QR codes). The AmneziaWG fields may sit at
+// the top level or inside an "interface" object; other fields are ignored.
+// Values may be JSON numbers or numeric strings, and h1-h4 accept a 0x
+// prefix for hex. h1-h4 are the magic message headers and fill H1-H4, while
+// i1-i5 fill the I1-I5 signature packets. The result is validated before it
+// is returned; malformed JSON and bad values are reported as *ParseError.
+func ParseAndroidAmneziaConfig(jsonBytes []byte) (*AtomicNoizeConfig, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(jsonBytes, &doc); err != nil {
+		return nil, &ParseError{Source: "json", Err: err}
+	}
+	if iface, ok := lookupFold(doc, "interface"); ok {
+		var inner map[string]json.RawMessage
+		if err := json.Unmarshal(iface, &inner); err != nil {
+			return nil, &ParseError{Source: "json", Err: fmt.Errorf("interface: %w", err)}
+		}
+		doc = inner
+	}
+
+	cfg := &AtomicNoizeConfig{}
+	found := false
+	for _, key := range androidAmneziaKeys {
+		raw, ok := lookupFold(doc, key)
+		if !ok {
+			continue
+		}
+		value, err := jsonScalar(raw)
+		if err != nil {
+			return nil, &ParseError{Source: "json", Err: fmt.Errorf("%s: %w", key, err)}
+		}
+		if value == "" {
+			continue
+		}
+		if err := setConfigField(cfg, key, value); err != nil {
+			return nil, &ParseError{Source: "json", Err: err}
+		}
+		found = true
+	}
+	if !found {
+		return nil, &ParseError{Source: "json", Err: errors.New("no AmneziaWG fields found")}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func lookupFold(doc map[string]json.RawMessage, key string) (json.RawMessage, bool) {
+	if v, ok := doc[key]; ok {
+		return v, true
+	}
+	for k, v := range doc {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// jsonScalar returns a JSON string, number or boolean as text; null
+// becomes "".
+func jsonScalar(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch string(raw) {
+	case "null":
+		return "", nil
+	case "true", "false":
+		return string(raw), nil
+	}
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", errors.New("expected a string, number or boolean")
+	}
+	return n.String(), nil
+}
@@ -0,0 +1,97 @@
+package preflightbind
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// junkLoops maps the cancel functions of running background junk loops to
+// their destinations.
+type junkLoops map[*context.CancelFunc]netip.Addr
+
+// StartBackgroundJunk sends a junk packet to dst every interval, even while
+// no WireGuard traffic flows, so an idle tunnel keeps looking like an active
+// connection. Packet sizes follow the config for dst and packets go through
+// the inner Bind. The goroutine runs until ctx is done, stop is called or the
+// Bind is closed; stop may be called more than once.
+func (b *Bind) StartBackgroundJunk(ctx context.Context, dst netip.AddrPort, interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%w: background junk interval must be positive", ErrConfigInvalid)
+	}
+	ep, err := b.inner.ParseEndpoint(dst.String())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		cancel()
+		return nil, fmt.Errorf("bind is shut down: %w", net.ErrClosed)
+	}
+	if b.bgJunk == nil {
+		b.bgJunk = make(junkLoops)
+	}
+	key := &cancel
+	b.bgJunk[key] = dst.Addr()
+	b.background.Add(1)
+	b.mu.Unlock()
+
+	b.activeBackgroundJunk.Add(1)
+	go func() {
+		defer b.background.Done()
+		defer b.activeBackgroundJunk.Add(-1)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			config, _ := b.configFor(dst.Addr())
+			if config == nil {
+				continue
+			}
+			junk := b.numberJunk(dst.Addr(), b.generateJunkPacket(config))
+			if b.sendPacket(junk, ep, "background junk") {
+				b.countJunk(len(junk))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			b.mu.Lock()
+			delete(b.bgJunk, key)
+			b.mu.Unlock()
+		})
+	}, nil
+}
+
+// stopBackgroundJunk cancels every background junk goroutine. It must be
+// called with b.mu held.
+func (b *Bind) stopBackgroundJunk() {
+	for cancel := range b.bgJunk {
+		(*cancel)()
+	}
+	clear(b.bgJunk)
+}
+
+// stopJunkLoops cancels the background junk goroutines sending to dst. It
+// must be called with b.mu held.
+func (b *Bind) stopJunkLoops(dst netip.Addr) {
+	for cancel, loopDst := range b.bgJunk {
+		if loopDst == dst {
+			(*cancel)()
+			delete(b.bgJunk, cancel)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package preflightbind
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind/testutil"
+)
+
+func BenchmarkGenerateJunkPacket(b *testing.B) {
+	bind := &Bind{}
+	for _, r := range []struct{ min, max int }{{0, 0}, {40, 70}, {64, 1024}, {1000, 1280}} {
+		cfg := &AtomicNoizeConfig{Jmin: r.min, Jmax: r.max}
+		b.Run(fmt.Sprintf("%d-%d", r.min, r.max), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bind.generateJunkPacket(cfg)
+			}
+		})
+	}
+}
+
+func BenchmarkParseCPSPacketStatic(b *testing.B) {
+	const cps = "<b 160301><g2><b 0100><s example.com><z 8></g2><b c0ffee>"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseCPSPacket(cps); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseCPSPacketDynamic(b *testing.B) {
+	const cps = "<p quic><c><t><r 64><e 16><h>"
+	ctx := &cpsContext{hmacKey: []byte("key")}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseCPSPacketWithContext(cps, ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMaybePreflight(b *testing.B) {
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708><r 64>", I2: "<b aabb><r 16>"}
+	newBind := func(b *testing.B) (*Bind, *testutil.FakeBind) {
+		fake := testutil.NewFakeBind()
+		bind, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return bind, fake
+	}
+	bufs := [][]byte{handshakeInitPacket()}
+
+	// The common case: the peer already had its preflight this interval
+	b.Run("rate-limited", func(b *testing.B) {
+		bind, _ := newBind(b)
+		ep, err := bind.ParseEndpoint("192.0.2.1:2408")
+		if err != nil {
+			b.Fatal(err)
+		}
+		bind.maybePreflightUsingSameSocket(ep, bufs)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			bind.maybePreflightUsingSameSocket(ep, bufs)
+		}
+	})
+
+	b.Run("full-send", func(b *testing.B) {
+		bind, fake := newBind(b)
+		ep, err := bind.ParseEndpoint("192.0.2.1:2408")
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst := netip.MustParseAddr("192.0.2.1")
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			bind.maybePreflightUsingSameSocket(ep, bufs)
+			b.StopTimer()
+			bind.RemovePeer(dst)
+			fake.Reset()
+			b.StartTimer()
+		}
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package preflightbind
+
+import (
+	"errors"
+	"syscall"
+)
+
+// interfaceControl is only implemented on Linux; elsewhere sockets are left
+// unbound.
+func interfaceControl(string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to an interface is only supported on Linux")
+}
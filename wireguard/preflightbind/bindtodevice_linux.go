@@ -0,0 +1,18 @@
+package preflightbind
+
+import "syscall"
+
+// interfaceControl returns a net.Dialer Control function that binds the
+// socket to ifname with SO_BINDTODEVICE.
+func interfaceControl(ifname string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), ifname)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,46 @@
+package preflightbind
+
+import (
+	"fmt"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// Layer is a conn.Bind that wraps another Bind and can be re-pointed at a
+// different inner Bind. Bind and XORBind are layers; transports such as
+// QUICBind are not and can only be the innermost element of a Chain.
+type Layer interface {
+	conn.Bind
+	SetInner(inner conn.Bind)
+}
+
+// SetInner replaces the Bind that b sends through. It must be called before
+// Open.
+func (b *Bind) SetInner(inner conn.Bind) { b.inner = inner }
+
+// SetInner replaces the Bind that x sends through. It must be called before
+// Open.
+func (x *XORBind) SetInner(inner conn.Bind) { x.inner = inner }
+
+// Chain links layers so that each one sends through the next: Send on the
+// result runs layers[0].Send, which forwards to layers[1].Send and so on,
+// while Open, Close and SetMark travel down the same path to the innermost
+// Bind, with every layer wrapping the receive functions on the way back up.
+// This composes preflight, XOR masking and transports such as QUICBind
+// without a dedicated Bind for every combination.
+//
+// Every layer except the last must implement Layer. Whatever inner Bind a
+// layer was constructed with is replaced.
+func Chain(layers ...conn.Bind) (conn.Bind, error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("%w: chain needs at least one layer", ErrConfigInvalid)
+	}
+	for i := 0; i < len(layers)-1; i++ {
+		l, ok := layers[i].(Layer)
+		if !ok {
+			return nil, fmt.Errorf("%w: chain layer %d (%T) cannot wrap another Bind", ErrConfigInvalid, i, layers[i])
+		}
+		l.SetInner(layers[i+1])
+	}
+	return layers[0], nil
+}
@@ -0,0 +1,151 @@
+package preflightbind
+
+import (
+	"bytes"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
+)
+
+// PacketClassifier decides which outgoing packets are WireGuard handshake
+// messages. Forks such as Cloudflare WARP, AmneziaWG or boringtun lay out
+// their handshake packets slightly differently; embedders can supply their
+// own classifier via WithPacketClassifier instead of patching this package.
+type PacketClassifier interface {
+	IsHandshakeInit(buf []byte) bool
+	IsHandshakeResponse(buf []byte) bool
+}
+
+// defaultClassifier implements PacketClassifier for standard WireGuard and
+// Cloudflare WARP. The zero value accepts initiations of at least
+// device.MessageInitiationSize bytes; see WithHandshakeInitSize.
+type defaultClassifier struct {
+	initMin, initMax int    // accepted initiation size range, 0 for defaults
+	initTypes        []byte // accepted initiation type bytes, nil for type 1
+}
+
+func (c defaultClassifier) IsHandshakeInit(buf []byte) bool {
+	if c.initMin == 0 && c.initMax == 0 && c.initTypes == nil {
+		return handshakeInitiation(buf)
+	}
+	if c.initMin == 0 && c.initMax == 0 {
+		if len(buf) < device.MessageInitiationSize {
+			return false
+		}
+	} else if len(buf) < c.initMin || (c.initMax > 0 && len(buf) > c.initMax) {
+		return false
+	}
+	if c.initTypes != nil {
+		return bytes.IndexByte(c.initTypes, buf[0]) >= 0
+	}
+	return buf[0] == byte(device.MessageInitiationType)
+}
+
+func (defaultClassifier) IsHandshakeResponse(buf []byte) bool {
+	return len(buf) >= device.MessageResponseSize && buf[0] == byte(device.MessageResponseType)
+}
+
+// DefaultPacketClassifier returns the classifier used when none is configured.
+func DefaultPacketClassifier() PacketClassifier { return defaultClassifier{} }
+
+// WithPacketClassifier replaces the handshake detection logic.
+func WithPacketClassifier(c PacketClassifier) Option {
+	return func(b *Bind) {
+		if c != nil {
+			b.classifier = c
+		}
+	}
+}
+
+// WithHandshakeInitSize makes the default classifier accept handshake
+// initiations of min to max bytes instead of requiring at least
+// device.MessageInitiationSize, for forks such as AmneziaWG whose extended
+// initiations have a different size. A zero max means no upper bound. The
+// option has no effect when a classifier was set with WithPacketClassifier.
+func WithHandshakeInitSize(min, max int) Option {
+	return func(b *Bind) {
+		c, ok := b.classifier.(defaultClassifier)
+		if !ok {
+			return
+		}
+		if min < 1 {
+			min = 1
+		}
+		c.initMin, c.initMax = min, max
+		b.classifier = c
+	}
+}
+
+// WithInitTypes makes the default classifier treat packets whose first byte
+// is any of types as handshake initiations, instead of only type 1, for
+// forks that renumber their messages. An empty list restores type 1. Like
+// WithHandshakeInitSize, it has no effect on a classifier set with
+// WithPacketClassifier.
+func WithInitTypes(types []byte) Option {
+	return func(b *Bind) {
+		c, ok := b.classifier.(defaultClassifier)
+		if !ok {
+			return
+		}
+		c.initTypes = nil
+		if len(types) > 0 {
+			c.initTypes = bytes.Clone(types)
+		}
+		b.classifier = c
+	}
+}
+
+// MessageType is the kind of a WireGuard message, as reported by
+// PacketClassify.
+type MessageType int
+
+// WireGuard message types.
+const (
+	MessageUnknown MessageType = iota
+	MessageInit
+	MessageResponse
+	MessageCookieReply
+	MessageTransport
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageInit:
+		return "init"
+	case MessageResponse:
+		return "response"
+	case MessageCookieReply:
+		return "cookie-reply"
+	case MessageTransport:
+		return "transport"
+	default:
+		return "unknown"
+	}
+}
+
+// PacketClassify returns the WireGuard message type of buf from its type
+// byte, or MessageUnknown if buf is shorter than that message type requires.
+// The three reserved bytes are not checked, since Cloudflare WARP uses them.
+func PacketClassify(buf []byte) MessageType {
+	if len(buf) == 0 {
+		return MessageUnknown
+	}
+	switch buf[0] {
+	case byte(device.MessageInitiationType):
+		if len(buf) >= device.MessageInitiationSize {
+			return MessageInit
+		}
+	case byte(device.MessageResponseType):
+		if len(buf) >= device.MessageResponseSize {
+			return MessageResponse
+		}
+	case byte(device.MessageCookieReplyType):
+		if len(buf) >= device.MessageCookieReplySize {
+			return MessageCookieReply
+		}
+	case byte(device.MessageTransportType):
+		if len(buf) >= device.MessageTransportHeaderSize {
+			return MessageTransport
+		}
+	}
+	return MessageUnknown
+}
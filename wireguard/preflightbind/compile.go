@@ -0,0 +1,178 @@
+package preflightbind
+
+import (
+	"fmt"
+	"strings"
+)
+
+// compiledPacket is a signature packet prepared at config load time. Packets
+// whose CPS string only contains static tags are built once; packets with
+// <r>, <e>, <c>, <t> or <p> tags, and I1 payloads generated from a
+// fingerprint profile or SNI, are rebuilt on every send so their dynamic
+// parts vary.
+type compiledPacket struct {
+	static []byte                 // pre-built bytes, nil when the packet is dynamic
+	cps    string                 // CPS source, kept for dynamic packets
+	gen    func() ([]byte, error) // generator for profile and SNI payloads
+}
+
+// present reports whether the packet is configured at all.
+func (p compiledPacket) present() bool {
+	return len(p.static) > 0 || p.cps != "" || p.gen != nil
+}
+
+// build returns the packet bytes, parsing the CPS string if it is dynamic.
+// n is the signature number (1-5) used in size errors.
+func (p compiledPacket) build(ctx *cpsContext, n int) ([]byte, error) {
+	var packet []byte
+	var err error
+	switch {
+	case p.gen != nil:
+		packet, err = p.gen()
+	case p.cps != "":
+		packet, err = parseCPSPacketWithContext(p.cps, ctx)
+	default:
+		return p.static, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkSize(n, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// checkSize reports an error if packet I<n> falls outside the size range set
+// with WithMinPacketSize and WithMaxPacketSize.
+func (ctx *cpsContext) checkSize(n int, packet []byte) error {
+	if ctx == nil {
+		return nil
+	}
+	if len(packet) < ctx.minSize {
+		return fmt.Errorf("%w: I%d packet is %d bytes, below the minimum of %d", ErrConfigInvalid, n, len(packet), ctx.minSize)
+	}
+	if ctx.maxSize > 0 && len(packet) > ctx.maxSize {
+		return fmt.Errorf("%w: I%d packet is %d bytes, above the maximum of %d", ErrPacketTooBig, n, len(packet), ctx.maxSize)
+	}
+	return nil
+}
+
+// compiledConfig holds the parsed form of an AtomicNoizeConfig's I1-I5.
+type compiledConfig struct {
+	i1         compiledPacket    // I1, without its IKEv2 framing
+	signatures [4]compiledPacket // I2-I5
+}
+
+// withMacros returns a copy of ctx that expands <ref> tags from macros.
+func (ctx *cpsContext) withMacros(macros map[string]string) *cpsContext {
+	if len(macros) == 0 {
+		return ctx
+	}
+	c := cpsContext{}
+	if ctx != nil {
+		c = *ctx
+	}
+	c.macros = macros
+	return &c
+}
+
+// isDynamicCPS reports whether cps contains tags whose output changes from
+// one call to the next.
+func isDynamicCPS(cps string) bool {
+	cps = cpsCondRegex.ReplaceAllString(cps, "")
+	for _, m := range cpsTagRegex.FindAllStringSubmatch(cps, -1) {
+		switch m[1] {
+		case "r", "e", "c", "t", "p":
+			return true
+		}
+	}
+	return false
+}
+
+// precompileConfig parses I1-I5 of cfg so that malformed CPS strings are
+// reported when the config is loaded rather than skipped at send time.
+func precompileConfig(cfg *AtomicNoizeConfig, ctx *cpsContext) (compiledConfig, error) {
+	var cc compiledConfig
+	if cfg == nil {
+		return cc, nil
+	}
+	ctx = ctx.withMacros(cfg.Macros)
+
+	// I1 is built once here so errors surface at load time, and kept as a
+	// generator or CPS string when each preflight needs fresh bytes
+	var gen func() ([]byte, error)
+	var i1 string
+	switch {
+	case ctx != nil && ctx.profile == FingerprintWireGuardNative:
+		// No I1 at all
+	case ctx != nil && ctx.profile != "":
+		opts := ctx.profileOpts
+		if opts.SNI == "" {
+			opts.SNI = ctx.sni
+		}
+		profile := ctx.profile
+		gen = func() ([]byte, error) { return BuildPayloadFromProfile(profile, opts) }
+	case ctx != nil && ctx.sni != "":
+		sni := ctx.sni
+		gen = func() ([]byte, error) { return BuildTLSClientHelloPayload(sni, nil, nil) }
+	default:
+		// Expanded here for the same reason as I2-I5 below
+		var err error
+		if i1, err = expandCPSMacros(strings.TrimSpace(cfg.I1), cfg.Macros); err != nil {
+			return cc, fmt.Errorf("%w: I1: %w", ErrConfigInvalid, err)
+		}
+	}
+	if gen != nil || i1 != "" {
+		var payload []byte
+		var err error
+		if gen != nil {
+			payload, err = gen()
+		} else {
+			payload, err = parseCPSPacketWithContext(i1, ctx)
+		}
+		if err != nil {
+			return cc, wrapIn(ErrConfigInvalid, fmt.Errorf("build I1: %w", err))
+		}
+		// An empty I1 is only checked when the config asked for one
+		if len(payload) > 0 || i1 != "" {
+			if err := ctx.checkSize(1, payload); err != nil {
+				return cc, wrapIn(ErrConfigInvalid, err)
+			}
+		}
+		switch {
+		case gen != nil && len(payload) > 0:
+			cc.i1 = compiledPacket{gen: gen}
+		case isDynamicCPS(i1):
+			cc.i1 = compiledPacket{cps: i1}
+		default:
+			cc.i1 = compiledPacket{static: payload}
+		}
+	}
+
+	for i, sig := range []string{cfg.I2, cfg.I3, cfg.I4, cfg.I5} {
+		sig = strings.TrimSpace(sig)
+		if sig == "" {
+			continue
+		}
+		// Expanded here because dynamic packets are rebuilt without the
+		// config's macro table
+		sig, err := expandCPSMacros(sig, cfg.Macros)
+		if err != nil {
+			return cc, fmt.Errorf("%w: I%d: %w", ErrConfigInvalid, i+2, err)
+		}
+		packet, err := parseCPSPacketWithContext(sig, ctx)
+		if err != nil {
+			return cc, fmt.Errorf("%w: I%d: %w", ErrConfigInvalid, i+2, err)
+		}
+		if err := ctx.checkSize(i+2, packet); err != nil {
+			return cc, wrapIn(ErrConfigInvalid, err)
+		}
+		if isDynamicCPS(sig) {
+			cc.signatures[i] = compiledPacket{cps: sig}
+		} else {
+			cc.signatures[i] = compiledPacket{static: packet}
+		}
+	}
+	return cc, nil
+}
@@ -0,0 +1,99 @@
+package preflightbind
+
+import (
+	mathrand "math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// junkEncoder is shared by every Bind; EncodeAll is safe for concurrent use.
+var (
+	junkEncoderOnce sync.Once
+	junkEncoder     *zstd.Encoder
+)
+
+// junkTemplateFields are the header names junkTemplate draws from.
+var junkTemplateFields = []string{
+	"accept", "accept-encoding", "cache-control", "content-length", "content-type",
+	"cookie", "date", "etag", "server", "user-agent", "vary", "x-request-id",
+}
+
+// WithJunkCompression replaces random junk payloads with zstd-compressed
+// text, so junk has the slightly-below-random entropy of a compressed
+// stream instead of that of a bare random source. The text is a fresh run
+// of header-like lines with random numbers, and the zstd frame header is
+// left off, so no two payloads share a prefix. The result is cut to the junk
+// size chosen from Jmin/Jmax; it is not a decodable zstd frame, only its
+// byte statistics are those of one.
+func WithJunkCompression(enabled bool) Option {
+	return func(b *Bind) {
+		b.compressJunk = enabled
+	}
+}
+
+// compressJunkPayload returns len(junk) bytes of compressed template text
+// in place of junk. It returns junk unchanged if compression is disabled.
+func (b *Bind) compressJunkPayload(junk []byte) []byte {
+	if !b.compressJunk || len(junk) == 0 {
+		return junk
+	}
+	junkEncoderOnce.Do(func() {
+		junkEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderCRC(false))
+	})
+	if junkEncoder == nil {
+		return junk
+	}
+	// Text of this kind compresses to roughly a third, so start there and
+	// grow until the compressed body covers the junk size
+	for plain := 3 * len(junk); plain <= 64*len(junk)+1024; plain *= 2 {
+		body := zstdFrameBody(junkEncoder.EncodeAll(junkTemplate(plain), nil))
+		if len(body) >= len(junk) {
+			return body[:len(junk)]
+		}
+	}
+	return junk
+}
+
+// junkTemplate returns at least n bytes of header-like lines ("name: value")
+// whose names repeat and whose values are random decimal numbers. Text this
+// redundant is what keeps the compressed result below full entropy.
+func junkTemplate(n int) []byte {
+	buf := make([]byte, 0, n+64)
+	for len(buf) < n {
+		buf = append(buf, junkTemplateFields[mathrand.Intn(len(junkTemplateFields))]...)
+		buf = append(buf, ": "...)
+		buf = strconv.AppendInt(buf, mathrand.Int63n(1<<(8+mathrand.Intn(40))), 10)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// zstdFrameBody strips the frame header and first block header from a zstd
+// frame, leaving the compressed data that follows them. It returns nil for
+// a frame it cannot parse.
+func zstdFrameBody(frame []byte) []byte {
+	const magicSize, blockHeaderSize = 4, 3
+	if len(frame) < magicSize+1 {
+		return nil
+	}
+	fhd := frame[magicSize]
+	singleSegment := fhd&0x20 != 0
+	n := magicSize + 1
+	if !singleSegment {
+		n++ // window descriptor
+	}
+	n += [4]int{0, 1, 2, 4}[fhd&3] // dictionary ID
+	switch fcs := fhd >> 6; {
+	case fcs == 0 && singleSegment:
+		n++
+	case fcs > 0:
+		n += [4]int{0, 2, 4, 8}[fcs] // frame content size
+	}
+	n += blockHeaderSize
+	if len(frame) < n {
+		return nil
+	}
+	return frame[n:]
+}
@@ -0,0 +1,253 @@
+package preflightbind
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Validate reports whether c is usable by a Bind: counts and sizes must be
+// non-negative, Jmax must not be below Jmin and I1-I5 must be valid CPS.
+func (c *AtomicNoizeConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Jc < 0 || c.JcAfterI1 < 0 || c.JcBeforeHS < 0 || c.JcAfterHS < 0 {
+		return fmt.Errorf("%w: junk packet counts cannot be negative", ErrConfigInvalid)
+	}
+	if c.Jmin < 0 || c.Jmax < 0 {
+		return fmt.Errorf("%w: junk packet sizes cannot be negative", ErrConfigInvalid)
+	}
+	if c.Jmax != 0 && c.Jmax < c.Jmin {
+		return fmt.Errorf("%w: maximum junk packet size (%d) cannot be less than minimum (%d)", ErrConfigInvalid, c.Jmax, c.Jmin)
+	}
+	if c.S1 < 0 || c.S1 > 64 || c.S2 < 0 || c.S2 > 64 {
+		return fmt.Errorf("%w: S1 and S2 must be between 0 and 64", ErrConfigInvalid)
+	}
+	if c.JunkInterval < 0 || c.HandshakeDelay < 0 {
+		return fmt.Errorf("%w: timing parameters cannot be negative", ErrConfigInvalid)
+	}
+	if c.JitterFraction < 0 || c.JitterFraction > 0.5 {
+		return fmt.Errorf("%w: JitterFraction must be between 0 and 0.5", ErrConfigInvalid)
+	}
+	for i, sig := range []string{c.I1, c.I2, c.I3, c.I4, c.I5} {
+		if sig == "" {
+			continue
+		}
+		sig, err := expandCPSMacros(sig, c.Macros)
+		if err != nil {
+			return fmt.Errorf("%w: I%d: %w", ErrConfigInvalid, i+1, err)
+		}
+		if !cpsTagRegex.MatchString(sig) {
+			return fmt.Errorf("%w: I%d contains no CPS tags", ErrConfigInvalid, i+1)
+		}
+	}
+	return nil
+}
+
+// SetDefaults fills zero-valued junk settings with working values: Jc=4,
+// Jmin=40 and Jmax=70 (or Jmin, if that is larger), the values used in
+// AmneziaWG's example configurations, and a JunkInterval of 5ms, which is
+// this package's own choice since AmneziaWG sends junk back to back.
+// HandshakeDelay and every other field are left as they are.
+//
+// NewWithAtomicNoize and ApplyConfig call SetDefaults on a copy of the
+// config unless WithConfigDefaults(false) is given, which keeps a zero Jc
+// meaning no junk at all (see the minimal preset in config/noize).
+func (c *AtomicNoizeConfig) SetDefaults() {
+	if c == nil {
+		return
+	}
+	if c.Jc == 0 {
+		c.Jc = 4
+	}
+	if c.Jmin == 0 {
+		c.Jmin = 40
+	}
+	if c.Jc > 0 && c.Jmax == 0 {
+		c.Jmax = max(70, c.Jmin)
+	}
+	if c.JunkInterval == 0 {
+		c.JunkInterval = 5 * time.Millisecond
+	}
+}
+
+// FieldChange describes one field that differs between two configs.
+type FieldChange struct {
+	FieldName string
+	OldValue  interface{}
+	NewValue  interface{}
+}
+
+// ConfigDiff returns the fields whose values differ between a and b, in
+// struct declaration order. A nil config is treated as the zero config.
+func ConfigDiff(a, b *AtomicNoizeConfig) []FieldChange {
+	if a == nil {
+		a = &AtomicNoizeConfig{}
+	}
+	if b == nil {
+		b = &AtomicNoizeConfig{}
+	}
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := va.Type()
+
+	var changes []FieldChange
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		oldV, newV := va.Field(i).Interface(), vb.Field(i).Interface()
+		if !reflect.DeepEqual(oldV, newV) {
+			changes = append(changes, FieldChange{
+				FieldName: t.Field(i).Name,
+				OldValue:  oldV,
+				NewValue:  newV,
+			})
+		}
+	}
+	return changes
+}
+
+// Equal reports whether c and other hold identical values in every field.
+func (c *AtomicNoizeConfig) Equal(other *AtomicNoizeConfig) bool {
+	return ConfigsEqual(c, other)
+}
+
+// ConfigsEqual is like a.Equal(b) but also handles nil configs: two nil
+// configs are equal, a nil and a non-nil config are not.
+func ConfigsEqual(a, b *AtomicNoizeConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return len(ConfigDiff(a, b)) == 0
+}
+
+// Hash returns the hex-encoded SHA-256 of c's fields, for checking that a
+// config arrived intact. Fields are serialized in alphabetical order of
+// their names, each as its name, a tab and its Go-quoted value, so equal
+// configs always hash the same. A nil config hashes like the zero config.
+func (c *AtomicNoizeConfig) Hash() string {
+	if c == nil {
+		c = &AtomicNoizeConfig{}
+	}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = t.Field(i).Name
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\t%#v\n", name, v.FieldByName(name).Interface())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// currentConfig returns the active config and its compiled signature packets.
+func (b *Bind) currentConfig() (*AtomicNoizeConfig, compiledConfig) {
+	b.cfgMu.RLock()
+	defer b.cfgMu.RUnlock()
+	return b.AtomicNoizeConfig, b.compiled
+}
+
+// Config returns a copy of the active config, or nil if obfuscation is
+// disabled. Region policies and fallback configs are not reflected.
+func (b *Bind) Config() *AtomicNoizeConfig {
+	cfg, _ := b.currentConfig()
+	if cfg == nil {
+		return nil
+	}
+	c := *cfg
+	return &c
+}
+
+// ApplyConfig validates cfg, compiles its signature packets and swaps it in as the
+// active config. In-flight preflight sequences finish with the old config.
+// A nil cfg disables AtomicNoize obfuscation. A WithConfigFallbackList chain
+// is discarded, so cfg applies to every destination outside region policies.
+// Applying a config equal to the current one changes nothing else.
+func (b *Bind) ApplyConfig(cfg *AtomicNoizeConfig) error {
+	cfg, err := b.prepareConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if current, _ := b.currentConfig(); ConfigsEqual(current, cfg) {
+		b.clearFallbacks()
+		return nil
+	}
+
+	compiled, err := precompileConfig(cfg, &b.cps)
+	if err != nil {
+		return err
+	}
+
+	b.cfgMu.Lock()
+	old := b.AtomicNoizeConfig
+	b.AtomicNoizeConfig = cfg
+	b.compiled = compiled
+	b.cfgMu.Unlock()
+	b.clearFallbacks()
+
+	for _, c := range ConfigDiff(old, cfg) {
+		b.log.Info("AtomicNoize config changed", "field", c.FieldName,
+			"old", redactConfigValue(c.FieldName, c.OldValue), "new", redactConfigValue(c.FieldName, c.NewValue))
+	}
+	return nil
+}
+
+// WithConfigDefaults chooses whether NewWithAtomicNoize and ApplyConfig
+// fill zero junk settings as SetDefaults does. It is on by default; pass
+// false for configs that are already complete and use a zero Jc to ask for
+// no junk.
+func WithConfigDefaults(enabled bool) Option {
+	return func(b *Bind) {
+		b.keepZeroConfig = !enabled
+	}
+}
+
+// prepareConfig returns cfg with defaults filled in, unless disabled by
+// WithConfigDefaults, and validated. The caller's config is not modified.
+func (b *Bind) prepareConfig(cfg *AtomicNoizeConfig) (*AtomicNoizeConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if !b.keepZeroConfig {
+		c := *cfg
+		c.SetDefaults()
+		cfg = &c
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// redactConfigValue returns v fit for logging. I1-I5 and Macros identify the
+// deployment and may hold interpolated secrets, so only their size is shown.
+func redactConfigValue(field string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if len(field) == 2 && field[0] == 'I' && field[1] >= '1' && field[1] <= '5' {
+			return fmt.Sprintf("<redacted, %d bytes>", len(v))
+		}
+	case map[string]string:
+		return fmt.Sprintf("<redacted, %d macros>", len(v))
+	}
+	return v
+}
+
+// WithLogger sets the logger used for configuration changes and warnings.
+func WithLogger(l *slog.Logger) Option {
+	return func(b *Bind) {
+		if l != nil {
+			b.log = l
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package preflightbind
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-ini/ini"
+)
+
+// ErrMissingSection is returned when a config file has no [amnezia] or
+// [AmneziaWarp] section.
+var ErrMissingSection = errors.New("no [amnezia] or [AmneziaWarp] section found")
+
+// ParseError reports a config that could not be decoded, or a key or value
+// in it that does not fit an AtomicNoizeConfig field. Source names the
+// format that was attempted.
+type ParseError struct {
+	Source string
+	Err    error
+}
+
+func (e *ParseError) Error() string { return fmt.Sprintf("parse %s config: %v", e.Source, e.Err) }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// amneziaSections are the section names ParseAmneziaConfigSection accepts,
+// compared case-insensitively.
+var amneziaSections = []string{"amneziawarp", "amnezia"}
+
+// ParseAmneziaConfigSection reads a TOML or wg-quick style INI file and
+// returns the AtomicNoizeConfig described by its [amnezia] or [AmneziaWarp]
+// section. Keys are matched case-insensitively against the standard
+// AmneziaWG names (Jc, Jmin, Jmax, S1, S2, H1-H4, I1-I5) and the remaining
+// AtomicNoizeConfig field names (JcAfterI1, JunkInterval, ...).
+//
+// If the section is absent the error is ErrMissingSection; decoding failures
+// and unknown keys or bad values are reported as *ParseError.
+func ParseAmneziaConfigSection(r io.Reader) (*AtomicNoizeConfig, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// wg-quick files are not valid TOML (unquoted values), so fall back to INI
+	source := "toml"
+	values, err := tomlSection(data)
+	if err != nil && !errors.Is(err, ErrMissingSection) {
+		source = "ini"
+		values, err = iniSection(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &AtomicNoizeConfig{}
+	for key, value := range values {
+		if err := setConfigField(cfg, key, value); err != nil {
+			return nil, &ParseError{Source: source, Err: err}
+		}
+	}
+	return cfg, nil
+}
+
+func tomlSection(data []byte) (map[string]string, error) {
+	var doc map[string]interface{}
+	if _, err := toml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return nil, &ParseError{Source: "toml", Err: err}
+	}
+	for name, section := range doc {
+		if !isAmneziaSection(name) {
+			continue
+		}
+		table, ok := section.(map[string]interface{})
+		if !ok {
+			return nil, &ParseError{Source: "toml", Err: fmt.Errorf("%s is not a table", name)}
+		}
+		values := make(map[string]string, len(table))
+		for k, v := range table {
+			values[k] = fmt.Sprint(v)
+		}
+		return values, nil
+	}
+	return nil, ErrMissingSection
+}
+
+func iniSection(data []byte) (map[string]string, error) {
+	// CPS strings are kept verbatim, so '#' and ';' are not comment markers
+	file, err := ini.LoadSources(ini.LoadOptions{Insensitive: true, IgnoreInlineComment: true}, data)
+	if err != nil {
+		return nil, &ParseError{Source: "ini", Err: err}
+	}
+	for _, section := range file.Sections() {
+		if isAmneziaSection(section.Name()) {
+			return section.KeysHash(), nil
+		}
+	}
+	return nil, ErrMissingSection
+}
+
+func isAmneziaSection(name string) bool {
+	for _, s := range amneziaSections {
+		if strings.EqualFold(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// setConfigField assigns value to the AtomicNoizeConfig field whose name
+// matches key case-insensitively.
+func setConfigField(cfg *AtomicNoizeConfig, key, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	field := v.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+	if !field.IsValid() {
+		return fmt.Errorf("%w: unknown AtomicNoize key %q", ErrConfigInvalid, key)
+	}
+
+	value = strings.TrimSpace(value)
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := parseDurationValue(value)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s: %w", ErrConfigInvalid, key, err)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s: %w", ErrConfigInvalid, key, err)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s: %w", ErrConfigInvalid, key, err)
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Uint32:
+		n, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s: %w", ErrConfigInvalid, key, err)
+		}
+		field.SetUint(n)
+	case field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s: %w", ErrConfigInvalid, key, err)
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("%w: unsupported AtomicNoize key %q", ErrConfigInvalid, key)
+	}
+	return nil
+}
+
+// parseDurationValue accepts Go duration strings ("5ms") and bare integers,
+// which are taken as milliseconds.
+func parseDurationValue(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,149 @@
+package preflightbind
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ReadConfig loads an AtomicNoizeConfig from r, whatever its format. Input
+// that is valid JSON is decoded like ParseAndroidAmneziaConfig, except that
+// every AtomicNoizeConfig field name is accepted, not only the AmneziaWG
+// ones. Anything else is read as TOML and then as INI, like
+// ParseAmneziaConfigSection. The result is validated before it is
+// returned; decoding failures are reported as *ParseError, whose Source
+// names the last format attempted.
+func ReadConfig(r io.Reader) (*AtomicNoizeConfig, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *AtomicNoizeConfig
+	if json.Valid(data) {
+		cfg, err = readJSONConfig(data)
+	} else {
+		cfg, err = ParseAmneziaConfigSection(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readJSONConfig decodes a JSON object, or the "interface" object inside
+// it, into an AtomicNoizeConfig. Keys that name no field are ignored, since
+// app exports carry the rest of the WireGuard config alongside.
+func readJSONConfig(data []byte) (*AtomicNoizeConfig, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, &ParseError{Source: "json", Err: err}
+	}
+	if iface, ok := lookupFold(doc, "interface"); ok {
+		var inner map[string]json.RawMessage
+		if err := json.Unmarshal(iface, &inner); err != nil {
+			return nil, &ParseError{Source: "json", Err: fmt.Errorf("interface: %w", err)}
+		}
+		doc = inner
+	}
+
+	cfg := &AtomicNoizeConfig{}
+	found := false
+	for _, name := range configFieldNames() {
+		raw, ok := lookupFold(doc, name)
+		if !ok {
+			continue
+		}
+		value, err := jsonScalar(raw)
+		if err != nil {
+			return nil, &ParseError{Source: "json", Err: fmt.Errorf("%s: %w", name, err)}
+		}
+		if value == "" {
+			continue
+		}
+		if err := setConfigField(cfg, name, value); err != nil {
+			return nil, &ParseError{Source: "json", Err: err}
+		}
+		found = true
+	}
+	if !found {
+		return nil, &ParseError{Source: "json", Err: fmt.Errorf("%w: no AtomicNoize fields found", ErrConfigInvalid)}
+	}
+	return cfg, nil
+}
+
+// WriteConfig writes cfg to w in format, which is "json", "toml" or "ini",
+// such that ReadConfig returns an equal config. Zero fields are omitted and
+// durations are written as Go duration strings ("5ms"). TOML and INI output
+// is an [amnezia] section. Macros cannot be expressed in these formats, so
+// a config with Macros is an error; expand them into I1-I5 first.
+func WriteConfig(w io.Writer, cfg *AtomicNoizeConfig, format string) error {
+	if cfg == nil {
+		return fmt.Errorf("%w: nil config", ErrConfigInvalid)
+	}
+	if len(cfg.Macros) > 0 {
+		return fmt.Errorf("%w: config macros cannot be written", ErrConfigInvalid)
+	}
+
+	values := make(map[string]any)
+	var names []string
+	v := reflect.ValueOf(cfg).Elem()
+	for _, name := range configFieldNames() {
+		field := v.FieldByName(name)
+		if field.IsZero() {
+			continue
+		}
+		if d, ok := field.Interface().(time.Duration); ok {
+			values[name] = d.String()
+		} else {
+			values[name] = field.Interface()
+		}
+		names = append(names, name)
+	}
+
+	switch strings.ToLower(format) {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false) // keep CPS tags readable
+		enc.SetIndent("", "  ")
+		return enc.Encode(values)
+	case "toml":
+		return toml.NewEncoder(w).Encode(map[string]any{"amnezia": values})
+	case "ini":
+		bw := bufio.NewWriter(w)
+		bw.WriteString("[Amnezia]\n")
+		for _, name := range names {
+			value := fmt.Sprint(values[name])
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("%w: %s cannot be written to INI: value spans lines", ErrConfigInvalid, name)
+			}
+			fmt.Fprintf(bw, "%s = %s\n", name, value)
+		}
+		return bw.Flush()
+	default:
+		return fmt.Errorf("%w: unknown config format %q", ErrConfigInvalid, format)
+	}
+}
+
+// configFieldNames lists the AtomicNoizeConfig fields that setConfigField
+// can assign, in declaration order.
+func configFieldNames() []string {
+	t := reflect.TypeOf(AtomicNoizeConfig{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() != reflect.Map {
+			names = append(names, t.Field(i).Name)
+		}
+	}
+	return names
+}
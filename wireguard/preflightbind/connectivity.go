@@ -0,0 +1,73 @@
+package preflightbind
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ConnectivityResult is the outcome of TestConnectivity.
+type ConnectivityResult struct {
+	PacketDelivered  bool          // I1 was written to the network
+	ResponseReceived bool          // any datagram came back before the deadline
+	RoundTripTime    time.Duration // time from send to first response
+	Error            string        // what went wrong, empty on success
+}
+
+// TestConnectivity sends the Bind's I1 packet to dst from a fresh UDP socket
+// and waits until ctx is done for any reply. It is a standalone diagnostic:
+// it ignores the rate limiter and does not touch the WireGuard socket, so it
+// can tell a delivery problem apart from a timing or rate-limit one. Many
+// servers never answer I1, so a missing response is reported in the result
+// rather than as an error. The returned error is non-nil only when the probe
+// could not be sent.
+func (b *Bind) TestConnectivity(ctx context.Context, dst netip.AddrPort) (ConnectivityResult, error) {
+	var res ConnectivityResult
+	fail := func(err error) (ConnectivityResult, error) {
+		res.Error = err.Error()
+		return res, err
+	}
+
+	_, compiled := b.configFor(dst.Addr())
+	payload, err := compiled.i1.build(&b.cps, 1)
+	if err != nil {
+		return fail(err)
+	}
+	if len(payload) == 0 {
+		return fail(fmt.Errorf("%w: no I1 payload configured", ErrConfigInvalid))
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, preflightDialTimeout)
+		defer cancel()
+	}
+
+	c, err := b.dial(ctx, dst)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.Close()
+	b.applyDSCP(c)
+
+	deadline, _ := ctx.Deadline()
+	_ = c.SetDeadline(deadline)
+	start := time.Now()
+	if _, err := c.Write(wrapInIKEv2Header(payload)); err != nil {
+		return fail(err)
+	}
+	res.PacketDelivered = true
+
+	// Unblock the read if ctx is cancelled before its deadline
+	stop := context.AfterFunc(ctx, func() { _ = c.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 2048)
+	if _, err := c.Read(buf); err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+	res.ResponseReceived = true
+	res.RoundTripTime = time.Since(start)
+	return res, nil
+}
@@ -0,0 +1,52 @@
+package preflightbind
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unescapeCPSString decodes the data of an <s> tag. Text is copied verbatim
+// except for backslash escapes: \r, \n, \t, \\, \> and \xHH. Trailing spaces
+// are kept; leading spaces are consumed by the tag syntax, so use \x20 for
+// them.
+func unescapeCPSString(s string) ([]byte, error) {
+	if !strings.Contains(s, `\`) {
+		return []byte(s), nil
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, fmt.Errorf("%w: trailing backslash", ErrInvalidCPSTag)
+		}
+		switch s[i] {
+		case 'r':
+			out = append(out, '\r')
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case '\\', '>':
+			out = append(out, s[i])
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("%w: short \\x escape", ErrInvalidCPSTag)
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid \\x escape %q", ErrInvalidCPSTag, s[i-1:i+3])
+			}
+			out = append(out, byte(v))
+			i += 2
+		default:
+			return nil, fmt.Errorf("%w: unknown escape \\%c", ErrInvalidCPSTag, s[i])
+		}
+	}
+	return out, nil
+}
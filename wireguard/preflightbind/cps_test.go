@@ -0,0 +1,214 @@
+package preflightbind
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCPSPacketTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		cps     string
+		want    []byte // exact output, checked when static is set
+		static  bool   // output is deterministic and parsing is idempotent
+		wantLen int    // expected length for dynamic output
+		wantErr bool
+	}{
+		{name: "empty", cps: "", want: nil, static: true},
+		{name: "plain hex", cps: "<b deadbeef>", want: []byte{0xde, 0xad, 0xbe, 0xef}, static: true},
+		{name: "hex with prefix", cps: "<b 0xDEADBEEF>", want: []byte{0xde, 0xad, 0xbe, 0xef}, static: true},
+		{name: "counter", cps: "<c>", wantLen: 4},
+		{name: "timestamp", cps: "<t>", wantLen: 4},
+		{name: "random", cps: "<r 16>", wantLen: 16},
+		{name: "random without length", cps: "<r>", wantLen: 0},
+		{name: "sequence", cps: "<b 0102><r 8><b 03>", wantLen: 11},
+		{name: "static sequence", cps: "<b 01><b 02><s ab>", want: []byte{1, 2, 'a', 'b'}, static: true},
+		{name: "unknown tag ignored", cps: "<x 00><b ff><q>", want: []byte{0xff}, static: true},
+		{name: "text outside tags ignored", cps: "junk<b ff>junk", want: []byte{0xff}, static: true},
+		{name: "malformed hex", cps: "<b xyz>", wantErr: true},
+		{name: "odd hex length", cps: "<b abc>", wantErr: true},
+		{name: "bad random length", cps: "<r many>", wantErr: true},
+		{name: "oversized random capped", cps: "<r 1001>", wantLen: 1000},
+		{name: "whitespace in tag data", cps: "<b  de ad  be ef >", want: []byte{0xde, 0xad, 0xbe, 0xef}, static: true},
+		{name: "whitespace around length", cps: "<r  16 >", wantLen: 16},
+		{name: "zero byte", cps: "<b ff><z><b ff>", want: []byte{0xff, 0, 0xff}, static: true},
+		{name: "zero run", cps: "<z 3>", want: []byte{0, 0, 0}, static: true},
+		{name: "empty zero run", cps: "<z 0>", want: []byte{}, static: true},
+		{name: "oversized zero run capped", cps: "<z 5000>", want: make([]byte, 1000), static: true},
+		{name: "bad zero length", cps: "<z -1>", wantErr: true},
+		{name: "quic macro", cps: "<p quic>", wantLen: 30},
+		{name: "dns macro", cps: "<p dns_query><b 00>", wantLen: 13},
+		{name: "unknown macro", cps: "<p gopher>", wantErr: true},
+		{name: "group", cps: "<b 16><g2><b 0102><g4><b 03></g4></g2>", want: []byte{0x16, 0, 7, 1, 2, 0, 0, 0, 1, 3}, static: true},
+		{name: "empty group", cps: "<g2></g2>", want: []byte{0, 0}, static: true},
+		{name: "unclosed group", cps: "<g2><b 01>", wantErr: true},
+		{name: "mismatched group", cps: "<g2><b 01></g4>", wantErr: true},
+		{name: "stray group end", cps: "<b 01></g2>", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCPSPacket(tt.cps)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCPSPacket(%q) = %x, want error", tt.cps, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCPSPacket(%q): %v", tt.cps, err)
+			}
+			if !tt.static {
+				if len(got) != tt.wantLen {
+					t.Fatalf("parseCPSPacket(%q) returned %d bytes, want %d", tt.cps, len(got), tt.wantLen)
+				}
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("parseCPSPacket(%q) = %x, want %x", tt.cps, got, tt.want)
+			}
+			again, err := parseCPSPacket(tt.cps)
+			if err != nil || !bytes.Equal(again, got) {
+				t.Fatalf("second parse of %q = %x, %v; want %x", tt.cps, again, err, got)
+			}
+			if isDynamicCPS(tt.cps) {
+				t.Errorf("isDynamicCPS(%q) = true for a static string", tt.cps)
+			}
+		})
+	}
+}
+
+func TestParseCPSPacketTimestamp(t *testing.T) {
+	before := uint32(time.Now().Unix())
+	got, err := parseCPSPacket("<t>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := uint32(time.Now().Unix())
+	if ts := binary.BigEndian.Uint32(got); ts < before || ts > after {
+		t.Fatalf("timestamp %d outside [%d, %d]", ts, before, after)
+	}
+}
+
+func TestParseCPSPacketVersion(t *testing.T) {
+	const cps = "<b 01><if version=1><b 11><endif><if version=2><b 22><if version=3><b 33><endif><endif><b ff>"
+	tests := []struct {
+		version int
+		want    []byte
+	}{
+		{0, []byte{0x01, 0x11, 0xff}}, // DefaultCPSVersion
+		{1, []byte{0x01, 0x11, 0xff}},
+		{2, []byte{0x01, 0x22, 0xff}},
+		{3, []byte{0x01, 0xff}},
+	}
+	for _, tt := range tests {
+		got, err := parseCPSPacketWithContext(cps, &cpsContext{version: tt.version})
+		if err != nil {
+			t.Fatalf("version %d: %v", tt.version, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("version %d: got %x, want %x", tt.version, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"<if version=1><b 00>", "<b 00><endif>", "<if version=99999999999999999999><endif>"} {
+		if _, err := parseCPSPacket(bad); err == nil {
+			t.Errorf("parseCPSPacket(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestParseCPSPacketMacros(t *testing.T) {
+	ctx := &cpsContext{macros: map[string]string{
+		"tls":   "<b 1603><ref ver>",
+		"ver":   "<b 01>",
+		"self":  "<ref self>",
+		"empty": "",
+		// Each level is 16 copies of the one below, 20 bytes times 16^4
+		// once fully expanded
+		"bomb":  strings.Repeat("<ref bomb3>", 16),
+		"bomb3": strings.Repeat("<ref bomb2>", 16),
+		"bomb2": strings.Repeat("<ref bomb1>", 16),
+		"bomb1": strings.Repeat("<ref bomb0>", 16),
+		"bomb0": "<b 0102030405060708>",
+	}}
+	tests := []struct {
+		cps     string
+		want    []byte
+		wantErr bool
+	}{
+		{cps: "<ref tls><b ff>", want: []byte{0x16, 0x03, 0x01, 0xff}},
+		{cps: "<def hdr><b aa><ref ver><enddef><ref hdr><ref hdr>", want: []byte{0xaa, 0x01, 0xaa, 0x01}},
+		{cps: "<def ver><b 02><enddef><ref tls>", want: []byte{0x16, 0x03, 0x02}}, // inline wins
+		{cps: "<b 01><ref empty>", want: []byte{0x01}},
+		{cps: "<ref missing>", wantErr: true},
+		{cps: "<ref self>", wantErr: true},
+		{cps: "<ref bomb>", wantErr: true},
+		{cps: "<def open><b 01>", wantErr: true},
+		{cps: "<b 01><enddef>", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCPSPacketWithContext(tt.cps, ctx)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCPSPacket(%q) = %x, want error", tt.cps, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCPSPacket(%q): %v", tt.cps, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("parseCPSPacket(%q) = %x, want %x", tt.cps, got, tt.want)
+		}
+	}
+
+	cfg := &AtomicNoizeConfig{I1: "<ref hdr>", I2: "<ref hdr><c>", I3: "<ref hdr>", Macros: map[string]string{"hdr": "<b c0ffee>"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	cc, err := precompileConfig(cfg, nil)
+	if err != nil {
+		t.Fatalf("precompileConfig: %v", err)
+	}
+	if !bytes.Equal(cc.i1.static, []byte{0xc0, 0xff, 0xee}) {
+		t.Errorf("I1 compiled to %x, want c0ffee", cc.i1.static)
+	}
+	if got := cc.signatures[0].cps; got != "<b c0ffee><c>" {
+		t.Errorf("dynamic I2 kept as %q, want macros expanded", got)
+	}
+	if got := cc.signatures[1].static; !bytes.Equal(got, []byte{0xc0, 0xff, 0xee}) {
+		t.Errorf("I3 compiled to %x, want c0ffee", got)
+	}
+}
+
+// TestParseCPSPacketDocExamples keeps the examples in parseCPSPacket's
+// documentation working.
+func TestParseCPSPacketDocExamples(t *testing.T) {
+	ctx := &cpsContext{hmacKey: []byte("key")}
+	tests := []struct {
+		cps     string
+		wantLen int // 0 to skip the length check
+	}{
+		{"<b 160301><g2><b 01><r 64></g2>", 70},
+		{"<p tls_hello>", 0},
+		{"<p quic><r 1000><r 170>", quicMinInitialSize},
+		{"<b 0102><r 64>", 66},
+		{`<p dns_query><s \x07example\x03com><z><b 00010001>`, 12 + 13 + 4},
+		{"<b c0><t><e 16><h>", 1 + 4 + 16 + packetMACSize},
+		{"<def tls><b 1603><enddef><ref tls><b 01>", 3},
+	}
+	for _, tt := range tests {
+		got, err := parseCPSPacketWithContext(tt.cps, ctx)
+		if err != nil {
+			t.Errorf("parseCPSPacket(%q): %v", tt.cps, err)
+			continue
+		}
+		if tt.wantLen != 0 && len(got) != tt.wantLen {
+			t.Errorf("parseCPSPacket(%q) returned %d bytes, want %d", tt.cps, len(got), tt.wantLen)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package preflightbind
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultCPSVersion is the version <if version=X> blocks are evaluated
+// against unless WithCPSVersion says otherwise.
+const DefaultCPSVersion = 1
+
+// cpsCondRegex matches the opening and closing tags of a conditional block.
+var cpsCondRegex = regexp.MustCompile(`<if\s+version\s*=\s*(\d+)\s*>|<endif\s*>`)
+
+// WithCPSVersion sets the client version used to evaluate
+// <if version=X>...<endif> blocks in I1-I5, so one config can carry
+// different bytes for different client versions.
+func WithCPSVersion(v int) Option {
+	return func(b *Bind) {
+		b.cps.version = v
+	}
+}
+
+// selectCPSVersion returns cps with every <if version=X>...<endif> block
+// resolved for version: blocks whose X matches keep their contents, others
+// are dropped. Blocks may nest; a block is kept only if every enclosing block
+// matches as well.
+func selectCPSVersion(cps string, version int) (string, error) {
+	if !strings.Contains(cps, "<if") && !strings.Contains(cps, "<endif") {
+		return cps, nil
+	}
+
+	var out strings.Builder
+	var stack []bool // whether each open block matches
+	active := func() bool {
+		for _, ok := range stack {
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	last := 0
+	for _, m := range cpsCondRegex.FindAllStringSubmatchIndex(cps, -1) {
+		if active() {
+			out.WriteString(cps[last:m[0]])
+		}
+		last = m[1]
+		if m[2] < 0 { // <endif>
+			if len(stack) == 0 {
+				return "", fmt.Errorf("%w: <endif> without matching <if>", ErrInvalidCPSTag)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		want, err := strconv.Atoi(cps[m[2]:m[3]])
+		if err != nil {
+			return "", fmt.Errorf("%w: <if> version: %w", ErrInvalidCPSTag, err)
+		}
+		stack = append(stack, want == version)
+	}
+	if len(stack) != 0 {
+		return "", fmt.Errorf("%w: <if> without matching <endif>", ErrInvalidCPSTag)
+	}
+	out.WriteString(cps[last:])
+	return out.String(), nil
+}
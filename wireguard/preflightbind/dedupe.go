@@ -0,0 +1,49 @@
+package preflightbind
+
+import (
+	"net/netip"
+	"time"
+)
+
+// initSenderOffset is the offset of the sender index in a WireGuard handshake
+// initiation (see device.MessageInitiation).
+const initSenderOffset = 4
+
+// seenInit is the last initiation sent to a destination.
+type seenInit struct {
+	sender uint32
+	at     time.Time
+}
+
+// WithDedupeWindow suppresses preflights for an initiation that repeats the
+// sender index of the last one sent to the same destination within d, even
+// if the rate-limit interval has passed in the meantime. wireguard-go picks
+// a new sender index for every initiation it creates, so this only catches
+// the same message being sent twice, e.g. by a caller retrying a failed Send.
+// A zero d disables the check.
+func WithDedupeWindow(d time.Duration) Option {
+	return func(b *Bind) {
+		b.dedupeWindow = d
+	}
+}
+
+// seenInitiation reports whether buf repeats the initiation last sent to dst
+// within the dedupe window, and remembers it otherwise. It must be called
+// with b.mu held.
+func (b *Bind) seenInitiation(dst netip.Addr, buf []byte, now time.Time) bool {
+	if b.dedupeWindow <= 0 {
+		return false
+	}
+	sender, ok := senderIndex(buf)
+	if !ok {
+		return false
+	}
+	if last, ok := b.seenInits[dst]; ok && last.sender == sender && now.Sub(last.at) < b.dedupeWindow {
+		return true
+	}
+	if b.seenInits == nil {
+		b.seenInits = make(map[netip.Addr]seenInit)
+	}
+	b.seenInits[dst] = seenInit{sender: sender, at: now}
+	return false
+}
@@ -0,0 +1,82 @@
+package preflightbind
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Diagnostics returns a multi-line, human-readable snapshot of the Bind's
+// internals for bug reports: the inner Bind, the active config, the
+// rate-limiter entries, the counters from Stats and the background
+// goroutines that are running. I1-I5 and macro contents are left out, since
+// they can identify the deployment; only whether each is set is shown.
+func (b *Bind) Diagnostics() string {
+	var sb strings.Builder
+	w := func(format string, args ...any) { fmt.Fprintf(&sb, format+"\n", args...) }
+
+	w("inner bind: %T", b.inner)
+	w("preflight port: %d", b.port443)
+	w("open: %v, frozen: %v, state: %s", b.IsOpen(), b.frozen.Load(), b.State())
+
+	cfg := b.Config()
+	if cfg == nil {
+		w("amnezia: disabled")
+	} else {
+		w("amnezia: enabled")
+		w("  junk: Jc=%d Jmin=%d Jmax=%d JcAfterI1=%d JcBeforeHS=%d JcAfterHS=%d AllowZeroSize=%v AdaptiveJunk=%v",
+			cfg.Jc, cfg.Jmin, cfg.Jmax, cfg.JcAfterI1, cfg.JcBeforeHS, cfg.JcAfterHS, cfg.AllowZeroSize, cfg.AdaptiveJunk)
+		w("  timing: JunkInterval=%v HandshakeDelay=%v JitterFraction=%g", cfg.JunkInterval, cfg.HandshakeDelay, cfg.JitterFraction)
+		w("  prefixes: S1=%d S2=%d H1-H4=%d/%d/%d/%d", cfg.S1, cfg.S2, cfg.H1, cfg.H2, cfg.H3, cfg.H4)
+		var sigs []string
+		for i, sig := range []string{cfg.I1, cfg.I2, cfg.I3, cfg.I4, cfg.I5} {
+			if sig != "" {
+				sigs = append(sigs, fmt.Sprintf("I%d", i+1))
+			}
+		}
+		if len(sigs) == 0 {
+			sigs = []string{"none"}
+		}
+		w("  signatures set: %s, macros: %d", strings.Join(sigs, " "), len(cfg.Macros))
+	}
+
+	b.mu.Lock()
+	type entry struct {
+		dst  netip.Addr
+		last time.Time
+	}
+	entries := make([]entry, 0, len(b.lastSent))
+	for dst, last := range b.lastSent {
+		entries = append(entries, entry{dst, last})
+	}
+	junkDsts := make([]string, 0, len(b.bgJunk))
+	for _, dst := range b.bgJunk {
+		junkDsts = append(junkDsts, dst.String())
+	}
+	pruner, worker, persisting := b.pruneStop != nil, b.preflightJobs != nil, b.persistStop != nil
+	b.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b entry) int { return a.dst.Compare(b.dst) })
+	w("rate limiter: interval %v, %d entries", b.interval, len(entries))
+	now := time.Now()
+	for _, e := range entries {
+		w("  %s  last sent %s (%v ago)", e.dst, e.last.Format(time.RFC3339), now.Sub(e.last).Round(time.Millisecond))
+	}
+
+	s := b.Stats()
+	w("stats: preflights=%d junk=%d packets/%d bytes inits=%d responses=%d transport=%d send failures=%d",
+		s.TotalPreflightsFired, s.TotalJunkPacketsSent, s.TotalJunkBytesSent,
+		s.HandshakeInitsSent, s.HandshakeResponsesSent, s.TransportMsgsSent, b.sendFailures.Load())
+	if !s.LastPreflightTime.IsZero() {
+		w("  last preflight: %s", s.LastPreflightTime.Format(time.RFC3339))
+	}
+
+	slices.Sort(junkDsts)
+	w("background goroutines:")
+	w("  pruner: %v, preflight worker: %v, persistence: %v", pruner, worker, persisting)
+	w("  post-handshake junk senders: %d", s.ActivePostHandshakeGoroutines)
+	w("  background junk loops: %d %s", len(junkDsts), strings.Join(junkDsts, " "))
+	return sb.String()
+}
@@ -0,0 +1,144 @@
+package preflightbind
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ikev2FramingSize is the IKEv2 header and SA payload wrapInIKEv2Header puts
+// in front of I1.
+const ikev2FramingSize = 28 + 24
+
+var dissectorNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// dissectorField is one field of the I1 layout.
+type dissectorField struct {
+	label  string
+	length int
+	kind   string // ProtoField constructor: bytes, uint16, uint32 or string
+	expect []byte // expected value of a static field, nil for dynamic ones
+}
+
+// GenerateLuaDissector returns a Wireshark Lua dissector for the I1 packets
+// config sends, named profile (lowercase letters, digits and underscores,
+// used as the display filter name). Each CPS tag of I1 becomes a field:
+// <b>, <s> and <z> show their expected value and are flagged when a packet
+// differs, while <r>, <e>, <c>, <t>, <h>, <p> and group lengths are shown
+// without a check. Macros are expanded and version blocks resolved for
+// DefaultCPSVersion. The lengths of <p> skeletons are taken from one
+// sample, so fields after a tls_hello may be misplaced if its size varies.
+//
+// Load the script from Wireshark's plugin folder or with -X
+// lua_script:file.lua, then pick the protocol for the WireGuard port with
+// Decode As.
+func GenerateLuaDissector(profile string, config *AtomicNoizeConfig) (string, error) {
+	if !dissectorNameRegex.MatchString(profile) {
+		return "", fmt.Errorf("%w: invalid dissector name %q: use lowercase letters, digits and underscores", ErrConfigInvalid, profile)
+	}
+	if config == nil || config.I1 == "" {
+		return "", fmt.Errorf("%w: config has no I1 to describe", ErrConfigInvalid)
+	}
+	fields, err := dissectorFields(config)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	w := func(format string, args ...any) { fmt.Fprintf(&sb, format+"\n", args...) }
+	w("-- Wireshark dissector for %s preflight I1 packets, generated by preflightbind.", profile)
+	w("local proto = Proto(%q, %q)", profile, profile+" preflight I1")
+	w("local f = {}")
+	for i, fld := range fields {
+		w("f[%d] = ProtoField.%s(%q, %q)", i+1, fld.kind, fmt.Sprintf("%s.f%d", profile, i+1), fld.label)
+	}
+	w("proto.fields = f")
+	w("")
+	w("local function check(item, range, expected)")
+	w("  if range:bytes():tohex():lower() ~= expected then")
+	w("    item:append_text(\" [unexpected, want \" .. expected .. \"]\")")
+	w("  end")
+	w("end")
+	w("")
+	w("function proto.dissector(buf, pinfo, tree)")
+	w("  pinfo.cols.protocol = %q", strings.ToUpper(profile))
+	w("  local t = tree:add(proto, buf())")
+	w("  local off = 0")
+	for i, fld := range fields {
+		if fld.length == 0 {
+			continue
+		}
+		w("  if buf:len() < off + %d then return end", fld.length)
+		w("  do")
+		w("    local r = buf(off, %d)", fld.length)
+		w("    local item = t:add(f[%d], r)", i+1)
+		if fld.expect != nil {
+			w("    check(item, r, %q)", hex.EncodeToString(fld.expect))
+		}
+		w("  end")
+		w("  off = off + %d", fld.length)
+	}
+	w("end")
+	w("")
+	w("DissectorTable.get(\"udp.port\"):add_for_decode_as(proto)")
+	return sb.String(), nil
+}
+
+// dissectorFields lays out config's I1, including its IKEv2 framing, as a
+// list of fields.
+func dissectorFields(config *AtomicNoizeConfig) ([]dissectorField, error) {
+	cps, err := expandCPSMacros(config.I1, config.Macros)
+	if err != nil {
+		return nil, err
+	}
+	if cps, err = selectCPSVersion(cps, DefaultCPSVersion); err != nil {
+		return nil, err
+	}
+
+	fields := []dissectorField{{label: "IKEv2 framing", length: ikev2FramingSize, kind: "bytes"}}
+	// A placeholder key lets <h> be sized without the real one
+	ctx := &cpsContext{hmacKey: []byte{0}}
+	for _, m := range cpsTagRegex.FindAllStringSubmatch(cps, -1) {
+		tag, data := m[1], strings.TrimSpace(m[2])
+		switch tag {
+		case "g2":
+			fields = append(fields, dissectorField{label: "group length", length: 2, kind: "uint16"})
+			continue
+		case "g4":
+			fields = append(fields, dissectorField{label: "group length", length: 4, kind: "uint32"})
+			continue
+		case "/g2", "/g4":
+			continue
+		}
+
+		value, err := parseCPSPacketWithContext(m[0], ctx)
+		if err != nil {
+			return nil, err
+		}
+		fld := dissectorField{length: len(value), kind: "bytes"}
+		switch tag {
+		case "b":
+			fld.label, fld.expect = "static bytes", value
+		case "z":
+			fld.label, fld.expect = "zero bytes", value
+		case "s":
+			fld.label, fld.expect, fld.kind = "text "+strconv.Quote(string(value)), value, "string"
+		case "c":
+			fld.label, fld.kind = "counter", "uint32"
+		case "t":
+			fld.label, fld.kind = "timestamp", "uint32"
+		case "r":
+			fld.label = "random"
+		case "e":
+			fld.label = "nonce"
+		case "h":
+			fld.label = "MAC"
+		case "p":
+			fld.label = data + " skeleton"
+		}
+		fields = append(fields, fld)
+	}
+	return fields, nil
+}
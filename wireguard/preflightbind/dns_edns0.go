@@ -0,0 +1,64 @@
+package preflightbind
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// EDNS(0) values used by BuildEDNS0PaddedQuery.
+const (
+	ednsPaddingOption = 12   // RFC 7830 Padding option code
+	ednsUDPSize       = 1232 // advertised UDP payload size, the DNS Flag Day 2020 value
+)
+
+// BuildEDNS0PaddedQuery returns a recursive DNS query for domain and qtype
+// (1 for A, 28 for AAAA, ...) suitable for use as the I1 payload. It carries
+// an EDNS(0) OPT record whose Padding option (RFC 7830) brings the message
+// to exactly paddedSize bytes, which is how privacy-conscious resolvers
+// make queries uniform in size; RFC 8467 recommends padding queries to a
+// multiple of 128. The query ID is random on every call.
+func BuildEDNS0PaddedQuery(domain string, qtype uint16, paddedSize int) ([]byte, error) {
+	name, err := dnsmessage.NewName(dnsFQDN(domain))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid domain %q: %w", ErrConfigInvalid, domain, err)
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	build := func(pad int) ([]byte, error) {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return nil, err
+		}
+		msg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.Type(qtype), Class: dnsmessage.ClassINET}},
+			Additionals: []dnsmessage.Resource{{
+				Header: opt,
+				Body: &dnsmessage.OPTResource{Options: []dnsmessage.Option{
+					{Code: ednsPaddingOption, Data: make([]byte, pad)},
+				}},
+			}},
+		}
+		return msg.Pack()
+	}
+
+	// An empty Padding option is the smallest message; the padding then
+	// fills the difference
+	unpadded, err := build(0)
+	if err != nil {
+		return nil, err
+	}
+	if paddedSize < len(unpadded) {
+		return nil, fmt.Errorf("%w: padded size %d is below the %d bytes the query needs", ErrConfigInvalid, paddedSize, len(unpadded))
+	}
+	if paddedSize > 0xFFFF {
+		return nil, fmt.Errorf("%w: padded size %d exceeds a DNS message", ErrPacketTooBig, paddedSize)
+	}
+	return build(paddedSize - len(unpadded))
+}
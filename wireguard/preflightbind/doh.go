@@ -0,0 +1,208 @@
+package preflightbind
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultDOHCacheTTL is how long a DoH answer is reused.
+const defaultDOHCacheTTL = 60 * time.Second
+
+// WithDOHResolver resolves the peer's host name, set with WithDOHHost, with
+// DNS over HTTPS (RFC 8484) at dohURL, e.g. "https://1.1.1.1/dns-query",
+// before each preflight, for networks that tamper with plain DNS. The
+// preflight packets then go to the DoH answer on the endpoint's port, even
+// if the address WireGuard was given came from a poisoned lookup. IPv4
+// addresses are preferred over IPv6. Answers are cached for 60s or as set
+// by WithDOHCacheTTL. This is separate from the inner Bind's endpoint
+// resolution: ParseEndpoint and the handshake itself are unaffected, and a
+// failed lookup leaves the preflight on the endpoint's own address.
+func WithDOHResolver(dohURL string) Option {
+	return func(b *Bind) {
+		b.doh = &dohResolver{
+			url:       dohURL,
+			client:    &http.Client{Timeout: preflightDialTimeout},
+			userAgent: func() string { return b.userAgent },
+		}
+	}
+}
+
+// WithDOHHost names the host the peer endpoint was resolved from, such as
+// "engage.cloudflareclient.com", for WithDOHResolver to look up.
+func WithDOHHost(host string) Option {
+	return func(b *Bind) {
+		b.dohHost = host
+	}
+}
+
+// WithDOHCacheTTL sets how long WithDOHResolver reuses an answer. A
+// non-positive d restores the default of 60s.
+func WithDOHCacheTTL(d time.Duration) Option {
+	return func(b *Bind) {
+		b.dohTTL = d
+	}
+}
+
+// ParseEndpoint parses s with the inner Bind.
+func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return b.inner.ParseEndpoint(s)
+}
+
+// preflightEndpoint returns where the preflight for ep is sent: ep itself,
+// or the DoH answer for the WithDOHHost name on ep's port.
+func (b *Bind) preflightEndpoint(ctx context.Context, ep conn.Endpoint) conn.Endpoint {
+	if b.doh == nil || b.dohHost == "" {
+		return ep
+	}
+	ttl := b.dohTTL
+	if ttl <= 0 {
+		ttl = defaultDOHCacheTTL
+	}
+	addr, err := b.doh.resolve(ctx, b.dohHost, ttl)
+	if err != nil {
+		b.reportError(fmt.Errorf("resolving %s over DoH: %w", b.dohHost, err), "DoH")
+		return ep
+	}
+	if addr == ep.DstIP() {
+		return ep
+	}
+	port := uint16(b.port443)
+	if dst, err := netip.ParseAddrPort(ep.DstToString()); err == nil {
+		port = dst.Port()
+	}
+	pep, err := b.inner.ParseEndpoint(netip.AddrPortFrom(addr, port).String())
+	if err != nil {
+		b.reportError(err, "DoH")
+		return ep
+	}
+	return pep
+}
+
+// dohResolver resolves host names over DoH and caches the answers.
+type dohResolver struct {
+	url       string
+	client    *http.Client
+	userAgent func() string // read per query, since options may follow
+
+	mu    sync.Mutex
+	cache map[string]dohAnswer
+}
+
+type dohAnswer struct {
+	addr    netip.Addr
+	expires time.Time
+}
+
+// resolve returns an address for host, from the cache if it is younger
+// than ttl.
+func (r *dohResolver) resolve(ctx context.Context, host string, ttl time.Duration) (netip.Addr, error) {
+	now := time.Now()
+	r.mu.Lock()
+	if a, ok := r.cache[host]; ok && now.Before(a.expires) {
+		r.mu.Unlock()
+		return a.addr, nil
+	}
+	r.mu.Unlock()
+
+	var addr netip.Addr
+	var err error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if addr, err = r.query(ctx, host, qtype); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]dohAnswer)
+	}
+	r.cache[host] = dohAnswer{addr: addr, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return addr, nil
+}
+
+// errNoDOHAnswer means the DoH server returned no record of the asked type.
+var errNoDOHAnswer = errors.New("no address in DoH answer")
+
+// query sends one DoH GET request for host's qtype records and returns the
+// first address in the answer.
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) (netip.Addr, error) {
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true}, // ID 0, as RFC 8484 recommends for caching
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		r.url+"?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	setUserAgent(req.Header, r.userAgent())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("%w: DoH server answered %s", ErrDialFailed, resp.Status)
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != "application/dns-message" {
+		return netip.Addr{}, fmt.Errorf("%w: unexpected DoH content type %q", ErrDialFailed, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(body); err != nil {
+		return netip.Addr{}, err
+	}
+	if answer.RCode != dnsmessage.RCodeSuccess {
+		return netip.Addr{}, fmt.Errorf("%w: DoH answer code %v", ErrDialFailed, answer.RCode)
+	}
+	for _, rr := range answer.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				return netip.AddrFrom4(body.A), nil
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				return netip.AddrFrom16(body.AAAA), nil
+			}
+		}
+	}
+	return netip.Addr{}, errNoDOHAnswer
+}
+
+// dnsFQDN returns host with a trailing dot.
+func dnsFQDN(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
@@ -0,0 +1,44 @@
+package preflightbind
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxDSCP is the largest value of the 6-bit DSCP field.
+const maxDSCP = 63
+
+// WithDSCP marks raw preflight sockets with the given DSCP value so that, on
+// QoS-aware networks, preflight packets are queued like the WireGuard traffic
+// that follows them. Values above 63 do not fit the 6-bit field and are
+// ignored. Packets sent on the WireGuard socket keep that socket's marking.
+func WithDSCP(dscp byte) Option {
+	return func(b *Bind) {
+		if dscp > maxDSCP {
+			b.log.Warn("ignoring out-of-range DSCP value", "dscp", dscp)
+			return
+		}
+		b.dscp = dscp
+		b.dscpSet = true
+	}
+}
+
+// applyDSCP sets the configured DSCP on c, which is connected to an IPv4 or
+// IPv6 peer. Failures are logged and the packet is sent unmarked.
+func (b *Bind) applyDSCP(c net.Conn) {
+	if !b.dscpSet {
+		return
+	}
+	tos := int(b.dscp) << 2 // DSCP occupies the upper six bits of TOS
+	var err error
+	if addr, ok := c.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		err = ipv6.NewConn(c).SetTrafficClass(tos)
+	} else {
+		err = ipv4.NewConn(c).SetTOS(tos)
+	}
+	if err != nil {
+		b.log.Debug("could not set DSCP on preflight socket", "error", err)
+	}
+}
@@ -0,0 +1,46 @@
+package preflightbind
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors for the package's failure modes. Returned errors wrap the matching
+// one alongside the underlying cause, so callers can branch with errors.Is
+// and still reach the cause (a *strconv.NumError, a *net.OpError, ...) with
+// errors.As. An error can match more than one: a bad tag in I1 passed to
+// ApplyConfig is both ErrConfigInvalid and ErrInvalidCPSTag.
+var (
+	// ErrInvalidCPSTag reports a malformed CPS string: an unknown protocol,
+	// a bad length, unbalanced groups, macros or version blocks.
+	ErrInvalidCPSTag = errors.New("invalid CPS tag")
+	// ErrHexDecodeFailure reports hex that does not decode, in a <b> tag or
+	// the payload given to New.
+	ErrHexDecodeFailure = errors.New("invalid hex")
+	// ErrRateLimited marks a preflight skipped because the destination was
+	// preflighted within the rate-limit interval. Send never fails for this
+	// reason; it shows up as the Err of EventRateLimited history entries.
+	ErrRateLimited = errors.New("preflight rate limited")
+	// ErrDialFailed reports that a socket or tunnel could not be opened,
+	// including waiting too long for a WithMaxOpenSockets slot, a proxy
+	// handshake that failed, or a DoH server or probe target that did not
+	// answer usefully.
+	ErrDialFailed = errors.New("dial failed")
+	// ErrPacketTooBig reports a packet or payload over a size limit.
+	ErrPacketTooBig = errors.New("packet too big")
+	// ErrConfigInvalid reports an AtomicNoizeConfig rejected by Validate or
+	// whose signature packets could not be compiled, an unknown key or bad
+	// value in a config file, an unknown ${NAME} in InterpolateVars, or a
+	// bad region policy or fallback config. It also covers other rejected
+	// arguments, such as an unknown fingerprint profile or config format.
+	ErrConfigInvalid = errors.New("invalid AtomicNoize config")
+)
+
+// wrapIn wraps err in sentinel unless it already is one, so a cause that
+// carries the sentinel is not reported twice.
+func wrapIn(sentinel, err error) error {
+	if errors.Is(err, sentinel) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", sentinel, err)
+}
@@ -0,0 +1,93 @@
+package preflightbind
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// Defaults for WithHandshakeFailureHook.
+const (
+	defaultFailureThreshold = 5
+	defaultFailureWindow    = 30 * time.Second
+)
+
+// HandshakeFailureHook is called when a peer keeps receiving handshake
+// initiations without answering, with count initiations seen in the window.
+type HandshakeFailureHook func(dst netip.Addr, count int)
+
+// WithHandshakeFailureHook calls hook when threshold handshake initiations
+// go to the same destination within window without a handshake response
+// coming back, which is how a WireGuard device behaves while a session fails
+// to establish. Zero threshold or window mean 5 and 30s. The count restarts
+// after each call, so a persistent failure fires the hook again every
+// threshold initiations; a response from the peer clears it. The hook runs
+// on the Send path and should hand slow work such as rotating configs or
+// alerting off to another goroutine.
+func WithHandshakeFailureHook(hook HandshakeFailureHook, threshold int, window time.Duration) Option {
+	return func(b *Bind) {
+		if threshold <= 0 {
+			threshold = defaultFailureThreshold
+		}
+		if window <= 0 {
+			window = defaultFailureWindow
+		}
+		b.failureHook = hook
+		b.failureThreshold = threshold
+		b.failureWindow = window
+	}
+}
+
+// trackInitiations counts the handshake initiations in bufs towards the
+// failure threshold of ep's destination, firing the hook once it is reached.
+func (b *Bind) trackInitiations(ep conn.Endpoint, bufs [][]byte) {
+	if b.failureHook == nil {
+		return
+	}
+	inits := 0
+	for _, buf := range bufs {
+		if b.classifier.IsHandshakeInit(buf) {
+			inits++
+		}
+	}
+	if inits == 0 {
+		return
+	}
+
+	dst := ep.DstIP()
+	now := time.Now()
+	b.mu.Lock()
+	if b.initTimes == nil {
+		b.initTimes = make(map[netip.Addr][]time.Time)
+	}
+	times := b.initTimes[dst]
+	cutoff := now.Add(-b.failureWindow)
+	for len(times) > 0 && !times[0].After(cutoff) {
+		times = times[1:]
+	}
+	for range inits {
+		times = append(times, now)
+	}
+	count := len(times)
+	if count >= b.failureThreshold {
+		times = nil
+	}
+	b.initTimes[dst] = times
+	b.mu.Unlock()
+
+	if count >= b.failureThreshold {
+		b.failureHook(dst, count)
+	}
+}
+
+// handshakeAnswered clears the failure count of dst after it responded to a
+// handshake.
+func (b *Bind) handshakeAnswered(dst netip.Addr) {
+	if b.failureHook == nil {
+		return
+	}
+	b.mu.Lock()
+	delete(b.initTimes, dst)
+	b.mu.Unlock()
+}
@@ -0,0 +1,128 @@
+package preflightbind
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// compiledFallback is one entry of a WithConfigFallbackList chain.
+type compiledFallback struct {
+	config   *AtomicNoizeConfig
+	compiled compiledConfig
+}
+
+// ParseAmneziaConfigList decodes a JSON array of config objects, in priority
+// order, for use with WithConfigFallbackList. Object keys are matched
+// case-insensitively against the AmneziaWG names (jc, jmin, s1, h1, i1, ...)
+// and the other AtomicNoizeConfig field names; values may be numbers,
+// strings or booleans. Every config is validated.
+func ParseAmneziaConfigList(data []byte) ([]*AtomicNoizeConfig, error) {
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, &ParseError{Source: "json", Err: err}
+	}
+	configs := make([]*AtomicNoizeConfig, 0, len(objects))
+	for i, obj := range objects {
+		cfg := &AtomicNoizeConfig{}
+		for key, raw := range obj {
+			value, err := jsonScalar(raw)
+			if err != nil {
+				return nil, &ParseError{Source: "json", Err: fmt.Errorf("config %d: %s: %w", i, key, err)}
+			}
+			if value == "" {
+				continue
+			}
+			if err := setConfigField(cfg, key, value); err != nil {
+				return nil, &ParseError{Source: "json", Err: fmt.Errorf("config %d: %w", i, err)}
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("config %d: %w", i, err)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// WithConfigFallbackList makes the Bind try configs in order instead of its
+// own config. Each destination starts with the first entry and moves to the
+// next one when its I1 cannot be sent (a dial or send error); the last entry
+// is kept once reached. A destination goes back to the first entry when it
+// answers with a handshake response. Region policies still take precedence,
+// and a later ApplyConfig (or Thaw) discards the list in favour of the
+// config it applies.
+func WithConfigFallbackList(configs []*AtomicNoizeConfig) Option {
+	return func(b *Bind) {
+		b.fallbackConfigs = configs
+	}
+}
+
+// compileFallbacks precompiles the WithConfigFallbackList entries. It runs
+// after all options are applied so the CPS context is final.
+func (b *Bind) compileFallbacks() error {
+	b.fallbacks = b.fallbacks[:0]
+	for i, cfg := range b.fallbackConfigs {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("fallback config %d: %w", i, err)
+		}
+		compiled, err := precompileConfig(cfg, &b.cps)
+		if err != nil {
+			return fmt.Errorf("fallback config %d: %w", i, err)
+		}
+		b.fallbacks = append(b.fallbacks, compiledFallback{config: cfg, compiled: compiled})
+	}
+	return nil
+}
+
+// fallbackConfig returns dst's active fallback entry, if a list is
+// configured.
+func (b *Bind) fallbackConfig(dst netip.Addr) (*AtomicNoizeConfig, compiledConfig, bool) {
+	b.cfgMu.RLock()
+	fallbacks := b.fallbacks
+	b.cfgMu.RUnlock()
+	if len(fallbacks) == 0 {
+		return nil, compiledConfig{}, false
+	}
+	b.mu.Lock()
+	i := min(b.fallbackIdx[dst], len(fallbacks)-1)
+	b.mu.Unlock()
+	return fallbacks[i].config, fallbacks[i].compiled, true
+}
+
+// advanceFallback moves dst to the next fallback entry after its I1 could
+// not be sent.
+func (b *Bind) advanceFallback(dst netip.Addr) {
+	b.cfgMu.RLock()
+	n := len(b.fallbacks)
+	b.cfgMu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := b.fallbackIdx[dst]
+	if i >= n-1 {
+		return
+	}
+	if b.fallbackIdx == nil {
+		b.fallbackIdx = make(map[netip.Addr]int)
+	}
+	b.fallbackIdx[dst] = i + 1
+	b.log.Warn("preflight failed, switching to fallback config", "dst", dst, "index", i+1)
+}
+
+// resetFallback returns dst to the first fallback entry after a handshake.
+func (b *Bind) resetFallback(dst netip.Addr) {
+	b.mu.Lock()
+	delete(b.fallbackIdx, dst)
+	b.mu.Unlock()
+}
+
+// clearFallbacks drops the fallback list, so the Bind's own config applies
+// to every destination again.
+func (b *Bind) clearFallbacks() {
+	b.cfgMu.Lock()
+	b.fallbackConfigs, b.fallbacks = nil, nil
+	b.cfgMu.Unlock()
+	b.mu.Lock()
+	b.fallbackIdx = nil
+	b.mu.Unlock()
+}
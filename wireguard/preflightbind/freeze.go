@@ -0,0 +1,26 @@
+package preflightbind
+
+// Freeze stops the Bind from firing preflights until Thaw is called, e.g.
+// while credentials rotate or a new config is loaded, so stale I1 bytes are
+// never sent. Handshakes still pass through to the inner Bind.
+func (b *Bind) Freeze() {
+	b.frozen.Store(true)
+}
+
+// Thaw resumes preflights after Freeze. If cfg is non-nil it is applied
+// first, as by ApplyConfig, so the next preflight uses it; if it is invalid
+// the Bind stays frozen and the error is returned.
+func (b *Bind) Thaw(cfg *AtomicNoizeConfig) error {
+	if cfg != nil {
+		if err := b.ApplyConfig(cfg); err != nil {
+			return err
+		}
+	}
+	b.frozen.Store(false)
+	return nil
+}
+
+// Frozen reports whether preflights are suspended by Freeze.
+func (b *Bind) Frozen() bool {
+	return b.frozen.Load()
+}
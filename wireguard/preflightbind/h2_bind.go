@@ -0,0 +1,309 @@
+package preflightbind
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+const (
+	h2DialTimeout  = 10 * time.Second
+	h2WriteTimeout = 5 * time.Second
+	h2RecvQueue    = 1024
+)
+
+// h2Bind carries WireGuard packets over one long-lived HTTP/2 POST: the
+// request body carries outgoing datagrams and the response body incoming
+// ones, each preceded by its 2-byte big-endian length.
+type h2Bind struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	stream  *h2Stream
+	dialing chan struct{} // closed when the dial in progress, if any, ends
+	closed  chan struct{}
+	recv    chan []byte
+
+	writeMu sync.Mutex // one datagram is written to the body at a time
+}
+
+// h2Stream is one POST exchange with the server.
+type h2Stream struct {
+	body   *io.PipeWriter
+	resp   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (s *h2Stream) close() {
+	s.cancel()
+	s.body.Close()
+	s.resp.Close()
+}
+
+// H2Bind returns a conn.Bind that tunnels WireGuard through an HTTP/2
+// stream to h2URL, for networks that allow HTTPS but block raw UDP.
+// https:// URLs negotiate HTTP/2 over TLS with tlsConfig (nil for the
+// defaults); http:// URLs speak HTTP/2 without TLS (h2c), for use behind a
+// TLS-terminating proxy.
+//
+// Open starts one POST request whose body stays open: Send writes each
+// datagram to it as a 2-byte big-endian length and the datagram, usually
+// one DATA frame each, and datagrams framed the same way are read from the
+// response body. The length prefix is needed because HTTP/2 does not keep
+// DATA frame boundaries end to end. The server has to send its response
+// headers before reading the body, and relay the datagrams to the
+// WireGuard peer. A dropped stream is reopened by Send. Every endpoint maps
+// to the same stream, as with WSBind, and the result can be wrapped by New
+// or NewWithAtomicNoize like any other Bind.
+func H2Bind(h2URL string, tlsConfig *tls.Config) (conn.Bind, error) {
+	u, err := url.Parse(h2URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP/2 URL %q: %w", h2URL, err)
+	}
+	tr := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true, // needed once TLSClientConfig is set
+	}
+	switch u.Scheme {
+	case "https":
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP2(true)
+	case "http":
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("HTTP/2 URL %q must use https:// or http://", h2URL)
+	}
+	return &h2Bind{url: h2URL, client: &http.Client{Transport: tr}}, nil
+}
+
+func (h *h2Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	h.mu.Lock()
+	if h.closed != nil {
+		h.mu.Unlock()
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	h.closed = closed
+	h.recv = make(chan []byte, h2RecvQueue)
+	h.mu.Unlock()
+
+	if _, err := h.current(); err != nil {
+		h.mu.Lock()
+		if h.closed == closed {
+			h.closed = nil
+		}
+		h.mu.Unlock()
+		return nil, 0, err
+	}
+	return []conn.ReceiveFunc{h.receive}, port, nil
+}
+
+// current returns a live stream, reopening it if the previous one dropped.
+// The POST is made without h.mu held, so Send and Close are not stalled
+// while a slow server sends its response headers; concurrent callers wait
+// for the same dial.
+func (h *h2Bind) current() (*h2Stream, error) {
+	h.mu.Lock()
+	for {
+		if h.closed == nil {
+			h.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if h.stream != nil {
+			s := h.stream
+			h.mu.Unlock()
+			return s, nil
+		}
+		if h.dialing == nil {
+			break
+		}
+		dialing := h.dialing
+		h.mu.Unlock()
+		<-dialing
+		h.mu.Lock()
+	}
+	dialing := make(chan struct{})
+	h.dialing = dialing
+	closed, recv := h.closed, h.recv
+	h.mu.Unlock()
+
+	s, err := h.dial()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dialing = nil
+	close(dialing)
+	if err != nil {
+		return nil, err
+	}
+	if h.closed != closed {
+		// Closed, and maybe reopened, while dialing; no reader was started
+		// for s, so closing it leaves nothing behind
+		s.close()
+		return nil, net.ErrClosed
+	}
+	h.stream = s
+	go h.readDatagrams(s, closed, recv)
+	return s, nil
+}
+
+// dial starts the POST and waits for the server's response headers.
+func (h *h2Bind) dial() (*h2Stream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// The context lives as long as the stream, so the dial timeout cancels
+	// it only while waiting for the response headers
+	timer := time.AfterFunc(h2DialTimeout, cancel)
+	resp, err := h.client.Do(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %w", ErrDialFailed, err)
+	}
+	s := &h2Stream{body: pw, resp: resp.Body, cancel: cancel}
+	if resp.ProtoMajor != 2 {
+		s.close()
+		return nil, fmt.Errorf("%w: server at %s answered with %s, not HTTP/2", ErrDialFailed, h.url, resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		s.close()
+		return nil, fmt.Errorf("%w: server at %s answered %s", ErrDialFailed, h.url, resp.Status)
+	}
+	return s, nil
+}
+
+func (h *h2Bind) readDatagrams(s *h2Stream, closed chan struct{}, recv chan []byte) {
+	defer func() {
+		h.mu.Lock()
+		if h.stream == s {
+			h.stream = nil
+		}
+		h.mu.Unlock()
+		s.close()
+	}()
+	r := bufio.NewReader(s.resp)
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		select {
+		case recv <- data:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (h *h2Bind) receive(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	h.mu.Lock()
+	closed, recv := h.closed, h.recv
+	h.mu.Unlock()
+	if closed == nil {
+		return 0, net.ErrClosed
+	}
+
+	var packet []byte
+	select {
+	case packet = <-recv:
+	case <-closed:
+		return 0, net.ErrClosed
+	}
+	ep := &wsEndpoint{uri: h.url}
+
+	n := 0
+	for {
+		sizes[n] = copy(packets[n], packet)
+		eps[n] = ep
+		n++
+		if n == len(packets) {
+			return n, nil
+		}
+		select {
+		case packet = <-recv:
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (h *h2Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	s, err := h.current()
+	if err != nil {
+		return err
+	}
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	// A pipe has no deadlines; a stalled stream is torn down instead, which
+	// fails the write and makes the next Send reopen it
+	timer := time.AfterFunc(h2WriteTimeout, s.close)
+	defer timer.Stop()
+	for _, buf := range bufs {
+		if len(buf) > 0xFFFF {
+			return fmt.Errorf("%w: %d bytes for HTTP/2 framing", ErrPacketTooBig, len(buf))
+		}
+		frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(buf)), uint16(len(buf)))
+		if _, err := s.body.Write(append(frame, buf...)); err != nil {
+			s.close() // the reader notices and clears h.stream for a redial
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *h2Bind) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed == nil {
+		return nil
+	}
+	close(h.closed)
+	h.closed = nil
+	if h.stream != nil {
+		h.stream.close()
+		h.stream = nil
+	}
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+func (h *h2Bind) SetMark(uint32) error { return nil }
+func (h *h2Bind) BatchSize() int       { return conn.IdealBatchSize }
+
+// ParseEndpoint accepts an https:// or http:// URI, or a plain "ip:port"
+// peer address. Either way packets travel over the Bind's own stream.
+func (h *h2Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if u, err := url.Parse(s); err == nil && (u.Scheme == "https" || u.Scheme == "http") {
+		return &wsEndpoint{uri: s}, nil
+	}
+	if _, err := netip.ParseAddrPort(s); err != nil {
+		return nil, errors.New("endpoint must be an https:// or http:// URI or an ip:port address")
+	}
+	return &wsEndpoint{uri: s}, nil
+}
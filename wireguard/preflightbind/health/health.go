@@ -0,0 +1,91 @@
+// Package health serves a preflightbind.Bind's state over HTTP, for daemons
+// that expose liveness and metrics to a sidecar or scraper.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
+)
+
+const redacted = "<redacted>"
+
+// StartHealthServer listens on addr and serves, in the background:
+//
+//   - GET /healthz: 200 while bind is open, 503 otherwise
+//   - GET /metrics: bind.Stats() in the Prometheus text format
+//   - GET /config: the active config as JSON, with I1-I5 redacted
+//
+// The returned server's Addr holds the address actually listened on, which
+// matters when addr asks for port 0. Call Shutdown on it to stop serving.
+func StartHealthServer(addr string, bind *preflightbind.Bind) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Addr:              ln.Addr().String(),
+		Handler:           Handler(bind),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go srv.Serve(ln)
+	return srv, nil
+}
+
+// Handler returns the handler StartHealthServer serves, for callers that
+// want to mount it on their own server.
+func Handler(bind *preflightbind.Bind) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !bind.IsOpen() {
+			http.Error(w, "closed", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, bind.Stats())
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sanitize(bind.Config()))
+	})
+	return mux
+}
+
+// writeMetrics writes s as Prometheus gauges and counters.
+func writeMetrics(w http.ResponseWriter, s preflightbind.Stats) {
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("preflightbind_rate_limiter_entries", "gauge", "Destinations tracked by the rate limiter.", s.RateLimiterEntries)
+	metric("preflightbind_preflights_total", "counter", "Preflight sequences started.", s.TotalPreflightsFired)
+	metric("preflightbind_junk_packets_total", "counter", "Junk packets sent.", s.TotalJunkPacketsSent)
+	metric("preflightbind_junk_bytes_total", "counter", "Bytes in junk packets sent.", s.TotalJunkBytesSent)
+	var last float64
+	if !s.LastPreflightTime.IsZero() {
+		last = float64(s.LastPreflightTime.UnixNano()) / 1e9
+	}
+	metric("preflightbind_last_preflight_timestamp_seconds", "gauge", "Unix time of the last preflight, 0 if none.", last)
+	metric("preflightbind_post_handshake_active", "gauge", "Post-handshake junk senders running.", s.ActivePostHandshakeGoroutines)
+	metric("preflightbind_background_junk_active", "gauge", "Background junk loops running.", s.ActiveBackgroundJunk)
+}
+
+// sanitize returns cfg with its signature packets redacted, since they can
+// identify the deployment.
+func sanitize(cfg *preflightbind.AtomicNoizeConfig) *preflightbind.AtomicNoizeConfig {
+	if cfg == nil {
+		return nil
+	}
+	for _, sig := range []*string{&cfg.I1, &cfg.I2, &cfg.I3, &cfg.I4, &cfg.I5} {
+		if *sig != "" {
+			*sig = redacted
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind/testutil"
+)
+
+func TestHandler(t *testing.T) {
+	cfg := &preflightbind.AtomicNoizeConfig{I1: "<b 0102>", Jc: 3}
+	b, err := preflightbind.NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(b)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if code := get("/healthz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before Open = %d, want 503", code)
+	}
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if code := get("/healthz").Code; code != http.StatusOK {
+		t.Errorf("/healthz after Open = %d, want 200", code)
+	}
+
+	if body := get("/metrics").Body.String(); !strings.Contains(body, "preflightbind_preflights_total 0\n") {
+		t.Errorf("/metrics missing preflight counter:\n%s", body)
+	}
+
+	var got preflightbind.AtomicNoizeConfig
+	if err := json.NewDecoder(get("/config").Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.I1 != redacted || got.Jc != 3 {
+		t.Errorf("/config = %+v, want I1 redacted and Jc 3", got)
+	}
+	if cfg.I1 != "<b 0102>" {
+		t.Error("redaction modified the Bind's config")
+	}
+}
@@ -0,0 +1,101 @@
+package preflightbind
+
+import (
+	"net/netip"
+	"time"
+)
+
+// PreflightEventKind describes what happened when a handshake initiation was
+// seen for a destination.
+type PreflightEventKind int
+
+const (
+	EventPreflightSent     PreflightEventKind = iota // preflight sequence was sent
+	EventRateLimited                                 // preflight skipped by the rate limiter
+	EventPostHandshakeJunk                           // post-handshake junk was scheduled
+	EventSkippedByChance                             // preflight skipped by WithPreflightProbability
+)
+
+func (k PreflightEventKind) String() string {
+	switch k {
+	case EventPreflightSent:
+		return "preflight-sent"
+	case EventRateLimited:
+		return "rate-limited"
+	case EventPostHandshakeJunk:
+		return "post-handshake-junk"
+	case EventSkippedByChance:
+		return "skipped-by-chance"
+	default:
+		return "unknown"
+	}
+}
+
+// PreflightEvent is one entry of a destination's history, see WithHistory.
+type PreflightEvent struct {
+	Time     time.Time
+	Kind     PreflightEventKind
+	Duration time.Duration // time spent sending; zero for skipped preflights
+	Err      error         // ErrRateLimited for EventRateLimited, otherwise nil
+}
+
+// eventRing is a fixed-size ring buffer of PreflightEvents.
+type eventRing struct {
+	events []PreflightEvent
+	next   int
+	full   bool
+}
+
+func (r *eventRing) add(ev PreflightEvent) {
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the events oldest first.
+func (r *eventRing) snapshot() []PreflightEvent {
+	if !r.full {
+		return append([]PreflightEvent(nil), r.events[:r.next]...)
+	}
+	out := make([]PreflightEvent, 0, len(r.events))
+	out = append(out, r.events[r.next:]...)
+	return append(out, r.events[:r.next]...)
+}
+
+// WithHistory keeps the last n PreflightEvents per destination IP for
+// diagnosing flapping peers. n <= 0 disables history (the default).
+func WithHistory(n int) Option {
+	return func(b *Bind) {
+		b.historySize = n
+	}
+}
+
+// recordEvent appends ev to dst's history. It must be called with b.mu held.
+func (b *Bind) recordEvent(dst netip.Addr, ev PreflightEvent) {
+	if b.historySize <= 0 {
+		return
+	}
+	r := b.history[dst]
+	if r == nil {
+		if b.history == nil {
+			b.history = make(map[netip.Addr]*eventRing)
+		}
+		r = &eventRing{events: make([]PreflightEvent, b.historySize)}
+		b.history[dst] = r
+	}
+	r.add(ev)
+}
+
+// GetHistory returns the recorded events for dst, oldest first. It returns
+// nil if history is disabled or nothing was recorded for dst.
+func (b *Bind) GetHistory(dst netip.Addr) []PreflightEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.history[dst]
+	if r == nil {
+		return nil
+	}
+	return r.snapshot()
+}
@@ -0,0 +1,80 @@
+package preflightbind
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Supported <h> tag algorithms.
+const (
+	HMACSHA256  = "sha256"
+	HMACBlake2b = "blake2b"
+)
+
+// packetMACSize is the length of the MAC appended by an <h> tag. Both
+// supported algorithms produce 32-byte tags.
+const packetMACSize = 32
+
+func newPacketMAC(key []byte, algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "", HMACSHA256:
+		return hmac.New(sha256.New, key), nil
+	case HMACBlake2b:
+		// BLAKE2b is keyed natively; keys longer than 64 bytes are rejected.
+		return blake2b.New256(key)
+	default:
+		return nil, fmt.Errorf("%w: unsupported <h> algorithm %q", ErrInvalidCPSTag, algo)
+	}
+}
+
+// computePacketHMAC returns the MAC of data under key using algo.
+func computePacketHMAC(data, key []byte, algo string) ([]byte, error) {
+	mac, err := newPacketMAC(key, algo)
+	if err != nil {
+		return nil, err
+	}
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// VerifyPacketHMAC reports whether packet ends with a valid MAC of the
+// preceding bytes, as produced by a trailing <h> tag. It is intended for
+// servers that want to tell genuine clients apart from scanners replaying
+// captured I1 packets. packet may be an I1 as received, with the IKEv2
+// framing the client puts around it after computing the MAC, or the bare
+// CPS output, as I2-I5 are sent.
+func VerifyPacketHMAC(packet, key []byte, algo string) bool {
+	if payload, ok := ikev2Payload(packet); ok && verifyTrailingMAC(payload, key, algo) {
+		return true
+	}
+	return verifyTrailingMAC(packet, key, algo)
+}
+
+func verifyTrailingMAC(packet, key []byte, algo string) bool {
+	if len(packet) < packetMACSize {
+		return false
+	}
+	body, tag := packet[:len(packet)-packetMACSize], packet[len(packet)-packetMACSize:]
+	want, err := computePacketHMAC(body, key, algo)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(tag, want)
+}
+
+// ikev2Payload returns the payload of a packet framed by wrapInIKEv2Header,
+// recognised by its next-payload, version and exchange type bytes and a
+// length field matching the packet.
+func ikev2Payload(packet []byte) ([]byte, bool) {
+	if len(packet) < ikev2FramingSize || packet[16] != 0x21 || packet[17] != 0x20 || packet[18] != 0x22 ||
+		binary.BigEndian.Uint32(packet[24:28]) != uint32(len(packet)) {
+		return nil, false
+	}
+	return packet[ikev2FramingSize:], true
+}
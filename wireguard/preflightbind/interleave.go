@@ -0,0 +1,87 @@
+package preflightbind
+
+import (
+	"slices"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// WithInterleaveJunk inserts a junk packet between each consecutive pair of
+// handshake messages within a single Send batch, so a burst of handshakes is
+// not seen as one tight group on the wire. Junk sizes follow the config that
+// applies to the destination; with no config nothing is inserted.
+func WithInterleaveJunk(enabled bool) Option {
+	return func(b *Bind) {
+		b.interleaveJunk = enabled
+	}
+}
+
+// interleave returns bufs with junk packets placed between consecutive
+// handshake messages, or bufs itself when nothing needs inserting.
+func (b *Bind) interleave(bufs [][]byte, ep conn.Endpoint) [][]byte {
+	if !b.interleaveJunk || len(bufs) < 2 {
+		return bufs
+	}
+	config, _ := b.configFor(ep.DstIP())
+	if config == nil {
+		return bufs
+	}
+
+	var out [][]byte
+	for i, buf := range bufs {
+		if i > 0 && b.isHandshake(bufs[i-1]) && b.isHandshake(buf) {
+			if out == nil {
+				out = append(make([][]byte, 0, 2*len(bufs)), bufs[:i]...)
+			}
+			junk := b.numberJunk(ep.DstIP(), b.generateJunkPacket(config))
+			b.bytesWritten.Add(int64(len(junk)))
+			b.countJunk(len(junk))
+			b.captureEndpoint(ep, junk)
+			out = append(out, junk)
+		}
+		if out != nil {
+			out = append(out, buf)
+		}
+	}
+	if out == nil {
+		return bufs
+	}
+	return out
+}
+
+func (b *Bind) isHandshake(buf []byte) bool {
+	return b.classifier.IsHandshakeInit(buf) || b.classifier.IsHandshakeResponse(buf)
+}
+
+// sendBatched passes bufs to the inner Bind in chunks no larger than its
+// BatchSize, since interleaving can grow a batch past that limit. With
+// WithExactBatches the last chunk is padded to exactly BatchSize.
+func (b *Bind) sendBatched(bufs [][]byte, ep conn.Endpoint) error {
+	size := b.inner.BatchSize()
+	if size <= 0 || (len(bufs) <= size && !b.exactBatches) {
+		return b.inner.Send(bufs, ep)
+	}
+	for len(bufs) > 0 {
+		n := min(size, len(bufs))
+		chunk := bufs[:n]
+		if b.exactBatches && n < size {
+			chunk = append(slices.Clip(chunk), make([][]byte, size-n)...)
+		}
+		if err := b.inner.Send(chunk, ep); err != nil {
+			return err
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
+
+// WithExactBatches pads every batch passed to the inner Bind with empty
+// buffers up to its BatchSize, for drivers that require exactly BatchSize
+// buffers per Send. Batches are always split at BatchSize; this only adds
+// the padding. Standard Binds send every buffer, empty ones included, so
+// only enable it for inner Binds that skip them.
+func WithExactBatches() Option {
+	return func(b *Bind) {
+		b.exactBatches = true
+	}
+}
@@ -0,0 +1,36 @@
+package preflightbind
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// cpsVarRegex matches ${NAME} placeholders in CPS strings.
+var cpsVarRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// InterpolateVars returns a copy of cfg with every ${NAME} placeholder in
+// I1-I5 replaced by env[NAME], so shared config files can carry runtime
+// values such as a container ID or API token. A placeholder whose name is
+// not in env is an error. Values are inserted verbatim, so they must form
+// valid CPS where they appear (e.g. hex inside a <b> tag).
+func InterpolateVars(cfg *AtomicNoizeConfig, env map[string]string) (*AtomicNoizeConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	out := *cfg
+	for i, field := range []*string{&out.I1, &out.I2, &out.I3, &out.I4, &out.I5} {
+		var missing string
+		*field = cpsVarRegex.ReplaceAllStringFunc(*field, func(m string) string {
+			name := cpsVarRegex.FindStringSubmatch(m)[1]
+			v, ok := env[name]
+			if !ok && missing == "" {
+				missing = name
+			}
+			return v
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("%w: I%d references unknown variable %q", ErrConfigInvalid, i+1, missing)
+		}
+	}
+	return &out, nil
+}
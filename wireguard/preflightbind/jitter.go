@@ -0,0 +1,26 @@
+package preflightbind
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// randFloat64 returns a uniform value in [0, 1) drawn from crypto/rand, so
+// that timing and sampling decisions cannot be predicted from earlier ones.
+func randFloat64() float64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return float64(binary.BigEndian.Uint64(buf[:])>>11) / (1 << 53)
+}
+
+// jitter returns d scaled by a uniform random factor in
+// [1-fraction, 1+fraction]. fraction is clamped to [0, 1], so the result is
+// never negative.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if d <= 0 || fraction <= 0 {
+		return d
+	}
+	fraction = min(fraction, 1)
+	return time.Duration(float64(d) * (1 + fraction*(2*randFloat64()-1)))
+}
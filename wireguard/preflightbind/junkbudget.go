@@ -0,0 +1,49 @@
+package preflightbind
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// WithMaxJunkBytesPerHandshake caps the junk bytes sent for one handshake,
+// across the junk sent around I1, before the initiation and after it, for
+// metered links where Jc*Jmax can add up. Junk stops at the first packet
+// that would exceed n bytes; I1-I5 do not count towards the cap. A
+// non-positive n means no cap.
+func WithMaxJunkBytesPerHandshake(n int) Option {
+	return func(b *Bind) {
+		b.maxJunkBytes = n
+	}
+}
+
+// junkBudget is the number of junk bytes one handshake may still send.
+type junkBudget struct {
+	remaining atomic.Int64
+}
+
+type junkBudgetKey struct{}
+
+// withJunkBudget returns ctx carrying a fresh junk budget, unless there is
+// no cap or ctx already has one.
+func (b *Bind) withJunkBudget(ctx context.Context) context.Context {
+	if b.maxJunkBytes <= 0 || ctx.Value(junkBudgetKey{}) != nil {
+		return ctx
+	}
+	budget := new(junkBudget)
+	budget.remaining.Store(int64(b.maxJunkBytes))
+	return context.WithValue(ctx, junkBudgetKey{}, budget)
+}
+
+// takeJunkBytes reserves n bytes from ctx's junk budget, reporting false if
+// that would exceed it. Without a budget it always succeeds.
+func takeJunkBytes(ctx context.Context, n int) bool {
+	budget, _ := ctx.Value(junkBudgetKey{}).(*junkBudget)
+	if budget == nil {
+		return true
+	}
+	if budget.remaining.Add(-int64(n)) < 0 {
+		budget.remaining.Add(int64(n))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package preflightbind
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// WithPortKnockSequence sends a short probe to each of ports on the peer's
+// address, in order and delay apart, before I1 goes out. Spreading the start
+// of the sequence over several ports keeps single-port knocking patterns from
+// being fingerprinted. Probes leave from the WireGuard socket and carry a
+// single zero byte unless WithPortKnockPayload is set. Ports outside 1-65535
+// are ignored.
+func WithPortKnockSequence(ports []int, delay time.Duration) Option {
+	return func(b *Bind) {
+		b.knockPorts = b.knockPorts[:0]
+		for _, p := range ports {
+			if p > 0 && p <= 0xFFFF {
+				b.knockPorts = append(b.knockPorts, uint16(p))
+			}
+		}
+		b.knockDelay = delay
+	}
+}
+
+// WithPortKnockPayload sets the bytes sent as each port-knock probe.
+func WithPortKnockPayload(payload []byte) Option {
+	return func(b *Bind) {
+		b.knockPayload = append([]byte(nil), payload...)
+	}
+}
+
+// sendPortKnocks sends the configured knock probes to ep's address.
+func (b *Bind) sendPortKnocks(ctx context.Context, ep conn.Endpoint) {
+	payload := b.knockPayload
+	if payload == nil {
+		payload = []byte{0x00}
+	}
+	for i, port := range b.knockPorts {
+		if ctx.Err() != nil {
+			return
+		}
+		if i > 0 {
+			sleepContext(ctx, b.knockDelay)
+		}
+		b.sendPacket(payload, b.endpointOnPort(ep, port), fmt.Sprintf("knock %d", port))
+	}
+	if len(b.knockPorts) > 0 {
+		sleepContext(ctx, b.knockDelay)
+	}
+}
@@ -0,0 +1,119 @@
+package preflightbind
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	mathrand "math/rand"
+	"regexp"
+	"strings"
+)
+
+// cpsMacros holds the protocol skeletons that <p name> expands to. Each
+// function fills its variable fields with fresh random values.
+var cpsMacros = map[string]func() []byte{
+	"quic":      quicHeaderMacro,
+	"tls_hello": tlsHelloMacro,
+	"dns_query": dnsQueryMacro,
+}
+
+// quicVersions are the QUIC versions <p quic> picks from. Both use the same
+// long-header Initial layout.
+var quicVersions = []uint32{
+	0x00000001, // v1, RFC 9000
+	0xff00001d, // draft-29
+}
+
+// quicHeaderMacro returns the 30-byte long header of a QUIC Initial packet:
+// random version, 8-byte connection IDs and packet number, an empty token
+// and a Length field announcing a minimum-size Initial.
+func quicHeaderMacro() []byte {
+	hdr := make([]byte, 30)
+	rand.Read(hdr)
+	hdr[0] = 0xc3 // long header, Initial, 4-byte packet number
+	binary.BigEndian.PutUint32(hdr[1:], quicVersions[mathrand.Intn(len(quicVersions))])
+	hdr[5] = 8  // DCID at 6:14
+	hdr[14] = 8 // SCID at 15:23
+	hdr[23] = 0 // no token
+	binary.BigEndian.PutUint16(hdr[24:], 0x4000|uint16(quicMinInitialSize-26))
+	return hdr
+}
+
+// tlsHelloMacro returns a TLS 1.3 ClientHello record without server_name.
+func tlsHelloMacro() []byte {
+	hello, _ := BuildTLSClientHelloPayload("", nil, nil) // only fails for long SNIs
+	return hello
+}
+
+// dnsQueryMacro returns a 12-byte DNS header for a recursive query with one
+// question and a random transaction ID.
+func dnsQueryMacro() []byte {
+	hdr := make([]byte, 12)
+	rand.Read(hdr[:2])
+	hdr[2] = 0x01 // RD
+	hdr[5] = 1    // QDCOUNT
+	return hdr
+}
+
+// maxCPSMacroDepth bounds how deeply <ref> expansions may nest, which also
+// stops macros that refer to themselves.
+const maxCPSMacroDepth = 8
+
+// maxCPSMacroExpansion bounds the length of a CPS string after macro
+// expansion, so a few fragments that each reference another several times
+// cannot grow exponentially within maxCPSMacroDepth levels.
+const maxCPSMacroExpansion = 64 << 10
+
+var (
+	cpsDefRegex = regexp.MustCompile(`(?s)<def\s+(\w+)\s*>(.*?)<enddef\s*>`)
+	cpsRefRegex = regexp.MustCompile(`<ref\s+(\w+)\s*>`)
+)
+
+// expandCPSMacros returns cps with its <def name>...<enddef> definitions
+// removed and every <ref name> replaced by the named fragment. Definitions
+// in cps take precedence over those in macros. Fragments may contain further
+// references, up to maxCPSMacroDepth levels deep and maxCPSMacroExpansion
+// bytes long.
+func expandCPSMacros(cps string, macros map[string]string) (string, error) {
+	if !strings.Contains(cps, "<def") && !strings.Contains(cps, "<ref") {
+		return cps, nil
+	}
+
+	table := macros
+	if defs := cpsDefRegex.FindAllStringSubmatch(cps, -1); len(defs) > 0 {
+		table = maps.Clone(macros)
+		if table == nil {
+			table = make(map[string]string, len(defs))
+		}
+		for _, d := range defs {
+			table[d[1]] = d[2]
+		}
+		cps = cpsDefRegex.ReplaceAllString(cps, "")
+	}
+	if strings.Contains(cps, "<def") || strings.Contains(cps, "<enddef") {
+		return "", fmt.Errorf("%w: unbalanced <def> or <enddef>", ErrInvalidCPSTag)
+	}
+
+	for depth := 0; cpsRefRegex.MatchString(cps); depth++ {
+		if depth == maxCPSMacroDepth {
+			return "", fmt.Errorf("%w: macro references nest deeper than %d levels", ErrInvalidCPSTag, maxCPSMacroDepth)
+		}
+		var err error
+		cps = cpsRefRegex.ReplaceAllStringFunc(cps, func(ref string) string {
+			name := cpsRefRegex.FindStringSubmatch(ref)[1]
+			body, ok := table[name]
+			if !ok && err == nil {
+				err = fmt.Errorf("%w: undefined macro %q", ErrInvalidCPSTag, name)
+			}
+			return body
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(cps) > maxCPSMacroExpansion {
+			return "", fmt.Errorf("%w: macro expansion exceeds %d bytes", ErrInvalidCPSTag, maxCPSMacroExpansion)
+		}
+	}
+	return cps, nil
+}
@@ -0,0 +1,99 @@
+package preflightbind
+
+import (
+	"context"
+	"time"
+)
+
+// Option configures optional Bind behaviour. Options are applied by New and
+// NewWithAtomicNoize before any CPS strings are parsed.
+type Option func(*Bind)
+
+// WithPacketHMAC sets the key used by <h> tags in I1-I5 signature packets.
+// algo selects the MAC used when a tag does not name one ("sha256" or
+// "blake2b"); an empty algo means "sha256".
+func WithPacketHMAC(key []byte, algo string) Option {
+	return func(b *Bind) {
+		b.cps.hmacKey = append([]byte(nil), key...)
+		b.cps.hmacAlgo = algo
+	}
+}
+
+// WithJunkPorts spreads junk packets round-robin across the given destination
+// ports instead of sending them all to the WireGuard endpoint's port, so DPI
+// rules keyed on a single port see less of the sequence. Ports outside
+// 1-65535 are ignored. An empty list keeps the default behaviour.
+func WithJunkPorts(ports []int) Option {
+	return func(b *Bind) {
+		b.junkPorts = b.junkPorts[:0]
+		for _, p := range ports {
+			if p > 0 && p <= 0xFFFF {
+				b.junkPorts = append(b.junkPorts, uint16(p))
+			}
+		}
+	}
+}
+
+// WithMultipathCount additionally sends I1 from n separate UDP sockets, each
+// with its own ephemeral source port, to improve delivery when the path
+// filters by source port. The copies go to the preflight port and are sent
+// concurrently alongside the copy on the WireGuard socket.
+func WithMultipathCount(n int) Option {
+	return func(b *Bind) {
+		b.multipathCount = n
+	}
+}
+
+// ErrorHandler receives errors that do not fail Send, such as a junk packet
+// that could not be written. context names the packet or step involved.
+type ErrorHandler func(err error, context string)
+
+// WithErrorHandler registers h for non-fatal errors on the preflight and
+// junk paths, which are otherwise dropped. h may be called concurrently.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(b *Bind) {
+		b.onError = h
+	}
+}
+
+func (b *Bind) reportError(err error, context string) {
+	if b.onError != nil {
+		b.onError(err, context)
+	}
+}
+
+// WithMaxPreflightDuration bounds how long the preflight sequence may block
+// Send. Once d has elapsed the remaining steps, including HandshakeDelay, are
+// skipped and a warning is logged. A zero d means no limit.
+func WithMaxPreflightDuration(d time.Duration) Option {
+	return func(b *Bind) {
+		b.maxPreflightDuration = d
+	}
+}
+
+// preflightContext returns the context that bounds one preflight sequence.
+func (b *Bind) preflightContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if b.maxPreflightDuration > 0 {
+		return context.WithTimeout(parent, b.maxPreflightDuration)
+	}
+	return context.WithCancel(parent)
+}
+
+// WithMinPacketSize rejects I1-I5 packets shorter than n bytes, so a config
+// whose tags all expand to nothing cannot produce a zero-byte I1 that looks
+// like an empty junk packet. Static packets are checked when the config is
+// loaded and construction fails; dynamic packets are also checked at send
+// time and reported through the error handler.
+func WithMinPacketSize(n int) Option {
+	return func(b *Bind) {
+		b.cps.minSize = n
+	}
+}
+
+// WithMaxPacketSize rejects I1-I5 packets longer than n bytes. It is checked
+// at the same points as WithMinPacketSize. A zero n means no limit.
+func WithMaxPacketSize(n int) Option {
+	return func(b *Bind) {
+		b.cps.maxSize = n
+	}
+}
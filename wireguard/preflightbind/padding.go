@@ -0,0 +1,91 @@
+package preflightbind
+
+import (
+	"crypto/rand"
+	mathrand "math/rand"
+)
+
+// PaddingStrategy grows handshake packets so their size no longer matches
+// the well-known 148/92 byte WireGuard handshake sizes. msgType is the
+// WireGuard message type (1 for initiation, 2 for response). Implementations
+// must not shrink buf.
+//
+// Padding only helps against peers that tolerate trailing bytes on handshake
+// messages; stock WireGuard servers drop such packets.
+type PaddingStrategy interface {
+	Pad(buf []byte, msgType byte) []byte
+}
+
+// FixedPadding pads every handshake packet with zeros up to targetSize.
+// Packets already at or above targetSize are left unchanged.
+func FixedPadding(targetSize int) PaddingStrategy {
+	return fixedPadding(targetSize)
+}
+
+type fixedPadding int
+
+func (p fixedPadding) Pad(buf []byte, _ byte) []byte {
+	return padTo(buf, int(p), false)
+}
+
+// RandomPadding pads every handshake packet with random bytes up to a size
+// chosen uniformly from [min, max].
+func RandomPadding(min, max int) PaddingStrategy {
+	if max < min {
+		max = min
+	}
+	return randomPadding{min: min, max: max}
+}
+
+type randomPadding struct{ min, max int }
+
+func (p randomPadding) Pad(buf []byte, _ byte) []byte {
+	target := p.min
+	if p.max > p.min {
+		target += mathrand.Intn(p.max - p.min + 1)
+	}
+	return padTo(buf, target, true)
+}
+
+// padTo returns buf extended to size bytes with zeros or random bytes.
+func padTo(buf []byte, size int, random bool) []byte {
+	if len(buf) >= size {
+		return buf
+	}
+	out := make([]byte, size)
+	copy(out, buf)
+	if random {
+		_, _ = rand.Read(out[len(buf):])
+	}
+	return out
+}
+
+// WithPaddingStrategy pads outgoing handshake initiations and responses
+// using s before they reach the inner bind.
+func WithPaddingStrategy(s PaddingStrategy) Option {
+	return func(b *Bind) {
+		b.padding = s
+	}
+}
+
+// padHandshakes applies b.padding to handshake packets in bufs. The caller's
+// slice is left untouched; a copy is returned if anything was padded.
+func (b *Bind) padHandshakes(bufs [][]byte) [][]byte {
+	if b.padding == nil {
+		return bufs
+	}
+	var out [][]byte
+	for i, buf := range bufs {
+		if !b.classifier.IsHandshakeInit(buf) && !b.classifier.IsHandshakeResponse(buf) {
+			continue
+		}
+		if out == nil {
+			out = append([][]byte(nil), bufs...)
+		}
+		out[i] = b.padding.Pad(buf, buf[0])
+	}
+	if out == nil {
+		return bufs
+	}
+	return out
+}
@@ -0,0 +1,181 @@
+package preflightbind
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 65535
+	pcapLinkRaw    = 101 // LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	udpHeaderSize  = 8
+)
+
+// packetCapture writes sent packets to an io.Writer in pcap format. Each
+// record carries a synthesized IP and UDP header so tools such as Wireshark
+// show the real source and destination.
+type packetCapture struct {
+	mu     sync.Mutex
+	w      io.Writer
+	header bool // global header written
+}
+
+// WithPacketCapture copies every preflight, signature and junk packet to w in
+// pcap format, for piping into Wireshark or tcpdump while tuning a config.
+// Packets sent on the WireGuard socket are recorded with the endpoint's
+// source address when known and a zero source port. Write errors are
+// reported through the error handler and do not affect sending.
+func WithPacketCapture(w io.Writer) Option {
+	return func(b *Bind) {
+		if w == nil {
+			b.capture = nil
+			return
+		}
+		b.capture = &packetCapture{w: w}
+	}
+}
+
+// captureConn records data sent on the raw socket c.
+func (b *Bind) captureConn(c net.Conn, data []byte) {
+	if b.capture == nil {
+		return
+	}
+	src := addrPortOf(c.LocalAddr())
+	dst := addrPortOf(c.RemoteAddr())
+	b.writeCapture(src, dst, data)
+}
+
+// captureEndpoint records data sent on the WireGuard socket to ep.
+func (b *Bind) captureEndpoint(ep conn.Endpoint, data []byte) {
+	if b.capture == nil {
+		return
+	}
+	dst, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		dst = netip.AddrPortFrom(ep.DstIP(), 0)
+	}
+	b.writeCapture(netip.AddrPortFrom(ep.SrcIP(), 0), dst, data)
+}
+
+func (b *Bind) writeCapture(src, dst netip.AddrPort, data []byte) {
+	if err := b.capture.write(time.Now(), src, dst, data); err != nil {
+		b.reportError(err, "packet capture")
+	}
+}
+
+// addrPortOf returns the address of a UDP net.Addr, or the zero value.
+func addrPortOf(a net.Addr) netip.AddrPort {
+	if u, ok := a.(*net.UDPAddr); ok {
+		return u.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// write appends one record, writing the pcap global header first if needed.
+func (pc *packetCapture) write(ts time.Time, src, dst netip.AddrPort, data []byte) error {
+	frame := buildIPUDPFrame(src, dst, data)
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if !pc.header {
+		var gh [24]byte
+		binary.LittleEndian.PutUint32(gh[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(gh[4:], 2) // version 2.4
+		binary.LittleEndian.PutUint16(gh[6:], 4)
+		binary.LittleEndian.PutUint32(gh[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(gh[20:], pcapLinkRaw)
+		if _, err := pc.w.Write(gh[:]); err != nil {
+			return err
+		}
+		pc.header = true
+	}
+
+	var rh [16]byte
+	binary.LittleEndian.PutUint32(rh[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rh[4:], uint32(ts.Nanosecond()/1000))
+	captured := len(frame)
+	if captured > pcapSnapLen {
+		captured = pcapSnapLen
+	}
+	binary.LittleEndian.PutUint32(rh[8:], uint32(captured))
+	binary.LittleEndian.PutUint32(rh[12:], uint32(len(frame)))
+	if _, err := pc.w.Write(rh[:]); err != nil {
+		return err
+	}
+	_, err := pc.w.Write(frame[:captured])
+	return err
+}
+
+// buildIPUDPFrame wraps data in an IPv4 or IPv6 header plus a UDP header.
+// The IPv6 form is used when either address is IPv6. UDP checksums are left
+// zero, which capture tools display as "not present".
+func buildIPUDPFrame(src, dst netip.AddrPort, data []byte) []byte {
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	v6 := srcAddr.Is6() || dstAddr.Is6()
+	udpLen := udpHeaderSize + len(data)
+
+	var frame []byte
+	if v6 {
+		frame = make([]byte, ipv6HeaderSize+udpLen)
+		frame[0] = 0x60
+		binary.BigEndian.PutUint16(frame[4:], uint16(udpLen))
+		frame[6] = 17 // UDP
+		frame[7] = 64 // hop limit
+		s, d := as16(srcAddr), as16(dstAddr)
+		copy(frame[8:24], s[:])
+		copy(frame[24:40], d[:])
+	} else {
+		frame = make([]byte, ipv4HeaderSize+udpLen)
+		frame[0] = 0x45
+		binary.BigEndian.PutUint16(frame[2:], uint16(ipv4HeaderSize+udpLen))
+		frame[8] = 64 // TTL
+		frame[9] = 17 // UDP
+		s, d := as4(srcAddr), as4(dstAddr)
+		copy(frame[12:16], s[:])
+		copy(frame[16:20], d[:])
+		binary.BigEndian.PutUint16(frame[10:], ipv4Checksum(frame[:ipv4HeaderSize]))
+	}
+
+	udp := frame[len(frame)-udpLen:]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderSize:], data)
+	return frame
+}
+
+func as4(a netip.Addr) [4]byte {
+	if a.Is4() {
+		return a.As4()
+	}
+	return [4]byte{}
+}
+
+func as16(a netip.Addr) [16]byte {
+	if a.IsValid() {
+		return a.As16()
+	}
+	return [16]byte{}
+}
+
+// ipv4Checksum computes the header checksum of hdr, whose checksum field is zero.
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,152 @@
+package preflightbind
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultRateLimiterFlushInterval is how often a persistent rate limiter
+// writes its changes to disk.
+const defaultRateLimiterFlushInterval = time.Second
+
+// rateLimiterBucket is the bbolt bucket holding one key per destination
+// address, each mapping to the Unix nanosecond time of its last preflight.
+var rateLimiterBucket = []byte("lastSent")
+
+// WithPersistentRateLimiter keeps the rate limiter in a bbolt database at
+// dbPath, so a restarted process does not preflight again to peers it has
+// just preflighted. Open loads the stored entries and Close writes the final
+// state and closes the database; in between, changes are written every
+// second or as set by WithRateLimiterFlushInterval. A database that cannot
+// be opened is logged and the rate limiter stays in memory only.
+func WithPersistentRateLimiter(dbPath string) Option {
+	return func(b *Bind) {
+		b.persistPath = dbPath
+	}
+}
+
+// WithRateLimiterFlushInterval sets how often WithPersistentRateLimiter
+// writes changes. A non-positive d restores the default of one second.
+func WithRateLimiterFlushInterval(d time.Duration) Option {
+	return func(b *Bind) {
+		b.persistInterval = d
+	}
+}
+
+// startPersistence opens the rate-limiter database, merges its entries into
+// lastSent and starts the flush loop. It must be called with b.mu held.
+func (b *Bind) startPersistence() {
+	if b.persistPath == "" || b.persistDB != nil {
+		return
+	}
+	db, err := bolt.Open(b.persistPath, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		b.log.Warn("cannot open persistent rate limiter, keeping it in memory", "path", b.persistPath, "error", err)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(rateLimiterBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var dst netip.Addr
+			if dst.UnmarshalBinary(k) != nil || len(v) != 8 {
+				return nil // skip entries we cannot read
+			}
+			last := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+			if last.After(b.lastSent[dst]) {
+				b.lastSent[dst] = last
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.log.Warn("cannot load persistent rate limiter", "path", b.persistPath, "error", err)
+	}
+	b.persistDB = db
+
+	interval := b.persistInterval
+	if interval <= 0 {
+		interval = defaultRateLimiterFlushInterval
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	b.persistStop, b.persistDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.flushRateLimiter(db)
+			case <-stop:
+				b.flushRateLimiter(db)
+				return
+			}
+		}
+	}()
+}
+
+// stopPersistence stops the flush loop after a final flush and closes the
+// database. It must be called without b.mu held, since the last flush
+// takes it.
+func (b *Bind) stopPersistence() {
+	b.mu.Lock()
+	db, stop, done := b.persistDB, b.persistStop, b.persistDone
+	b.persistDB, b.persistStop, b.persistDone = nil, nil, nil
+	b.mu.Unlock()
+	if db == nil {
+		return
+	}
+	close(stop)
+	<-done
+	if err := db.Close(); err != nil {
+		b.log.Warn("closing persistent rate limiter", "error", err)
+	}
+}
+
+// rateLimiterChanged marks lastSent as needing a flush.
+func (b *Bind) rateLimiterChanged() {
+	b.persistDirty.Store(true)
+}
+
+// flushRateLimiter replaces the stored entries with the current lastSent if
+// it changed since the last flush.
+func (b *Bind) flushRateLimiter(db *bolt.DB) {
+	if !b.persistDirty.Swap(false) {
+		return
+	}
+	b.mu.Lock()
+	entries := make(map[netip.Addr]time.Time, len(b.lastSent))
+	for dst, last := range b.lastSent {
+		entries[dst] = last
+	}
+	b.mu.Unlock()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(rateLimiterBucket) != nil {
+			if err := tx.DeleteBucket(rateLimiterBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(rateLimiterBucket)
+		if err != nil {
+			return err
+		}
+		for dst, last := range entries {
+			k, _ := dst.MarshalBinary()
+			if err := bucket.Put(k, binary.BigEndian.AppendUint64(nil, uint64(last.UnixNano()))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.persistDirty.Store(true)
+		b.reportError(err, "rate limiter flush")
+	}
+}
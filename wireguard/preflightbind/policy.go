@@ -0,0 +1,70 @@
+package preflightbind
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// RegionPolicy selects Config for destinations inside CIDR, so peers in
+// different censorship regimes can get different obfuscation parameters.
+type RegionPolicy struct {
+	CIDR   netip.Prefix
+	Config *AtomicNoizeConfig
+}
+
+type compiledPolicy struct {
+	prefix   netip.Prefix
+	config   *AtomicNoizeConfig
+	compiled compiledConfig
+}
+
+// NewPolicyBind creates a Bind that picks its AtomicNoize config per
+// destination: the policy with the longest prefix containing the destination
+// wins, and defaultConfig applies when no policy matches.
+func NewPolicyBind(inner conn.Bind, policies []RegionPolicy, defaultConfig *AtomicNoizeConfig, port int, minInterval time.Duration, opts ...Option) (*Bind, error) {
+	b, err := NewWithAtomicNoize(inner, defaultConfig, port, minInterval, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range policies {
+		if !p.CIDR.IsValid() {
+			return nil, fmt.Errorf("%w: invalid policy prefix %v", ErrConfigInvalid, p.CIDR)
+		}
+		if err := p.Config.Validate(); err != nil {
+			return nil, fmt.Errorf("policy %v: %w", p.CIDR, err)
+		}
+		compiled, err := precompileConfig(p.Config, &b.cps)
+		if err != nil {
+			return nil, fmt.Errorf("policy %v: %w", p.CIDR, err)
+		}
+		b.policies = append(b.policies, compiledPolicy{
+			prefix:   p.CIDR.Masked(),
+			config:   p.Config,
+			compiled: compiled,
+		})
+	}
+	sort.SliceStable(b.policies, func(i, j int) bool {
+		return b.policies[i].prefix.Bits() > b.policies[j].prefix.Bits()
+	})
+	return b, nil
+}
+
+// configFor returns the config that applies to dst: the longest matching
+// region policy, the active fallback config, or the Bind's current config.
+func (b *Bind) configFor(dst netip.Addr) (*AtomicNoizeConfig, compiledConfig) {
+	dst = dst.Unmap()
+	for _, p := range b.policies {
+		if p.prefix.Contains(dst) {
+			return p.config, p.compiled
+		}
+	}
+	if cfg, compiled, ok := b.fallbackConfig(dst); ok {
+		return cfg, compiled
+	}
+	return b.currentConfig()
+}
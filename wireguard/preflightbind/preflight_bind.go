@@ -1,23 +1,30 @@
 package preflightbind
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"log/slog"
 	mathrand "math/rand"
+	"net"
 	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var rng = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
-
 // AtomicNoizeConfig holds the AtomicNoize WireGuard obfuscation parameters
 type AtomicNoizeConfig struct {
 	// I1-I5: Signature packets for protocol imitation
@@ -31,6 +38,13 @@ type AtomicNoizeConfig struct {
 	S1 int // Random prefix for Init packets
 	S2 int // Random prefix for Response packets
 
+	// H1-H4: Magic message type headers from AmneziaWG configs. They are
+	// kept for round-tripping but not applied, since WARP expects standard types
+	H1 uint32
+	H2 uint32
+	H3 uint32
+	H4 uint32
+
 	// Junk packet configuration
 	Jc   int // Number of junk packets (0-10)
 	Jmin int // Minimum junk packet size (bytes)
@@ -45,21 +59,127 @@ type AtomicNoizeConfig struct {
 	JunkInterval   time.Duration // Interval between junk packets
 	AllowZeroSize  bool          // Allow zero-size junk packets
 	HandshakeDelay time.Duration // Delay before actual handshake after I1
+
+	// JitterFraction randomizes HandshakeDelay and each JunkInterval gap by
+	// up to this fraction either way, so that the timing is not a constant
+	// an observer can match on. It must be in [0, 0.5]; 0 disables jitter
+	JitterFraction float64
+
+	// AdaptiveJunk scales junk counts by the RTT measured between handshake
+	// initiations and their responses: halved above 200ms, doubled below
+	// 20ms
+	AdaptiveJunk bool
+
+	// Macros are named CPS fragments that I1-I5 can expand with <ref name>,
+	// alongside fragments defined inline with <def name>...<enddef>
+	Macros map[string]string
 }
 
 // Bind wraps a conn.Bind and fires QUIC-like preflight when WG sends a handshake initiation.
 type Bind struct {
-	inner             conn.Bind
-	port443           int                // usually 443
-	payload           []byte             // I1 bytes
-	AtomicNoizeConfig *AtomicNoizeConfig // AtomicNoize configuration
-	mu                sync.Mutex
-	lastSent          map[netip.Addr]time.Time // rate-limit per dst IP
-	interval          time.Duration            // e.g., 1s to avoid duplicate bursts
-	postHandshakeSent map[netip.Addr]bool      // track if post-handshake junk sent per IP
+	inner                conn.Bind
+	port443              int                // usually 443
+	compiled             compiledConfig     // parsed I1-I5 of AtomicNoizeConfig
+	AtomicNoizeConfig    *AtomicNoizeConfig // AtomicNoize configuration; replace via ApplyConfig
+	cfgMu                sync.RWMutex       // guards AtomicNoizeConfig and compiled
+	mu                   sync.Mutex
+	lastSent             map[netip.Addr]time.Time // rate-limit per dst IP
+	interval             time.Duration            // e.g., 1s to avoid duplicate bursts
+	postHandshakeSent    map[netip.Addr]bool      // track if post-handshake junk sent per IP
+	cookied              map[netip.Addr]bool      // peers that sent a cookie reply; next init skips preflight
+	cps                  cpsContext               // state shared with CPS tags such as <h>
+	classifier           PacketClassifier         // handshake detection, see WithPacketClassifier
+	pruneInterval        time.Duration            // how often stale lastSent entries are dropped
+	pruneStop            chan struct{}            // closes to stop the prune loop started by Open
+	junkPorts            []uint16                 // destination ports for junk packets, see WithJunkPorts
+	junkPortIdx          atomic.Uint32            // round-robin cursor into junkPorts
+	multipathCount       int                      // extra sockets I1 is sent from, see WithMultipathCount
+	historySize          int                      // events kept per destination, see WithHistory
+	history              map[netip.Addr]*eventRing
+	log                  *slog.Logger
+	padding              PaddingStrategy              // optional handshake padding, see WithPaddingStrategy
+	sourceAddr           *net.UDPAddr                 // local address for raw preflight sockets, see WithSourceIP
+	dialer               EndpointDialer               // replaces net dialing for raw preflight sockets
+	onError              ErrorHandler                 // receives non-fatal send errors, see WithErrorHandler
+	rtt                  map[netip.Addr]time.Duration // smoothed RTT per destination for AdaptiveJunk
+	initSent             map[netip.Addr]time.Time     // when the last initiation to each destination was sent, guarded by mu
+	state                atomic.Int32                 // current PreflightState, see State
+	stateMu              sync.Mutex                   // guards stateActive and orders state transitions
+	stateActive          [StatePostHandshake + 1]int  // running sequences per state
+	stateCh              chan PreflightState          // optional transition feed, see WithStateChannel
+	dedupeWindow         time.Duration                // see WithDedupeWindow
+	seenInits            map[netip.Addr]seenInit      // last initiation sent per destination, guarded by mu
+	policies             []compiledPolicy             // per-region configs, longest prefix first
+	bytesWritten         atomic.Int64                 // obfuscation bytes sent, see TotalBytesSent
+	maxPreflightDuration time.Duration                // budget for the blocking part of a preflight
+	closed               bool                         // set by Shutdown, guarded by mu
+	background           sync.WaitGroup               // post-handshake junk goroutines
+	dscp                 byte                         // DSCP for raw preflight sockets, see WithDSCP
+	dscpSet              bool                         // whether WithDSCP was applied
+	capture              *packetCapture               // see WithPacketCapture
+	interleaveJunk       bool                         // see WithInterleaveJunk
+	knockPorts           []uint16                     // see WithPortKnockSequence
+	knockDelay           time.Duration                // pause between knocks
+	knockPayload         []byte                       // knock probe bytes, see WithPortKnockPayload
+	sequenceNumbers      bool                         // see WithSequenceNumbers
+	junkSeq              map[netip.Addr]uint32        // next junk sequence number, guarded by mu
+	preflightsFired      atomic.Uint64                // counters reported by Stats
+	junkPackets          atomic.Uint64                // see Stats
+	junkBytes            atomic.Uint64                // see Stats
+	lastPreflight        atomic.Int64                 // UnixNano of the last preflight
+	activePostHandshake  atomic.Int32                 // running post-handshake goroutines
+	sendMode             sendMode                     // see WithUseInnerSend
+	compressJunk         bool                         // see WithJunkCompression
+	sessions             sessionTracker               // preflight times by session, guarded by mu
+	recvObserver         RecvObserver                 // see WithRecvObserver
+	recvObserved         chan []observedPacket        // batches waiting for the observer, nil when not running
+	recvObserverStop     chan struct{}                // closed to stop the observer goroutine
+	recvObserverDropped  atomic.Uint64                // packets the observer fell too far behind to see
+	recvObserverLagging  atomic.Bool                  // the last batch was dropped, see observeRecv
+	frozen               atomic.Bool                  // see Freeze
+	keepZeroConfig       bool                         // see WithConfigDefaults
+	bgJunk               junkLoops                    // running StartBackgroundJunk loops, guarded by mu
+	activeBackgroundJunk atomic.Int32                 // see Stats
+	fallbackConfigs      []*AtomicNoizeConfig         // see WithConfigFallbackList
+	fallbacks            []compiledFallback           // compiled fallbackConfigs, guarded by cfgMu
+	fallbackIdx          map[netip.Addr]int           // active entry of fallbacks per destination, guarded by mu
+	sendFailures         atomic.Uint64                // preflight packets the inner Bind rejected
+	handshakePrefixes    bool                         // see WithHandshakePrefixes
+	ifname               string                       // see WithInterfaceName
+	proxy                packetProxy                  // see WithHTTPConnectProxy and WithSOCKS5Proxy
+	preflightQueueDepth  int                          // see WithPreflightQueueDepth, 0 runs preflights inline
+	preflightJobs        chan preflightJob            // queue for the preflight worker, nil when not running
+	preflightStop        chan struct{}                // closed to stop the preflight worker
+	tracer               trace.Tracer                 // see WithTraceProvider, nil for no-op
+	persistPath          string                       // see WithPersistentRateLimiter
+	persistInterval      time.Duration                // see WithRateLimiterFlushInterval
+	persistDB            *bolt.DB                     // open between Open and Close
+	persistStop          chan struct{}                // closed to stop the flush loop
+	persistDone          chan struct{}                // closed once the flush loop has exited
+	persistDirty         atomic.Bool                  // lastSent changed since the last flush
+	intervalOverrides    []intervalOverride           // see WithIntervalOverrides, longest prefix first
+	open                 atomic.Bool                  // between a successful Open and Close
+	failureHook          HandshakeFailureHook         // see WithHandshakeFailureHook
+	failureThreshold     int                          // initiations that count as a failure
+	failureWindow        time.Duration                // window the threshold applies to
+	initTimes            map[netip.Addr][]time.Time   // recent initiation times per destination, guarded by mu
+	shared               *SharedRateLimiter           // see WithSharedRateLimiter, nil when unused
+	maxJunkBytes         int                          // see WithMaxJunkBytesPerHandshake, 0 for no cap
+	stickyPort           bool                         // see WithStickyPreflightPort
+	stickyConn           *net.UDPConn                 // shared preflight socket between Open and Close, guarded by mu
+	doh                  *dohResolver                 // see WithDOHResolver
+	dohHost              string                       // see WithDOHHost
+	dohTTL               time.Duration                // see WithDOHCacheTTL
+	probability          float64                      // see WithPreflightProbability, 0 means always
+	initsSent            atomic.Uint64                // WireGuard messages passed to Send, see Stats
+	responsesSent        atomic.Uint64                // see Stats
+	transportSent        atomic.Uint64                // see Stats
+	socketSem            chan struct{}                // open-socket slots, see WithMaxOpenSockets
+	exactBatches         bool                         // see WithExactBatches
+	userAgent            string                       // see WithHTTPUserAgent
 }
 
-func New(inner conn.Bind, hexPayload string, port int, minInterval time.Duration) (*Bind, error) {
+func New(inner conn.Bind, hexPayload string, port int, minInterval time.Duration, opts ...Option) (*Bind, error) {
 	// hexPayload may start with "0x..."
 	h := hexPayload
 	if len(h) >= 2 && (h[:2] == "0x" || h[:2] == "0X") {
@@ -67,47 +187,104 @@ func New(inner conn.Bind, hexPayload string, port int, minInterval time.Duration
 	}
 	p, err := hex.DecodeString(h)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: payload: %w", ErrHexDecodeFailure, err)
 	}
-	return &Bind{
+	b := &Bind{
 		inner:             inner,
 		port443:           port,
-		payload:           p,
+		compiled:          compiledConfig{i1: compiledPacket{static: p}},
 		lastSent:          make(map[netip.Addr]time.Time),
 		postHandshakeSent: make(map[netip.Addr]bool),
+		cookied:           make(map[netip.Addr]bool),
 		interval:          minInterval,
-	}, nil
+		classifier:        defaultClassifier{},
+		pruneInterval:     defaultPruneInterval,
+		socketSem:         make(chan struct{}, defaultMaxOpenSockets),
+		log:               slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if err := b.compileFallbacks(); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 // NewWithAtomicNoize creates a new Bind with AtomicNoize configuration
-func NewWithAtomicNoize(inner conn.Bind, AtomicNoizeConfig *AtomicNoizeConfig, port int, minInterval time.Duration) (*Bind, error) {
-	var payload []byte
-	var err error
-
-	if AtomicNoizeConfig != nil && AtomicNoizeConfig.I1 != "" {
-		// Parse I1 using CPS format
-		payload, err = parseCPSPacket(AtomicNoizeConfig.I1)
-		if err != nil {
-			return nil, fmt.Errorf("invalid I1 CPS format: %w", err)
-		}
-	}
-
-	return &Bind{
+func NewWithAtomicNoize(inner conn.Bind, AtomicNoizeConfig *AtomicNoizeConfig, port int, minInterval time.Duration, opts ...Option) (*Bind, error) {
+	b := &Bind{
 		inner:             inner,
 		port443:           port,
-		payload:           payload,
 		AtomicNoizeConfig: AtomicNoizeConfig,
 		lastSent:          make(map[netip.Addr]time.Time),
 		interval:          minInterval,
 		postHandshakeSent: make(map[netip.Addr]bool),
-	}, nil
+		cookied:           make(map[netip.Addr]bool),
+		classifier:        defaultClassifier{},
+		pruneInterval:     defaultPruneInterval,
+		socketSem:         make(chan struct{}, defaultMaxOpenSockets),
+		log:               slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	cfg, err := b.prepareConfig(AtomicNoizeConfig)
+	if err != nil {
+		return nil, err
+	}
+	b.AtomicNoizeConfig = cfg
+
+	// Parse I1-I5 up front so CPS errors surface here rather than at send time
+	compiled, err := precompileConfig(cfg, &b.cps)
+	if err != nil {
+		return nil, err
+	}
+	b.compiled = compiled
+	if err := b.compileFallbacks(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.inner.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.mu.Lock()
+	b.startPruner()
+	b.startPreflightWorker()
+	b.startRecvObserver()
+	b.startPersistence()
+	b.openStickySocket()
+	b.mu.Unlock()
+	b.open.Store(true)
+	return b.wrapReceiveFuncs(fns), actualPort, nil
 }
 
-func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) { return b.inner.Open(port) }
-func (b *Bind) Close() error                                         { return b.inner.Close() }
-func (b *Bind) SetMark(m uint32) error                               { return b.inner.SetMark(m) }
-func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error)        { return b.inner.ParseEndpoint(s) }
-func (b *Bind) BatchSize() int                                       { return b.inner.BatchSize() }
+func (b *Bind) Close() error {
+	b.open.Store(false)
+	b.mu.Lock()
+	b.stopPruner()
+	b.stopBackgroundJunk()
+	b.stopPreflightWorker()
+	b.stopRecvObserver()
+	b.closeStickySocket()
+	b.mu.Unlock()
+	b.stopPersistence()
+	if b.proxy != nil {
+		b.proxy.close()
+	}
+	return b.inner.Close()
+}
+
+// IsOpen reports whether the Bind has been opened and not closed since.
+func (b *Bind) IsOpen() bool { return b.open.Load() }
+
+func (b *Bind) SetMark(m uint32) error { return b.inner.SetMark(m) }
+func (b *Bind) BatchSize() int         { return b.inner.BatchSize() }
 
 // handshakeInitiation reports whether buf looks like a WG handshake initiation.
 // Per spec: first byte == 1 (init), next 3 bytes are reserved = 0. Size is 148 for init.
@@ -121,19 +298,112 @@ func handshakeInitiation(buf []byte) bool {
 	return buf[0] == byte(device.MessageInitiationType) && len(buf) >= device.MessageInitiationSize
 }
 
-// parseCPSPacket parses a Custom Protocol Signature packet format
-// Format: <b hex_data><c><t><r length>
+// cpsTagRegex matches a single CPS tag, or a group delimiter such as <g2>
+// or </g2>, and captures its type and data. Tag data may contain backslash
+// escapes, so "\>" does not end a tag.
+var cpsTagRegex = regexp.MustCompile(`<(/?g[24]|[btcrehszp])\s*((?:[^>\\]|\\.)*)>`)
+
+// cpsContext carries the Bind state that some CPS tags depend on.
+type cpsContext struct {
+	hmacKey  []byte // key for <h> tags, set via WithPacketHMAC
+	hmacAlgo string // default algorithm for <h> tags
+	sni      string // when set, I1 is a TLS ClientHello for this name, see WithSNI
+	minSize  int    // smallest allowed I1-I5 packet, see WithMinPacketSize
+	maxSize  int    // largest allowed I1-I5 packet, 0 for no limit
+
+	profile     FingerprintProfile // when set, I1 is built from this profile
+	profileOpts ProfileOptions
+	version     int               // for <if version=X> blocks, 0 means DefaultCPSVersion
+	macros      map[string]string // fragments for <ref name>, from AtomicNoizeConfig.Macros
+}
+
+// parseCPSPacket builds a packet from a Custom Protocol Signature (CPS)
+// string, the format of I1-I5. A CPS string is a sequence of tags, each
+// appending bytes to the packet in order:
+//
+//	packet     = { item } .
+//	item       = tag | group | block | other .
+//	tag        = "<" tag_type { space } tag_data ">" .
+//	tag_type   = "b" | "c" | "t" | "r" | "e" | "h" | "s" | "z" | "p" .
+//	tag_data   = { data_char | "\\" any_char } .
+//	data_char  = any_char - ( ">" | "\\" ) .
+//	group      = "<g2>" packet "</g2>" | "<g4>" packet "</g4>" .
+//	block      = "<if" space { space } "version" { space } "=" { space } digits { space } ">"
+//	             packet "<endif" { space } ">" .
+//	other      = any_char .  (* text outside tags, and tags of any other type, are ignored *)
+//
+// Macros are expanded first, so the grammar applies to their result.
+// <def name>...<enddef> defines a fragment and emits nothing; <ref name> is
+// replaced by the fragment's text, which is taken from an inline definition
+// or else from AtomicNoizeConfig.Macros and may itself contain references,
+// up to eight levels deep. An undefined name is an error.
+//
+// Blocks are resolved next: the contents of <if version=X>...<endif> are
+// kept only when X is the client version (DefaultCPSVersion unless set with
+// WithCPSVersion) and every enclosing block is kept too. Unbalanced blocks
+// are an error. Apart from <s>, tag_data is trimmed of surrounding space.
+//
+//	<b hex>       hex bytes, with an optional 0x prefix; spaces are ignored
+//	              and an odd number of digits is an error. <b> emits nothing
+//	<c>           4-byte big-endian counter, currently Unix seconds
+//	<t>           4-byte big-endian Unix timestamp
+//	<r n>         n random bytes, capped at 1000; n <= 0 or <r> emits nothing
+//	<e n>         like <r n>; marks the bytes as an anti-replay nonce for
+//	              servers that drop packets repeating a recently seen one
+//	<h algo>      32-byte MAC of everything emitted so far, keyed by
+//	              WithPacketHMAC; algo is sha256 (default) or blake2b
+//	<s text>      UTF-8 text with the escapes \r \n \t \\ \> and \xHH; leading
+//	              spaces are consumed by the tag, so write them as \x20
+//	<z n>         n zero bytes, capped at 1000; <z> emits one
+//	<p name>      a protocol skeleton with random variable fields: quic (QUIC
+//	              Initial long header), tls_hello (TLS 1.3 ClientHello) or
+//	              dns_query (DNS query header)
+//	<g2>...</g2>  the enclosed bytes preceded by their 2-byte big-endian
+//	              length; <g4>...</g4> uses 4 bytes. Groups nest but must be
+//	              closed in order, and their length covers a nested prefix
+//
+// Examples:
+//
+//	<b 160301><g2><b 01><r 64></g2>          TLS record with an exact length field
+//	<p tls_hello>                            TLS knock: full ClientHello
+//	<p quic><r 1000><r 170>                  QUIC knock padded to 1200 bytes
+//	<b 0102><r 64>                           two fixed bytes and random padding
+//	<p dns_query><s \x07example\x03com><z><b 00010001>   DNS query for example.com
+//	<b c0><t><e 16><h>                       timestamped, nonce-carrying, MACed knock
+//	<def tls><b 1603><enddef><ref tls><b 01> shared TLS record prefix
 func parseCPSPacket(cps string) ([]byte, error) {
+	return parseCPSPacketWithContext(cps, nil)
+}
+
+// parseCPSPacketWithContext parses a CPS string using the given context.
+// A nil context is valid; tags that need it (<h>) then fail.
+func parseCPSPacketWithContext(cps string, ctx *cpsContext) ([]byte, error) {
 	if cps == "" {
 		return nil, nil
 	}
 
+	version := DefaultCPSVersion
+	var macros map[string]string
+	if ctx != nil {
+		if ctx.version != 0 {
+			version = ctx.version
+		}
+		macros = ctx.macros
+	}
+	cps, err := expandCPSMacros(cps, macros)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err := selectCPSVersion(cps, version)
+	if err != nil {
+		return nil, err
+	}
+
 	var result []byte
-	remaining := cps
+	var groups []cpsGroup // open <g2>/<g4> groups, innermost last
 
 	// Parse CPS tags using regex
-	tagRegex := regexp.MustCompile(`<([btcr])\s*([^>]*)>`)
-	matches := tagRegex.FindAllStringSubmatch(remaining, -1)
+	matches := cpsTagRegex.FindAllStringSubmatch(remaining, -1)
 
 	for _, match := range matches {
 		if len(match) < 3 {
@@ -154,7 +424,7 @@ func parseCPSPacket(cps string) ([]byte, error) {
 				tagData = strings.ReplaceAll(tagData, " ", "")
 				bytes, err := hex.DecodeString(tagData)
 				if err != nil {
-					return nil, fmt.Errorf("invalid hex data in <b> tag: %w", err)
+					return nil, fmt.Errorf("%w: <b> data: %w: %w", ErrInvalidCPSTag, ErrHexDecodeFailure, err)
 				}
 				result = append(result, bytes...)
 			}
@@ -176,13 +446,13 @@ func parseCPSPacket(cps string) ([]byte, error) {
 				byte(timestamp),
 			}
 			result = append(result, timestampBytes...)
-		case "r": // Random bytes
+		case "r", "e": // Random bytes, or a random anti-replay nonce
 			length := 0
 			if tagData != "" {
 				var err error
 				length, err = strconv.Atoi(tagData)
 				if err != nil {
-					return nil, fmt.Errorf("invalid length in <r> tag: %w", err)
+					return nil, fmt.Errorf("%w: <%s> length: %w", ErrInvalidCPSTag, tagType, err)
 				}
 				if length > 1000 {
 					length = 1000 // Cap at 1000 bytes as per spec
@@ -196,12 +466,89 @@ func parseCPSPacket(cps string) ([]byte, error) {
 				}
 				result = append(result, randomBytes...)
 			}
+		case "z": // Zero bytes
+			length := 1
+			if tagData != "" {
+				var err error
+				length, err = strconv.Atoi(tagData)
+				if err != nil || length < 0 {
+					return nil, fmt.Errorf("%w: <z> length %q", ErrInvalidCPSTag, tagData)
+				}
+				if length > 1000 {
+					length = 1000
+				}
+			}
+			result = append(result, make([]byte, length)...)
+		case "p": // Protocol macro
+			macro, ok := cpsMacros[tagData]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown protocol %q in <p>", ErrInvalidCPSTag, tagData)
+			}
+			result = append(result, macro()...)
+		case "s": // UTF-8 string literal, no length prefix
+			text, err := unescapeCPSString(match[2])
+			if err != nil {
+				return nil, fmt.Errorf("<s> text: %w", err)
+			}
+			result = append(result, text...)
+		case "h": // HMAC over everything emitted so far
+			if ctx == nil || len(ctx.hmacKey) == 0 {
+				return nil, fmt.Errorf("%w: <h> requires a key (see WithPacketHMAC)", ErrInvalidCPSTag)
+			}
+			algo := tagData
+			if algo == "" {
+				algo = ctx.hmacAlgo
+			}
+			mac, err := computePacketHMAC(result, ctx.hmacKey, algo)
+			if err != nil {
+				return nil, fmt.Errorf("%w: <h>: %w", ErrInvalidCPSTag, err)
+			}
+			result = append(result, mac...)
+		case "g2", "g4": // Start of a length-prefixed group
+			if tagData != "" {
+				return nil, fmt.Errorf("%w: <%s> takes no data", ErrInvalidCPSTag, tagType)
+			}
+			groups = append(groups, cpsGroup{start: len(result), width: int(tagType[1] - '0')})
+		case "/g2", "/g4": // End of a group: prepend its length
+			width := int(tagType[2] - '0')
+			if len(groups) == 0 || groups[len(groups)-1].width != width {
+				return nil, fmt.Errorf("%w: <%s> without matching <g%d>", ErrInvalidCPSTag, tagType, width)
+			}
+			g := groups[len(groups)-1]
+			groups = groups[:len(groups)-1]
+			if result, err = g.close(result); err != nil {
+				return nil, err
+			}
 		}
 	}
+	if len(groups) > 0 {
+		return nil, fmt.Errorf("%w: <g%d> is not closed", ErrInvalidCPSTag, groups[len(groups)-1].width)
+	}
 
 	return result, nil
 }
 
+// cpsGroup is an open <g2> or <g4> group.
+type cpsGroup struct {
+	start int // offset of the group's first byte in the packet
+	width int // size of its length prefix, 2 or 4
+}
+
+// close inserts the big-endian length of result[g.start:] before it.
+func (g cpsGroup) close(result []byte) ([]byte, error) {
+	n := len(result) - g.start
+	prefix := make([]byte, g.width)
+	if g.width == 2 {
+		if n > 0xFFFF {
+			return nil, fmt.Errorf("%w: <g2> group of %d bytes does not fit a 2-byte length", ErrPacketTooBig, n)
+		}
+		binary.BigEndian.PutUint16(prefix, uint16(n))
+	} else {
+		binary.BigEndian.PutUint32(prefix, uint32(n))
+	}
+	return slices.Insert(result, g.start, prefix...), nil
+}
+
 // wrapInIKEv2Header wraps payload in IKEv2/IPsec header to mimic legitimate IKE negotiation
 // This adds 52 bytes of IKEv2 framing to match AtomicNoize's behavior exactly
 func wrapInIKEv2Header(payload []byte) []byte {
@@ -275,18 +622,18 @@ func wrapInIKEv2Header(payload []byte) []byte {
 	return header
 }
 
-// generateJunkPacket creates a junk packet with specified size constraints
-func (b *Bind) generateJunkPacket() []byte {
-	if b.AtomicNoizeConfig == nil {
+// generateJunkPacket creates a junk packet with the size constraints of config
+func (b *Bind) generateJunkPacket(config *AtomicNoizeConfig) []byte {
+	if config == nil {
 		return nil
 	}
 
-	minSize := b.AtomicNoizeConfig.Jmin
-	maxSize := b.AtomicNoizeConfig.Jmax
+	minSize := config.Jmin
+	maxSize := config.Jmax
 
 	// Handle zero-size packets based on AllowZeroSize flag
 	if minSize == 0 && maxSize == 0 {
-		if b.AtomicNoizeConfig.AllowZeroSize {
+		if config.AllowZeroSize {
 			return []byte{} // True 0-byte payload (may not work with all UDP implementations)
 		}
 		return []byte{0x00} // Minimal 1-byte packet (UDP requirement)
@@ -294,18 +641,18 @@ func (b *Bind) generateJunkPacket() []byte {
 
 	// If Jmin is 0, treat based on AllowZeroSize flag
 	if minSize == 0 {
-		if !b.AtomicNoizeConfig.AllowZeroSize {
+		if !config.AllowZeroSize {
 			minSize = 1
 		}
 		if maxSize == 0 {
-			if !b.AtomicNoizeConfig.AllowZeroSize {
+			if !config.AllowZeroSize {
 				maxSize = 1
 			}
 		}
 	}
 
 	// Ensure minimum 1 byte for UDP unless AllowZeroSize is true
-	if !b.AtomicNoizeConfig.AllowZeroSize {
+	if !config.AllowZeroSize {
 		if minSize < 1 {
 			minSize = 1
 		}
@@ -318,14 +665,14 @@ func (b *Bind) generateJunkPacket() []byte {
 	if maxSize == minSize {
 		size = minSize
 	} else if maxSize > minSize {
-		size = minSize + rng.Intn(maxSize-minSize+1)
+		size = minSize + mathrand.Intn(maxSize-minSize+1)
 	} else {
 		size = minSize
 	}
 
 	// Handle zero-size case
 	if size == 0 {
-		if b.AtomicNoizeConfig.AllowZeroSize {
+		if config.AllowZeroSize {
 			return []byte{}
 		}
 		return []byte{0x00}
@@ -336,51 +683,220 @@ func (b *Bind) generateJunkPacket() []byte {
 	if err != nil {
 		// Fallback to math/rand if crypto/rand fails
 		for i := range junk {
-			junk[i] = byte(rng.Intn(256))
+			junk[i] = byte(mathrand.Intn(256))
+		}
+	}
+	return b.compressJunkPayload(junk)
+}
+
+// sendPacket sends a single preflight packet on the WireGuard socket. what
+// names the packet for the error handler.
+// It reports whether the packet was sent. See WithUseInnerSend for when a
+// raw socket is used instead.
+func (b *Bind) sendPacket(packet []byte, ep conn.Endpoint, what string) bool {
+	if b.proxy != nil {
+		return b.sendPacketProxy(packet, ep, what)
+	}
+	if b.sendMode == sendRawOnly {
+		return b.sendPacketRaw(packet, ep, what)
+	}
+	if err := b.sendBatched([][]byte{packet}, ep); err != nil {
+		if b.sendMode == sendInnerWithFallback {
+			b.log.Debug("inner send failed, retrying on a raw socket", "packet", what, "error", err)
+			return b.sendPacketRaw(packet, ep, what)
+		}
+		b.sendFailures.Add(1)
+		b.reportError(err, what)
+		return false
+	}
+	b.bytesWritten.Add(int64(len(packet)))
+	b.captureEndpoint(ep, packet)
+	return true
+}
+
+// sendJunkPackets sends count junk packets through the WireGuard socket,
+// interval apart, and returns one interval after the last. Each gap is
+// jittered by config.JitterFraction. Packets are scheduled against the start
+// time, so the spacing does not drift.
+func (b *Bind) sendJunkPackets(ctx context.Context, ep conn.Endpoint, config *AtomicNoizeConfig, count int, interval time.Duration) {
+	if count <= 0 {
+		return
+	}
+	junk := func() []byte {
+		packet := b.numberJunk(ep.DstIP(), b.generateJunkPacket(config))
+		if !takeJunkBytes(ctx, len(packet)) {
+			b.log.Debug("junk byte cap reached for this handshake", "dst", ep.DstIP(), "limit", b.maxJunkBytes)
+			return nil
 		}
+		return packet
+	}
+	schedule := make([]TimedPacket, count)
+	var end time.Duration
+	for i := range schedule {
+		schedule[i] = TimedPacket{AbsoluteDelay: end, Payload: junk}
+		end += jitter(interval, config.JitterFraction)
+	}
+
+	start := time.Now()
+	completed := runSchedule(ctx, start, schedule, func(packet []byte) {
+		if b.sendPacket(packet, b.junkEndpoint(ep), "junk") {
+			b.countJunk(len(packet))
+		}
+	})
+	if completed {
+		sleepUntil(ctx, start.Add(end))
+	}
+}
+
+// sleepContext pauses for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// junkEndpoint returns the endpoint the next junk packet goes to: ep itself,
+// or ep's address on the next port configured via WithJunkPorts.
+func (b *Bind) junkEndpoint(ep conn.Endpoint) conn.Endpoint {
+	if len(b.junkPorts) == 0 {
+		return ep
+	}
+	i := b.junkPortIdx.Add(1) - 1
+	return b.endpointOnPort(ep, b.junkPorts[i%uint32(len(b.junkPorts))])
+}
+
+// endpointOnPort returns an endpoint for ep's address on port, or ep itself
+// if the inner Bind cannot parse one.
+func (b *Bind) endpointOnPort(ep conn.Endpoint, port uint16) conn.Endpoint {
+	portEp, err := b.inner.ParseEndpoint(netip.AddrPortFrom(ep.DstIP(), port).String())
+	if err != nil {
+		return ep
 	}
-	return junk
+	return portEp
 }
 
 // maybePreflightUsingSameSocket sends preflight packets using the WireGuard socket (same source port)
-func (b *Bind) maybePreflightUsingSameSocket(ep conn.Endpoint, bufs [][]byte) {
+func (b *Bind) maybePreflightUsingSameSocket(ep conn.Endpoint, bufs [][]byte) context.Context {
+	ctx := context.Background()
+	if b.frozen.Load() {
+		return ctx
+	}
 	dst := ep.DstIP()
-	var seenInit bool
+	var initBuf []byte
 	for _, buf := range bufs {
-		if handshakeInitiation(buf) {
-			seenInit = true
+		if b.classifier.IsHandshakeInit(buf) {
+			initBuf = buf
 			break
 		}
 	}
-	if !seenInit {
-		return
+	if initBuf == nil {
+		return ctx
 	}
 
+	// Everything from the dedupe check to updating lastSent happens in one
+	// critical section, so concurrent Sends to the same destination cannot
+	// both pass the rate limit. The scan above needs no lock since it only
+	// reads bufs.
 	now := time.Now()
 	b.mu.Lock()
+	if b.seenInitiation(dst, initBuf, now) {
+		// Retransmission of an initiation we already preflighted
+		b.mu.Unlock()
+		return ctx
+	}
+	if b.cookied[dst] {
+		// Re-initiation after a cookie reply; the peer is under load and
+		// has already seen our preflight.
+		delete(b.cookied, dst)
+		b.mu.Unlock()
+		return ctx
+	}
 	last := b.lastSent[dst]
-	if now.Sub(last) < b.interval {
+	interval := b.intervalFor(dst)
+	if now.Sub(last) < interval {
+		b.recordEvent(dst, PreflightEvent{Time: now, Kind: EventRateLimited, Err: ErrRateLimited})
 		b.mu.Unlock()
-		return
+		return ctx
+	}
+	if !b.preflightChance() {
+		b.recordEvent(dst, PreflightEvent{Time: now, Kind: EventSkippedByChance})
+		b.mu.Unlock()
+		return ctx
+	}
+	if !b.shared.claim(dst, now, interval) {
+		b.recordEvent(dst, PreflightEvent{Time: now, Kind: EventRateLimited, Err: ErrRateLimited})
+		b.mu.Unlock()
+		return ctx
 	}
 	b.lastSent[dst] = now
+	b.rateLimiterChanged()
+	b.recordSession(dst, initBuf, now)
 	b.mu.Unlock()
 
+	config, compiled := b.configFor(dst)
+	attrs := []attribute.KeyValue{
+		attribute.String("dst", dst.String()),
+		attribute.Bool("i1_present", compiled.i1.present()),
+	}
+	if config != nil {
+		attrs = append(attrs, attribute.Int("jc", config.Jc))
+	}
+	ctx, span := b.startSpan(ctx, "preflightbind.preflight", attrs...)
+	ctx = b.withJunkBudget(ctx)
+	ready := make(chan struct{})
+	ctx = withPreflightReady(ctx, ready)
+	job := preflightJob{ctx: ctx, ep: ep, config: config, compiled: compiled, at: now, span: span, ready: ready}
+	if !b.enqueuePreflight(job) {
+		b.runPreflight(job)
+	}
+	return ctx
+}
+
+// runPreflight sends one preflight sequence and records it, either inline
+// from Send or on the queue worker (see WithPreflightQueueDepth).
+func (b *Bind) runPreflight(job preflightJob) {
+	ep, config, compiled, now := job.ep, job.config, job.compiled, job.at
+	dst := ep.DstIP()
+	defer job.span.End()
+	defer close(job.ready)
+
+	// A job queued before Freeze must not send the config being replaced
+	if b.frozen.Load() {
+		job.span.AddEvent("preflight skipped, bind frozen")
+		return
+	}
+
 	// Execute AtomicNoize sequence using the SAME socket as WireGuard
-	if b.AtomicNoizeConfig != nil {
-		b.executeAtomicNoizePreflightUsingSameSocket(ep)
+	if config != nil {
+		b.preflightsFired.Add(1)
+		b.lastPreflight.Store(now.UnixNano())
+		b.enterState(StatePreHandshake)
+		ctx, cancel := b.preflightContext(job.ctx)
+		b.executeAtomicNoizePreflightUsingSameSocket(ctx, b.preflightEndpoint(ctx, ep), config, compiled)
 
 		// Apply handshake delay if configured
-		if b.AtomicNoizeConfig.HandshakeDelay > 0 {
-			time.Sleep(b.AtomicNoizeConfig.HandshakeDelay)
+		if config.HandshakeDelay > 0 {
+			sleepContext(ctx, jitter(config.HandshakeDelay, config.JitterFraction))
+		}
+		if ctx.Err() != nil {
+			b.log.Warn("preflight sequence exceeded its time budget, remaining steps skipped",
+				"dst", dst, "limit", b.maxPreflightDuration)
 		}
+		cancel()
+		b.leaveState(StatePreHandshake)
 	}
+
+	b.mu.Lock()
+	b.recordEvent(dst, PreflightEvent{Time: now, Kind: EventPreflightSent, Duration: time.Since(now)})
+	b.mu.Unlock()
 }
 
 // executeAtomicNoizePreflightUsingSameSocket sends obfuscation packets using WireGuard's socket
-func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint) {
-	config := b.AtomicNoizeConfig
-	if config == nil {
+func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ctx context.Context, ep conn.Endpoint, config *AtomicNoizeConfig, compiled compiledConfig) {
+	if config == nil || b.frozen.Load() {
 		return
 	}
 
@@ -389,63 +905,80 @@ func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint) {
 		junkInterval = 1 * time.Millisecond // Default to 1ms if not specified
 	}
 
+	// Step 0: Knock on the configured ports before I1
+	b.sendPortKnocks(ctx, ep)
+
 	// Step 1: Send I1 packet with IKEv2 framing using WireGuard socket
-	if config.I1 != "" && b.payload != nil {
-		framedPayload := wrapInIKEv2Header(b.payload)
-		_ = b.inner.Send([][]byte{framedPayload}, ep)
-		time.Sleep(2 * time.Millisecond)
+	if payload, err := compiled.i1.build(&b.cps, 1); err != nil {
+		b.reportError(err, "I1")
+	} else if len(payload) > 0 {
+		framedPayload := wrapInIKEv2Header(payload)
+		if !b.sendPacket(framedPayload, ep, "I1") {
+			b.advanceFallback(ep.DstIP())
+		}
+		b.sendMultipath(ctx, netip.AddrPortFrom(ep.DstIP(), uint16(b.port443)), framedPayload)
+		sleepContext(ctx, 2*time.Millisecond)
 	}
 
 	// Step 1.5: Send junk packets after I1 (if JcAfterI1 is specified)
-	if config.JcAfterI1 > 0 {
-		for i := 0; i < config.JcAfterI1; i++ {
-			junkPacket := b.generateJunkPacket()
-			_ = b.inner.Send([][]byte{junkPacket}, ep)
-			time.Sleep(junkInterval)
-		}
-	}
+	dst := ep.DstIP()
+	b.sendJunkPackets(ctx, ep, config, b.adaptJunkCount(config, dst, config.JcAfterI1), junkInterval)
 
 	// Step 2: Send junk packets using WireGuard socket (SAME source port)
-	if config.JcBeforeHS > 0 {
-		for i := 0; i < config.JcBeforeHS; i++ {
-			junkPacket := b.generateJunkPacket()
-			_ = b.inner.Send([][]byte{junkPacket}, ep)
-			time.Sleep(junkInterval)
-		}
-	}
+	b.sendJunkPackets(ctx, ep, config, b.adaptJunkCount(config, dst, config.JcBeforeHS), junkInterval)
 
 	// Step 3: Send I2-I5 signature packets using WireGuard socket
-	signatures := []string{"", config.I2, config.I3, config.I4, config.I5}
-	for i, sig := range signatures {
-		if i == 0 || sig == "" {
+	for i, sig := range compiled.signatures {
+		if ctx.Err() != nil {
+			return
+		}
+		packet, err := sig.build(&b.cps, i+2)
+		if err != nil {
+			b.reportError(err, fmt.Sprintf("I%d", i+2))
 			continue
 		}
-		packet, err := parseCPSPacket(sig)
-		if err == nil && len(packet) > 0 {
-			_ = b.inner.Send([][]byte{packet}, ep)
-			time.Sleep(1 * time.Millisecond)
+		if len(packet) > 0 {
+			b.sendPacket(packet, ep, fmt.Sprintf("I%d", i+2))
+			sleepContext(ctx, 1*time.Millisecond)
 		}
 	}
 }
 
 func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
-	b.maybePreflightUsingSameSocket(ep, bufs)
+	return b.send(bufs, ep, nil)
+}
+
+// send implements Send. gate, if not nil, is called with the preflight's
+// context before any of bufs is sent; see PreflightScheduler.
+func (b *Bind) send(bufs [][]byte, ep conn.Endpoint, gate func(context.Context)) error {
+	b.countMessages(bufs)
+	b.trackInitiations(ep, bufs)
+	ctx := b.maybePreflightUsingSameSocket(ep, bufs)
+	if gate != nil {
+		gate(ctx)
+	}
 
 	// Send post-handshake junk packets if needed
-	b.maybeSendPostHandshakeJunk(ep, bufs)
+	b.maybeSendPostHandshakeJunk(ctx, ep, bufs)
 
-	// For Cloudflare Warp compatibility, don't apply S1/S2 prefixes
-	// The obfuscation is achieved through junk packets and I1-I5 signature packets
-	return b.inner.Send(bufs, ep)
+	// For Cloudflare Warp compatibility, S1/S2 prefixes are only applied
+	// with WithHandshakePrefixes. By default the obfuscation is achieved
+	// through junk packets and I1-I5 signature packets
+	b.noteInitSent(ep, bufs)
+	return b.sendBatched(b.prefixHandshakes(b.interleave(b.padHandshakes(bufs), ep), ep), ep)
 }
 
-// maybeSendPostHandshakeJunk sends remaining junk packets after handshake request
-func (b *Bind) maybeSendPostHandshakeJunk(ep conn.Endpoint, bufs [][]byte) {
-	if b.AtomicNoizeConfig == nil {
+// maybeSendPostHandshakeJunk sends remaining junk packets after handshake
+// request. ctx carries the preflight span, if any, as the parent of its own.
+func (b *Bind) maybeSendPostHandshakeJunk(ctx context.Context, ep conn.Endpoint, bufs [][]byte) {
+	if b.frozen.Load() {
+		return
+	}
+	dst := ep.DstIP()
+	config, _ := b.configFor(dst)
+	if config == nil {
 		return
 	}
-
-	config := b.AtomicNoizeConfig
 
 	// Calculate remaining junk packets to send after handshake
 	remainingJunk := config.Jc - config.JcBeforeHS
@@ -456,7 +989,7 @@ func (b *Bind) maybeSendPostHandshakeJunk(ep conn.Endpoint, bufs [][]byte) {
 	// Check if this is a handshake initiation (type 1)
 	var seenHandshakeRequest bool
 	for _, buf := range bufs {
-		if len(buf) > 0 && buf[0] == 1 {
+		if b.classifier.IsHandshakeInit(buf) {
 			seenHandshakeRequest = true
 			break
 		}
@@ -466,29 +999,130 @@ func (b *Bind) maybeSendPostHandshakeJunk(ep conn.Endpoint, bufs [][]byte) {
 		return
 	}
 
-	dst := ep.DstIP()
 	b.mu.Lock()
 	alreadySent := b.postHandshakeSent[dst]
-	if alreadySent {
+	if alreadySent || b.closed {
 		b.mu.Unlock()
 		return
 	}
 	b.postHandshakeSent[dst] = true
+	b.recordEvent(dst, PreflightEvent{Time: time.Now(), Kind: EventPostHandshakeJunk})
+	b.background.Add(1)
 	b.mu.Unlock()
 
 	// Send remaining junk packets using WireGuard socket (same source port)
 	// Send immediately after handshake request without delay
+	ctx = b.withJunkBudget(ctx) // shared with the preflight, if one just ran
+	_, span := b.startSpan(ctx, "preflightbind.post_handshake",
+		attribute.String("dst", dst.String()), attribute.Int("junk", remainingJunk))
 	go func() {
+		defer b.background.Done()
+		defer span.End()
+		b.activePostHandshake.Add(1)
+		defer b.activePostHandshake.Add(-1)
 		junkInterval := config.JunkInterval
 		if junkInterval == 0 {
 			junkInterval = 1 * time.Millisecond // Default to 1ms if not specified
 		}
-		for i := 0; i < remainingJunk; i++ {
-			junkPacket := b.generateJunkPacket()
-			_ = b.inner.Send([][]byte{junkPacket}, ep)
-			time.Sleep(junkInterval)
-		}
+		b.enterState(StatePostHandshake)
+		defer b.leaveState(StatePostHandshake)
+		b.sendJunkPackets(ctx, ep, config, b.adaptJunkCount(config, dst, remainingJunk), junkInterval)
 	}()
 }
 
-// applyAtomicNoizePrefix adds S1/S2 random prefixes to WireGuard packets
+// applyAtomicNoizePrefix adds S1/S2 random prefixes to WireGuard packets:
+// S1 bytes before a handshake initiation, S2 bytes before a handshake
+// response. Other packets are returned unchanged. buf is not modified.
+func (b *Bind) applyAtomicNoizePrefix(buf []byte, config *AtomicNoizeConfig) []byte {
+	if config == nil || len(buf) == 0 {
+		return buf
+	}
+	var n int
+	switch {
+	case b.classifier.IsHandshakeInit(buf):
+		n = config.S1
+	case b.classifier.IsHandshakeResponse(buf):
+		n = config.S2
+	}
+	if n <= 0 {
+		return buf
+	}
+	out := make([]byte, n+len(buf))
+	if _, err := rand.Read(out[:n]); err != nil {
+		for i := 0; i < n; i++ {
+			out[i] = byte(mathrand.Intn(256))
+		}
+	}
+	copy(out[n:], buf)
+	return out
+}
+
+// stripAtomicNoizePrefix returns the length of the S1/S2 prefix on a received
+// packet, or 0 if it carries none. The prefix is random, so the message type
+// is read just after it: a response (type 2) of S2 plus the standard size
+// loses S2 bytes, and an initiation (type 1, unexpected on a client) of S1
+// plus the standard size loses S1 bytes.
+//
+// A transport packet can have the same length and, one time in 256, the
+// same byte at that offset, so the three reserved bytes after the type must
+// be zero as well. Cloudflare WARP fills them in, so a response whose
+// reserved bytes are set is still accepted when its receiver index names an
+// initiation we sent, as reported by known (which may be nil).
+func stripAtomicNoizePrefix(buf []byte, config *AtomicNoizeConfig, known func(receiver uint32) bool) int {
+	if config == nil {
+		return 0
+	}
+	reservedZero := func(s int) bool { return buf[s+1] == 0 && buf[s+2] == 0 && buf[s+3] == 0 }
+	if s := config.S2; s > 0 && len(buf) == s+device.MessageResponseSize &&
+		buf[s] == byte(device.MessageResponseType) {
+		if reservedZero(s) || (known != nil && known(binary.LittleEndian.Uint32(buf[s+respReceiverOffset:]))) {
+			return s
+		}
+	}
+	if s := config.S1; s > 0 && len(buf) == s+device.MessageInitiationSize &&
+		buf[s] == byte(device.MessageInitiationType) && reservedZero(s) {
+		return s
+	}
+	return 0
+}
+
+// respReceiverOffset is where a handshake response carries the sender index
+// of the initiation it answers.
+const respReceiverOffset = 8
+
+// sentSender reports whether an initiation with sender index sender was
+// preflighted to dst recently.
+func (b *Bind) sentSender(dst netip.Addr, sender uint32) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.sessions.lookup(sessionKey{dst: dst, sender: sender})
+	return ok
+}
+
+// WithHandshakePrefixes turns on the AmneziaWG S1/S2 handshake prefixes:
+// outgoing initiations and responses get S1 and S2 random bytes prepended,
+// and received handshake messages have them removed. It is off by default
+// because Cloudflare WARP expects unprefixed handshakes; enable it only for
+// AmneziaWG servers configured with the same S1 and S2.
+func WithHandshakePrefixes(enabled bool) Option {
+	return func(b *Bind) {
+		b.handshakePrefixes = enabled
+	}
+}
+
+// prefixHandshakes applies applyAtomicNoizePrefix to every handshake message
+// in bufs when WithHandshakePrefixes is enabled.
+func (b *Bind) prefixHandshakes(bufs [][]byte, ep conn.Endpoint) [][]byte {
+	if !b.handshakePrefixes {
+		return bufs
+	}
+	config, _ := b.configFor(ep.DstIP())
+	if config == nil || (config.S1 == 0 && config.S2 == 0) {
+		return bufs
+	}
+	out := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		out[i] = b.applyAtomicNoizePrefix(buf, config)
+	}
+	return out
+}
@@ -0,0 +1,3250 @@
+package preflightbind
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func FuzzParseCPSPacket(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"<b 0xc200>",
+		"<b 0d0a0d0a><t><r 16>",
+		"<b 0c0d0e0f><c>",
+		"<r 1000>",
+		"<r 1001>",
+		"<r -1>",
+		"<r 99999999999999999999>",
+		"<b zz>",
+		"<b 0x>",
+		"<b 0>",
+		"<<b 00>>",
+		"<b 00",
+		"<h>",
+		"<x 00>",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, cps string) {
+		out, err := parseCPSPacket(cps)
+		if err != nil {
+			return
+		}
+		// Each <r> tag is capped at 1000 bytes; <b> tags emit at most half
+		// their hex length. Anything beyond that means a cap was bypassed.
+		if limit := 1000*strings.Count(cps, "<") + len(cps); len(out) > limit {
+			t.Fatalf("parseCPSPacket(%q) returned %d bytes, want <= %d", cps, len(out), limit)
+		}
+	})
+}
+
+func TestParseCPSPacketRandomCap(t *testing.T) {
+	for _, cps := range []string{"<r 100000>", "<e 100000>"} {
+		out, err := parseCPSPacket(cps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 1000 {
+			t.Fatalf("%s: got %d random bytes, want 1000", cps, len(out))
+		}
+	}
+}
+
+func TestParseCPSPacketRejectsBadHex(t *testing.T) {
+	for _, cps := range []string{"<b zz>", "<b 0>", "<b 0xabc>"} {
+		if _, err := parseCPSPacket(cps); err == nil {
+			t.Errorf("parseCPSPacket(%q) succeeded, want error", cps)
+		}
+	}
+}
+
+func TestParseAmneziaConfigSection(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"ini", "[Interface]\nPrivateKey = abc=\n\n[AmneziaWarp]\nJc = 4\nJmin = 40\nJmax = 70\nH1 = 0x10\nI1 = <b 0xc200><r 16>\nJunkInterval = 5ms\n"},
+		{"toml", "[amnezia]\njc = 4\njmin = 40\njmax = 70\nh1 = \"16\"\ni1 = \"<b 0xc200><r 16>\"\njunkinterval = \"5ms\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseAmneziaConfigSection(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Jc != 4 || cfg.Jmin != 40 || cfg.Jmax != 70 || cfg.H1 != 16 ||
+				cfg.I1 != "<b 0xc200><r 16>" || cfg.JunkInterval != 5*time.Millisecond {
+				t.Fatalf("unexpected config %+v", cfg)
+			}
+		})
+	}
+
+	_, err := ParseAmneziaConfigSection(strings.NewReader("[Interface]\nPrivateKey = abc=\n"))
+	if !errors.Is(err, ErrMissingSection) {
+		t.Fatalf("got %v, want ErrMissingSection", err)
+	}
+}
+
+func TestParseAndroidAmneziaConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"flat", `{"jc":"4","jmin":40,"jmax":"70","h1":"0x10","i1":"<b 0xc200><r 16>","mtu":1280}`},
+		{"interface", `{"interface":{"Jc":4,"Jmin":"40","Jmax":70,"H1":16,"I1":"<b 0xc200><r 16>"},"peers":[]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseAndroidAmneziaConfig([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Jc != 4 || cfg.Jmin != 40 || cfg.Jmax != 70 || cfg.H1 != 16 || cfg.I1 != "<b 0xc200><r 16>" {
+				t.Fatalf("unexpected config %+v", cfg)
+			}
+		})
+	}
+
+	var perr *ParseError
+	if _, err := ParseAndroidAmneziaConfig([]byte(`{"jc":`)); !errors.As(err, &perr) {
+		t.Fatalf("got %v, want *ParseError", err)
+	}
+	if _, err := ParseAndroidAmneziaConfig([]byte(`{"jmin":80,"jmax":40}`)); err == nil {
+		t.Fatal("accepted Jmax < Jmin")
+	}
+}
+
+func TestParseCPSPacketString(t *testing.T) {
+	tests := []struct {
+		cps  string
+		want string
+	}{
+		{`<s GET / HTTP/1.1\r\nHost: example.com\r\n\r\n>`, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{`<s CONNECT example.com:443 HTTP/1.1\r\n>`, "CONNECT example.com:443 HTTP/1.1\r\n"},
+		{`<b 16><s a\>b><b 17>`, "\x16a>b\x17"},
+		{`<s \x20lead\\trail >`, " lead\\trail "},
+		{`<s héllo>`, "héllo"},
+	}
+	for _, tt := range tests {
+		got, err := parseCPSPacket(tt.cps)
+		if err != nil {
+			t.Errorf("parseCPSPacket(%q): %v", tt.cps, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("parseCPSPacket(%q) = %q, want %q", tt.cps, got, tt.want)
+		}
+	}
+
+	for _, cps := range []string{`<s bad\q>`, `<s \x4>`, `<s \xzz>`} {
+		if _, err := parseCPSPacket(cps); err == nil {
+			t.Errorf("parseCPSPacket(%q) succeeded, want error", cps)
+		}
+	}
+}
+
+func handshakeInitPacket() []byte {
+	buf := make([]byte, device.MessageInitiationSize)
+	buf[0] = byte(device.MessageInitiationType)
+	return buf
+}
+
+// TestDynamicI1 checks that an I1 with dynamic parts, or one generated from
+// a profile, is rebuilt for every preflight rather than resent verbatim.
+func TestDynamicI1(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  *AtomicNoizeConfig
+		opts []Option
+	}{
+		{"nonce", &AtomicNoizeConfig{I1: "<b 0102><e 16><t>"}, nil},
+		{"sni", &AtomicNoizeConfig{}, []Option{WithSNI("example.com")}},
+		{"quic", &AtomicNoizeConfig{}, []Option{WithFingerprintProfile(FingerprintQUICInitial, ProfileOptions{})}},
+	} {
+		fake := testutil.NewFakeBind()
+		b, err := NewWithAtomicNoize(fake, tt.cfg, 443, time.Hour, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep, err := b.ParseEndpoint("192.0.2.1:2408")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var i1s [][]byte
+		for range 2 {
+			fake.Reset()
+			b.ResetRateLimiter()
+			if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+				t.Fatal(err)
+			}
+			i1s = append(i1s, fake.Sends()[0].Packet)
+		}
+		if bytes.Equal(i1s[0], i1s[1]) {
+			t.Errorf("%s: two preflights sent the same I1 %x", tt.name, i1s[0])
+		}
+	}
+}
+
+func TestSendFiresPreflightOnce(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{
+		I1:         "<b 0102030405060708>",
+		I2:         "<b aabb>",
+		Jc:         2,
+		Jmin:       10,
+		Jmax:       20,
+		JcAfterI1:  1,
+		JcBeforeHS: 2,
+	}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init := handshakeInitPacket()
+	if err := b.Send([][]byte{init}, ep); err != nil {
+		t.Fatal(err)
+	}
+	sends := fake.Sends()
+	// I1, JcAfterI1 + JcBeforeHS junk packets, I2, then the initiation itself
+	if len(sends) != 1+3+1+1 {
+		t.Fatalf("got %d packets, want 6", len(sends))
+	}
+	if !bytes.HasSuffix(sends[0].Packet, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("first packet %x is not I1", sends[0].Packet)
+	}
+	for _, s := range sends[1:4] {
+		if n := len(s.Packet); n < cfg.Jmin || n > cfg.Jmax {
+			t.Errorf("junk packet of %d bytes outside [%d, %d]", n, cfg.Jmin, cfg.Jmax)
+		}
+	}
+	if !bytes.Equal(sends[4].Packet, []byte{0xaa, 0xbb}) {
+		t.Errorf("got %x, want I2", sends[4].Packet)
+	}
+	if !bytes.Equal(sends[5].Packet, init) {
+		t.Errorf("last packet is not the handshake initiation")
+	}
+
+	// A second initiation inside the interval is passed through untouched
+	fake.Reset()
+	if err := b.Send([][]byte{init}, ep); err != nil {
+		t.Fatal(err)
+	}
+	if sends := fake.Sends(); len(sends) != 1 {
+		t.Fatalf("got %d packets for rate-limited initiation, want 1", len(sends))
+	}
+}
+
+func TestConcurrentSendFiresPreflightOnce(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const senders = 100
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			init := handshakeInitPacket()
+			init[4] = byte(i) // distinct sender index per goroutine
+			if err := b.Send([][]byte{init}, ep); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	preflights := 0
+	for _, s := range fake.Sends() {
+		if bytes.HasSuffix(s.Packet, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+			preflights++
+		}
+	}
+	if preflights != 1 {
+		t.Fatalf("got %d preflights from %d concurrent initiations, want 1", preflights, senders)
+	}
+	if got := b.Stats().TotalPreflightsFired; got != 1 {
+		t.Fatalf("Stats reports %d preflights, want 1", got)
+	}
+}
+
+func TestHandshakePrefixRoundTrip(t *testing.T) {
+	cfg := &AtomicNoizeConfig{S1: 15, S2: 40}
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Hour, WithHandshakePrefixes(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := make([]byte, device.MessageResponseSize)
+	response[0] = byte(device.MessageResponseType)
+	tests := []struct {
+		name   string
+		packet []byte
+		prefix int
+	}{
+		{"initiation", handshakeInitPacket(), cfg.S1},
+		{"response", response, cfg.S2},
+		{"transport", []byte{4, 0, 0, 0, 1, 2, 3}, 0},
+	}
+	// A transport packet of exactly S2 plus the response size whose byte at
+	// offset S2 happens to be 2 must pass through untouched
+	transport := make([]byte, cfg.S2+device.MessageResponseSize)
+	transport[0] = byte(device.MessageTransportType)
+	for i := 1; i < len(transport); i++ {
+		transport[i] = byte(i*7 + 1)
+	}
+	transport[cfg.S2] = byte(device.MessageResponseType)
+	if n := stripAtomicNoizePrefix(transport, cfg, nil); n != 0 {
+		t.Errorf("stripped %d bytes from a transport packet of length S2+%d", n, device.MessageResponseSize)
+	}
+	// WARP sets the reserved bytes; the receiver index vouches for it then
+	warp := b.applyAtomicNoizePrefix(response, cfg)
+	warp[cfg.S2+1] = 0x5a
+	binary.LittleEndian.PutUint32(warp[cfg.S2+respReceiverOffset:], 77)
+	known := func(receiver uint32) bool { return receiver == 77 }
+	if n := stripAtomicNoizePrefix(warp, cfg, known); n != cfg.S2 {
+		t.Errorf("WARP response with a known receiver: stripped %d bytes, want %d", n, cfg.S2)
+	}
+	if n := stripAtomicNoizePrefix(warp, cfg, nil); n != 0 {
+		t.Errorf("WARP response with an unknown receiver: stripped %d bytes, want 0", n)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := b.applyAtomicNoizePrefix(tt.packet, cfg)
+			if len(sent) != len(tt.packet)+tt.prefix {
+				t.Fatalf("prefixed packet is %d bytes, want %d", len(sent), len(tt.packet)+tt.prefix)
+			}
+			n := stripAtomicNoizePrefix(sent, cfg, nil)
+			if n != tt.prefix {
+				t.Fatalf("stripped %d bytes, want %d", n, tt.prefix)
+			}
+			if !bytes.Equal(sent[n:], tt.packet) {
+				t.Fatal("stripped packet differs from the original")
+			}
+		})
+	}
+}
+
+func TestPersistentRateLimiterSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.db")
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	preflights := func(fake *testutil.FakeBind) int {
+		n := 0
+		for _, s := range fake.Sends() {
+			if bytes.HasSuffix(s.Packet, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+				n++
+			}
+		}
+		return n
+	}
+
+	for i, want := range []int{1, 0} {
+		fake := testutil.NewFakeBind()
+		b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPersistentRateLimiter(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Open(0); err != nil {
+			t.Fatal(err)
+		}
+		ep, err := b.ParseEndpoint("192.0.2.1:2408")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := preflights(fake); got != want {
+			t.Fatalf("run %d: got %d preflights, want %d", i+1, got, want)
+		}
+	}
+}
+
+func TestHandshakeFailureHook(t *testing.T) {
+	var fired []int
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), nil, 443, time.Hour,
+		WithHandshakeFailureHook(func(dst netip.Addr, count int) { fired = append(fired, count) }, 3, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fired) != 1 || fired[0] != 3 {
+		t.Fatalf("hook fired with %v after 5 initiations, want [3]", fired)
+	}
+
+	b.handshakeAnswered(ep.DstIP())
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+	if len(fired) != 1 {
+		t.Fatalf("hook fired again with %v after the peer answered", fired)
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	shared := NewSharedRateLimiter()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	total := 0
+	for i := 0; i < 2; i++ {
+		fake := testutil.NewFakeBind()
+		b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithSharedRateLimiter(shared))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep, err := b.ParseEndpoint("192.0.2.1:2408")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		total += int(b.Stats().TotalPreflightsFired)
+	}
+	if total != 1 {
+		t.Fatalf("two Binds sharing a rate limiter fired %d preflights, want 1", total)
+	}
+}
+
+func TestMaxJunkBytesPerHandshake(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{Jc: 10, JcBeforeHS: 10, Jmin: 100, Jmax: 100}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithMaxJunkBytesPerHandshake(350))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Stats().TotalJunkBytesSent; got != 300 {
+		t.Fatalf("sent %d junk bytes with a 350-byte cap, want 300", got)
+	}
+}
+
+func TestStickyPreflightPort(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := &AtomicNoizeConfig{JcBeforeHS: 3, Jmin: 10, Jmax: 10}
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Hour,
+		WithUseInnerSend(false), WithStickyPreflightPort(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ep, err := b.ParseEndpoint(ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := make(map[uint16]bool)
+	buf := make([]byte, 64)
+	_ = ln.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		_, src, err := ln.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[src.Port()] = true
+	}
+	if len(ports) != 1 {
+		t.Fatalf("junk came from %d source ports, want 1", len(ports))
+	}
+}
+
+func TestDOHResolver(t *testing.T) {
+	queries := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		raw, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(raw); err != nil {
+			t.Error(err)
+			return
+		}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 7}},
+			}},
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer srv.Close()
+
+	fake := testutil.NewFakeBind()
+	b, err := NewWithAtomicNoize(fake, &AtomicNoizeConfig{I1: "<b 01>"}, 443, time.Hour,
+		WithDOHResolver(srv.URL), WithDOHHost("vpn.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The endpoint itself is left to the inner Bind
+	if _, err := b.ParseEndpoint("vpn.example:2408"); err == nil {
+		t.Fatal("ParseEndpoint resolved a host name instead of delegating")
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		fake.Reset()
+		b.ResetRateLimiter()
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		sends := fake.Sends()
+		if got := sends[0].Endpoint.DstToString(); got != "192.0.2.7:2408" {
+			t.Fatalf("preflight sent to %s, want the DoH answer 192.0.2.7:2408", got)
+		}
+		if got := sends[len(sends)-1].Endpoint.DstToString(); got != "192.0.2.1:2408" {
+			t.Fatalf("handshake sent to %s, want the endpoint 192.0.2.1:2408", got)
+		}
+	}
+	if queries != 1 {
+		t.Fatalf("made %d DoH queries, want 1 with the answer cached", queries)
+	}
+}
+
+func TestMessageCounters(t *testing.T) {
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := make([]byte, device.MessageTransportSize)
+	transport[0] = byte(device.MessageTransportType)
+	bufs := [][]byte{handshakeInitPacket(), transport, transport, transport, {0xff}}
+	if err := b.Send(bufs, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	s := b.Stats()
+	if s.HandshakeInitsSent != 1 || s.HandshakeResponsesSent != 0 || s.TransportMsgsSent != 3 {
+		t.Fatalf("got %d inits, %d responses, %d transport; want 1, 0, 3",
+			s.HandshakeInitsSent, s.HandshakeResponsesSent, s.TransportMsgsSent)
+	}
+	if got := b.DataToControlRatio(); got != 3 {
+		t.Fatalf("DataToControlRatio() = %v, want 3", got)
+	}
+}
+
+// TestRNGConcurrentAccess checks that junk generation is safe to call from
+// concurrent Sends; run it with -race.
+func TestRNGConcurrentAccess(t *testing.T) {
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &AtomicNoizeConfig{Jmin: 10, Jmax: 200}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if n := len(b.generateJunkPacket(cfg)); n < cfg.Jmin || n > cfg.Jmax {
+					t.Errorf("junk packet of %d bytes outside [%d, %d]", n, cfg.Jmin, cfg.Jmax)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// serveSOCKS5 answers one SOCKS5 client on ln without authentication. With
+// relay set it grants UDP ASSOCIATE on that socket; otherwise it refuses it
+// and serves CONNECT to any target.
+func serveSOCKS5(t *testing.T, ln net.Listener, relay *net.UDPConn) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, 262)
+			if _, err := io.ReadFull(c, buf[:2]); err != nil {
+				return
+			}
+			io.ReadFull(c, buf[:buf[1]])
+			c.Write([]byte{5, 0})
+			if _, err := io.ReadFull(c, buf[:4]); err != nil {
+				return
+			}
+			cmd := buf[1]
+			var target string
+			switch buf[3] {
+			case 1:
+				io.ReadFull(c, buf[:6])
+				target = net.JoinHostPort(net.IP(buf[:4]).String(), fmt.Sprint(int(buf[4])<<8|int(buf[5])))
+			default:
+				t.Errorf("unexpected address type %d", buf[3])
+				return
+			}
+			if relay == nil {
+				if cmd == 3 {
+					c.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) // command not supported
+					return
+				}
+				dst, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer dst.Close()
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				io.Copy(dst, c)
+				return
+			}
+			reply := []byte{5, 0, 0, 1, 0, 0, 0, 0}
+			reply = binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+			c.Write(reply)
+			io.Copy(io.Discard, c) // hold the association open
+		}()
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.7:2408")
+	payload := []byte("preflight")
+
+	t.Run("udp", func(t *testing.T) {
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer relay.Close()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serveSOCKS5(t, ln, relay)
+
+		b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour, WithSOCKS5Proxy(ln.Addr().String(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if err := b.proxy.send(dst, payload); err != nil {
+			t.Fatal(err)
+		}
+		relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, _, err := relay.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := socks5Datagram(dst, payload); !bytes.Equal(buf[:n], want) {
+			t.Fatalf("relay got %x, want %x", buf[:n], want)
+		}
+	})
+
+	t.Run("tcp fallback", func(t *testing.T) {
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serveSOCKS5(t, ln, nil)
+
+		b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour, WithSOCKS5Proxy(ln.Addr().String(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if err := b.proxy.send(netip.MustParseAddrPort(target.Addr().String()), payload); err != nil {
+			t.Fatal(err)
+		}
+		c, err := target.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		frame := make([]byte, 2+len(payload))
+		if _, err := io.ReadFull(c, frame); err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint16(frame) != uint16(len(payload)) || !bytes.Equal(frame[2:], payload) {
+			t.Fatalf("target got frame %x", frame)
+		}
+	})
+}
+
+func TestJitter(t *testing.T) {
+	const d = 100 * time.Millisecond
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		got := jitter(d, 0.2)
+		if got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("jitter(%v, 0.2) = %v, outside ±20%%", d, got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter returned the same delay every time")
+	}
+	if got := jitter(d, 0); got != d {
+		t.Errorf("jitter(%v, 0) = %v, want unchanged", d, got)
+	}
+	if err := (&AtomicNoizeConfig{JitterFraction: 0.6}).Validate(); err == nil {
+		t.Error("Validate accepted JitterFraction 0.6")
+	}
+}
+
+func TestWriteConfigRoundTrip(t *testing.T) {
+	cfg := &AtomicNoizeConfig{
+		I1:             `<b 160301><s a;b#c\x20>`,
+		I2:             "<r 16>",
+		Jc:             4,
+		Jmin:           40,
+		Jmax:           70,
+		H1:             0xdeadbeef,
+		JunkInterval:   5 * time.Millisecond,
+		HandshakeDelay: 250 * time.Microsecond,
+		AllowZeroSize:  true,
+		JitterFraction: 0.25,
+	}
+	for _, format := range []string{"json", "toml", "ini"} {
+		var buf bytes.Buffer
+		if err := WriteConfig(&buf, cfg, format); err != nil {
+			t.Fatalf("WriteConfig(%s): %v", format, err)
+		}
+		got, err := ReadConfig(&buf)
+		if err != nil {
+			t.Fatalf("ReadConfig(%s): %v", format, err)
+		}
+		if !got.Equal(cfg) {
+			t.Errorf("%s round trip changed %v", format, ConfigDiff(cfg, got))
+		}
+	}
+
+	var perr *ParseError
+	if _, err := ReadConfig(strings.NewReader(`{"privateKey": "x"}`)); !errors.As(err, &perr) || perr.Source != "json" {
+		t.Errorf("ReadConfig of JSON without fields = %v, want json *ParseError", err)
+	}
+	if err := WriteConfig(io.Discard, cfg, "yaml"); err == nil {
+		t.Error("WriteConfig accepted format yaml")
+	}
+}
+
+func TestProbeReachability(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	loopback := netip.MustParseAddr("127.0.0.1")
+
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, echo.LocalAddr().(*net.UDPAddr).Port, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := b.ProbeReachability(context.Background(), loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.UDPReachable || !res.HostUp() {
+		t.Errorf("got %+v, want UDP reachable", res)
+	}
+	if _, ok := b.AverageRTT(loopback); !ok {
+		t.Error("UDP probe round trip not recorded")
+	}
+	t.Logf("ICMP reachable %v (%v)", res.ICMPReachable, res.ICMPErr)
+
+	// A port nobody listens on is refused
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+	b, err = NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, port, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = b.ProbeReachability(context.Background(), loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.UDPRefused || res.UDPReachable {
+		t.Errorf("got %+v, want UDP refused", res)
+	}
+}
+
+func TestPreflightSchedulerHoldsHandshake(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", HandshakeDelay: 50 * time.Millisecond}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPreflightQueueDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	s := NewPreflightScheduler(b, time.Second)
+	ep, err := s.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	init := handshakeInitPacket()
+	if err := s.Send([][]byte{init}, ep); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.HandshakeDelay {
+		t.Errorf("Send returned after %v, before the %v handshake delay", elapsed, cfg.HandshakeDelay)
+	}
+	sends := fake.Sends()
+	if len(sends) != 2 || !bytes.Equal(sends[1].Packet, init) {
+		t.Fatalf("got %d packets, want I1 then the initiation", len(sends))
+	}
+}
+
+// TestPreflightQueueDropOnClose checks that jobs still queued when the
+// bind closes release their handshake gate and end their span.
+func TestPreflightQueueDropOnClose(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", HandshakeDelay: 300 * time.Millisecond}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPreflightQueueDepth(1), WithTraceProvider(tp), WithConfigDefaults(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	s := NewPreflightScheduler(b, 5*time.Second)
+
+	// The first preflight keeps the worker busy in its handshake delay
+	first, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, first); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(fake.Sends()) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not start the first preflight")
+		}
+	}
+
+	second, err := b.ParseEndpoint("192.0.2.2:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- s.Send([][]byte{handshakeInitPacket()}, second) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		queued := len(b.preflightJobs)
+		b.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second preflight was not queued")
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake gate of a dropped preflight stayed closed")
+	}
+	var dropped bool
+	for _, span := range recorder.Ended() {
+		for _, ev := range span.Events() {
+			dropped = dropped || strings.Contains(ev.Name, "dropped")
+		}
+	}
+	if !dropped {
+		t.Error("span of the dropped preflight was not ended")
+	}
+	for _, p := range fake.Sends() {
+		if p.Endpoint.DstIP() == second.DstIP() && !bytes.Equal(p.Packet, handshakeInitPacket()) {
+			t.Errorf("dropped preflight sent %x", p.Packet)
+		}
+	}
+}
+
+// TestFreezeQueuedPreflight checks that a preflight queued before Freeze
+// does not send the old config once the worker reaches it.
+func TestFreezeQueuedPreflight(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", Jc: 2, Jmin: 10, Jmax: 10, HandshakeDelay: 100 * time.Millisecond}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPreflightQueueDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	s := NewPreflightScheduler(b, 5*time.Second)
+
+	first, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, first); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(fake.Sends()) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not start the first preflight")
+		}
+	}
+
+	second, err := b.ParseEndpoint("192.0.2.2:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- s.Send([][]byte{handshakeInitPacket()}, second) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		queued := len(b.preflightJobs)
+		b.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second preflight was not queued")
+		}
+	}
+	b.Freeze()
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]byte
+	for _, p := range fake.Sends() {
+		if p.Endpoint.DstIP() == second.DstIP() {
+			got = append(got, p.Packet)
+		}
+	}
+	if len(got) != 1 || !bytes.Equal(got[0], handshakeInitPacket()) {
+		t.Errorf("frozen Bind sent %d packets to the queued destination, want only the initiation", len(got))
+	}
+}
+
+func TestBuildEDNS0PaddedQuery(t *testing.T) {
+	for _, size := range []int{128, 468} {
+		q, err := BuildEDNS0PaddedQuery("example.com", uint16(dnsmessage.TypeAAAA), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(q) != size {
+			t.Fatalf("query is %d bytes, want %d", len(q), size)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(q); err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != "example.com." || msg.Questions[0].Type != dnsmessage.TypeAAAA {
+			t.Errorf("unexpected question %v", msg.Questions)
+		}
+		opt, ok := msg.Additionals[0].Body.(*dnsmessage.OPTResource)
+		if !ok || len(opt.Options) != 1 || opt.Options[0].Code != ednsPaddingOption {
+			t.Errorf("missing padding option in %v", msg.Additionals)
+		}
+	}
+	if _, err := BuildEDNS0PaddedQuery("example.com", 1, 20); err == nil {
+		t.Error("padded size smaller than the query was accepted")
+	}
+}
+
+func TestMultipathCount(t *testing.T) {
+	const n = 3
+	lc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lc.Close()
+	port := lc.LocalAddr().(*net.UDPAddr).Port
+
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{I1: "<b 0102030405060708>"}, port, time.Hour, WithMultipathCount(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("127.0.0.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	i1 := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ports := map[int]bool{}
+	buf := make([]byte, 1500)
+	lc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(ports) < n {
+		m, from, err := lc.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("got I1 from %d source ports, want %d: %v", len(ports), n, err)
+		}
+		if !bytes.HasSuffix(buf[:m], i1) {
+			t.Fatalf("got %x, want the framed I1", buf[:m])
+		}
+		ports[from.Port] = true
+	}
+}
+
+// TestMaxPreflightDuration checks that a preflight stuck waiting for a
+// socket and a long handshake delay still returns within the cap.
+func TestMaxPreflightDuration(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	var logs bytes.Buffer
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", HandshakeDelay: 10 * time.Second}
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 9, time.Hour,
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithMultipathCount(2), WithMaxOpenSockets(1), WithMaxPreflightDuration(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hold the only socket slot, so the multipath copies of I1 block
+	held, err := b.dial(context.Background(), netip.MustParseAddrPort("127.0.0.1:9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	ep, err := b.ParseEndpoint("127.0.0.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > limit+time.Second {
+		t.Errorf("Send took %v with a %v preflight cap", elapsed, limit)
+	}
+	if !strings.Contains(logs.String(), "exceeded its time budget") {
+		t.Errorf("no warning about the skipped steps in %q", logs.String())
+	}
+}
+
+func TestMaxOpenSockets(t *testing.T) {
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour, WithMaxOpenSockets(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := netip.MustParseAddrPort("127.0.0.1:9")
+	first, err := b.dial(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if c, err := b.dial(ctx, dst); err == nil {
+		c.Close()
+		t.Fatal("second socket opened past the cap")
+	}
+
+	first.Close()
+	first.Close() // a second Close must not free another slot
+	second, err := b.dial(context.Background(), dst)
+	if err != nil {
+		t.Fatalf("socket not available after Close: %v", err)
+	}
+	defer second.Close()
+	if len(b.socketSem) != 1 {
+		t.Fatalf("%d slots in use, want 1", len(b.socketSem))
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	cfg := &AtomicNoizeConfig{I1: "<b c0ffee0123>", Jc: 3}
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	d := b.Diagnostics()
+	for _, want := range []string{"*testutil.FakeBind", "amnezia: enabled", "Jc=3", "signatures set: I1,", "192.0.2.1", "preflights=1"} {
+		if !strings.Contains(d, want) {
+			t.Errorf("Diagnostics missing %q:\n%s", want, d)
+		}
+	}
+	if strings.Contains(d, "c0ffee") {
+		t.Errorf("Diagnostics leaks I1 contents:\n%s", d)
+	}
+}
+
+func TestGenerateLuaDissector(t *testing.T) {
+	cfg := &AtomicNoizeConfig{I1: "<b c0ffee><g2><r 8><t></g2><s hi>"}
+	lua, err := GenerateLuaDissector("knock", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`Proto("knock"`,
+		`ProtoField.bytes("knock.f1", "IKEv2 framing")`,
+		`check(item, r, "c0ffee")`,
+		`ProtoField.uint16("knock.f3", "group length")`,
+		`local r = buf(off, 8)`,
+		`ProtoField.uint32("knock.f5", "timestamp")`,
+		`check(item, r, "6869")`,
+		`add_for_decode_as(proto)`,
+	} {
+		if !strings.Contains(lua, want) {
+			t.Errorf("dissector missing %q:\n%s", want, lua)
+		}
+	}
+
+	if _, err := GenerateLuaDissector("Bad Name", cfg); err == nil {
+		t.Error("invalid protocol name accepted")
+	}
+	if _, err := GenerateLuaDissector("knock", &AtomicNoizeConfig{}); err == nil {
+		t.Error("config without I1 accepted")
+	}
+}
+
+func TestExactBatches(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	fake.Batch, fake.ExactBatch = 4, true
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", Jc: 2, Jmin: 10, Jmax: 20, JcBeforeHS: 2}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithExactBatches(), WithInterleaveJunk(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := make([][]byte, 6)
+	for i := range bufs {
+		bufs[i] = handshakeInitPacket()
+		bufs[i][4] = byte(i)
+	}
+	if err := b.Send(bufs, ep); err != nil {
+		t.Fatalf("Send with an exact-batch inner Bind: %v", err)
+	}
+
+	var empty, inits int
+	for _, s := range fake.Sends() {
+		switch {
+		case len(s.Packet) == 0:
+			empty++
+		case bytes.Equal(s.Packet[:4], bufs[0][:4]) && len(s.Packet) == len(bufs[0]):
+			inits++
+		}
+	}
+	if inits != len(bufs) {
+		t.Errorf("%d initiations reached the inner Bind, want %d", inits, len(bufs))
+	}
+	if total := len(fake.Sends()); total%fake.Batch != 0 || empty == 0 {
+		t.Errorf("%d packets with %d padding, want whole batches of %d", total, empty, fake.Batch)
+	}
+}
+
+func TestHTTPUserAgent(t *testing.T) {
+	uas := make(chan []string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uas <- r.Header.Values("User-Agent")
+		http.Error(w, "no", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		opts []Option
+		want []string
+	}{
+		{nil, nil},
+		{[]Option{WithHTTPUserAgent(UserAgentCurl)}, []string{UserAgentCurl}},
+	} {
+		opts := append([]Option{WithDOHResolver(srv.URL), WithDOHHost("example.com")}, tt.opts...)
+		b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{I1: "<b 01>"}, 443, time.Hour, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep := &testutil.FakeEndpoint{Dst: netip.MustParseAddrPort("192.0.2.1:2408")}
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-uas; !slices.Equal(got, tt.want) {
+			t.Errorf("User-Agent = %q, want %q", got, tt.want)
+		}
+		for len(uas) > 0 {
+			<-uas // the AAAA query
+		}
+	}
+}
+
+func TestH2Bind(t *testing.T) {
+	// The server echoes every length-prefixed datagram back down the stream
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 only", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		var hdr [2]byte
+		for {
+			if _, err := io.ReadFull(r.Body, hdr[:]); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+			if _, err := io.ReadFull(r.Body, data); err != nil {
+				return
+			}
+			w.Write(append(hdr[:], data...))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	if _, err := H2Bind("ftp://example.com", nil); err == nil {
+		t.Error("H2Bind accepted an ftp:// URL")
+	}
+	inner, err := H2Bind(srv.URL, srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewWithAtomicNoize(inner, &AtomicNoizeConfig{}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ep, err := b.ParseEndpoint(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{[]byte("first"), []byte("second")}
+	if err := b.Send(want, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]byte
+	bufs := [][]byte{make([]byte, 1500), make([]byte, 1500)}
+	sizes := make([]int, len(bufs))
+	eps := make([]conn.Endpoint, len(bufs))
+	for len(got) < len(want) {
+		n, err := fns[0](bufs, sizes, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range n {
+			got = append(got, slices.Clone(bufs[i][:sizes[i]]))
+		}
+	}
+	if !slices.EqualFunc(got, want, bytes.Equal) {
+		t.Errorf("echoed %q, want %q", got, want)
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	sentinels := []error{ErrInvalidCPSTag, ErrHexDecodeFailure, ErrRateLimited, ErrDialFailed, ErrPacketTooBig, ErrConfigInvalid}
+
+	dialFailure := errors.New("no route")
+	failing, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{I1: "<b 0x01>"}, 443, time.Hour,
+		WithEndpointDialer(func(string) (net.Conn, error) { return nil, dialFailure }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dialErr := failing.TestConnectivity(context.Background(), netip.MustParseAddrPort("192.0.2.1:443"))
+
+	_, tagErr := parseCPSPacket("<r abc>")
+	_, hexErr := New(testutil.NewFakeBind(), "0xzz", 443, time.Hour)
+	_, sizeErr := BuildEDNS0PaddedQuery("example.com", 1, 70000)
+	badI1 := (&Bind{}).ApplyConfig(&AtomicNoizeConfig{I1: "<g2><b 0x01>"})
+	_, unknownKey := ParseAmneziaConfigSection(strings.NewReader("[amnezia]\nbogus = 1\n"))
+	_, badValue := ParseAmneziaConfigSection(strings.NewReader("[amnezia]\njc = many\n"))
+	_, unknownVar := InterpolateVars(&AtomicNoizeConfig{I1: "<b ${ID}>"}, nil)
+	_, badPrefix := NewPolicyBind(testutil.NewFakeBind(), []RegionPolicy{{}}, nil, 443, time.Hour)
+	_, badPolicy := NewPolicyBind(testutil.NewFakeBind(), []RegionPolicy{
+		{CIDR: netip.MustParsePrefix("192.0.2.0/24"), Config: &AtomicNoizeConfig{Jc: -1}},
+	}, nil, 443, time.Hour)
+	_, badFallback := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour,
+		WithConfigFallbackList([]*AtomicNoizeConfig{{I1: "<b 0x01>"}, {Jmin: 20, Jmax: 10}}))
+	_, tooShort := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{I1: "<b 0x01>"}, 443, time.Hour, WithMinPacketSize(8))
+	badEscape := (&Bind{}).ApplyConfig(&AtomicNoizeConfig{I1: `<s a\q>`})
+	_, longSNI := BuildTLSClientHelloPayload(strings.Repeat("a", 254), nil, nil)
+	_, badProfile := BuildPayloadFromProfile("bogus", ProfileOptions{})
+	_, badDissector := GenerateLuaDissector("Bad Name", &AtomicNoizeConfig{I1: "<b 0x01>"})
+	badFormat := WriteConfig(io.Discard, &AtomicNoizeConfig{Jc: 1}, "yaml")
+	_, emptyChain := Chain()
+	noI1, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, noI1Err := noI1.TestConnectivity(context.Background(), netip.MustParseAddrPort("192.0.2.1:443"))
+	_, badInterval := noI1.StartBackgroundJunk(context.Background(), netip.MustParseAddrPort("192.0.2.1:443"), 0)
+
+	// A proxy that refuses CONNECT fails the preflight send
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer refusing.Close()
+	var proxyErr error
+	proxied, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{I1: "<b 0x01>"}, 443, time.Hour,
+		WithHTTPConnectProxy(refusing.URL), WithConfigDefaults(false),
+		WithErrorHandler(func(err error, _ string) {
+			if proxyErr == nil {
+				proxyErr = err
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxied.Send([][]byte{handshakeInitPacket()}, &testutil.FakeEndpoint{Dst: netip.MustParseAddrPort("192.0.2.1:2408")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		want []error
+	}{
+		{"bad tag", tagErr, []error{ErrInvalidCPSTag}},
+		{"bad hex", hexErr, []error{ErrHexDecodeFailure}},
+		{"dial", dialErr, []error{ErrDialFailed}},
+		{"too big", sizeErr, []error{ErrPacketTooBig}},
+		{"validate", (&AtomicNoizeConfig{Jc: -1}).Validate(), []error{ErrConfigInvalid}},
+		{"bad I1", badI1, []error{ErrConfigInvalid, ErrInvalidCPSTag}},
+		{"unknown key", unknownKey, []error{ErrConfigInvalid}},
+		{"bad value", badValue, []error{ErrConfigInvalid}},
+		{"unknown variable", unknownVar, []error{ErrConfigInvalid}},
+		{"policy prefix", badPrefix, []error{ErrConfigInvalid}},
+		{"policy config", badPolicy, []error{ErrConfigInvalid}},
+		{"fallback config", badFallback, []error{ErrConfigInvalid}},
+		{"below minimum size", tooShort, []error{ErrConfigInvalid}},
+		{"bad escape", badEscape, []error{ErrConfigInvalid, ErrInvalidCPSTag}},
+		{"long SNI", longSNI, []error{ErrPacketTooBig}},
+		{"unknown profile", badProfile, []error{ErrConfigInvalid}},
+		{"dissector name", badDissector, []error{ErrConfigInvalid}},
+		{"config format", badFormat, []error{ErrConfigInvalid}},
+		{"empty chain", emptyChain, []error{ErrConfigInvalid}},
+		{"no I1", noI1Err, []error{ErrConfigInvalid}},
+		{"junk interval", badInterval, []error{ErrConfigInvalid}},
+		{"proxy refused", proxyErr, []error{ErrDialFailed}},
+	} {
+		for _, s := range sentinels {
+			if got, want := errors.Is(tt.err, s), slices.Contains(tt.want, s); got != want {
+				t.Errorf("%s: errors.Is(%v, %v) = %v, want %v", tt.name, tt.err, s, got, want)
+			}
+		}
+	}
+
+	// A sentinel already carried by the cause is not repeated
+	if strings.Count(tooShort.Error(), ErrConfigInvalid.Error()) != 1 {
+		t.Errorf("size error %q repeats %q", tooShort, ErrConfigInvalid)
+	}
+	if strings.Count(proxyErr.Error(), ErrDialFailed.Error()) != 1 {
+		t.Errorf("proxy error %q repeats %q", proxyErr, ErrDialFailed)
+	}
+
+	// The cause stays reachable
+	if !errors.Is(dialErr, dialFailure) {
+		t.Errorf("dial error %v does not wrap its cause", dialErr)
+	}
+	var numErr *strconv.NumError
+	if !errors.As(tagErr, &numErr) {
+		t.Errorf("tag error %v does not wrap the *strconv.NumError", tagErr)
+	}
+	if !errors.As(badValue, &numErr) {
+		t.Errorf("config value error %v does not wrap the *strconv.NumError", badValue)
+	}
+
+	// Config file keys and values are reported as *ParseError too
+	for _, tt := range []struct {
+		name   string
+		err    error
+		source string
+	}{
+		{"unknown key", unknownKey, "toml"},
+		{"bad value", badValue, "ini"},
+	} {
+		var perr *ParseError
+		if !errors.As(tt.err, &perr) || perr.Source != tt.source {
+			t.Errorf("%s: %v is not a *ParseError from %s", tt.name, tt.err, tt.source)
+		}
+	}
+	var perr *ParseError
+	if _, err := ParseAndroidAmneziaConfig([]byte(`{"jc":"many"}`)); !errors.As(err, &perr) || !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("Android config with a bad value: got %v, want a *ParseError wrapping ErrConfigInvalid", err)
+	}
+	if _, err := ParseAmneziaConfigList([]byte(`[{"jc":1},{"jmin":"x"}]`)); !errors.As(err, &perr) || !strings.Contains(err.Error(), "config 1") {
+		t.Errorf("config list with a bad value: got %v, want a *ParseError naming config 1", err)
+	}
+
+	// Rate limiting never fails Send; it is reported in the history
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{I1: "<b 0x01>"}, 443, time.Hour, WithHistory(4), WithConfigDefaults(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &testutil.FakeEndpoint{Dst: netip.MustParseAddrPort("192.0.2.1:2408")}
+	for range 2 {
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := b.GetHistory(ep.Dst.Addr())
+	if len(events) != 2 || events[1].Kind != EventRateLimited || !errors.Is(events[1].Err, ErrRateLimited) {
+		t.Errorf("history = %+v, want a rate-limited second event carrying ErrRateLimited", events)
+	}
+}
+
+func TestApplyConfigLogRedactsSignatures(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{Jc: 1}, 443, time.Hour, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &AtomicNoizeConfig{Jc: 2, I1: "<b c0ffee>", Macros: map[string]string{"token": "<s secret>"}}
+	if err := b.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"c0ffee", "secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("config change log leaks %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "field=Jc old=1 new=2") || !strings.Contains(out, "field=I1") {
+		t.Errorf("config change log misses fields:\n%s", out)
+	}
+}
+
+// failingBind is a FakeBind whose sends to one destination fail.
+type failingBind struct {
+	*testutil.FakeBind
+	fail netip.Addr
+}
+
+func (f *failingBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	if ep.DstIP() == f.fail {
+		return errors.New("unreachable")
+	}
+	return f.FakeBind.Send(bufs, ep)
+}
+
+func TestConfigFallbackList(t *testing.T) {
+	configs, err := ParseAmneziaConfigList([]byte(`[{"I1": "<b 01>", "jc": 1}, {"i1": "<b 02>"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[0].I1 != "<b 01>" || configs[0].Jc != 1 || configs[1].I1 != "<b 02>" {
+		t.Fatalf("ParseAmneziaConfigList = %+v", configs)
+	}
+	if _, err := ParseAmneziaConfigList([]byte(`[{"jc": -1}]`)); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("invalid entry: got %v, want ErrConfigInvalid", err)
+	}
+
+	down, up := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	fake := &failingBind{FakeBind: testutil.NewFakeBind(), fail: down}
+	b, err := NewWithAtomicNoize(fake, &AtomicNoizeConfig{I1: "<b ff>"}, 443, time.Hour, WithConfigFallbackList(configs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	i1For := func(dst netip.Addr) string {
+		cfg, _ := b.configFor(dst)
+		return cfg.I1
+	}
+
+	// A failed I1 only moves its own destination along the chain
+	for _, dst := range []netip.Addr{down, up} {
+		b.Send([][]byte{handshakeInitPacket()}, &testutil.FakeEndpoint{Dst: netip.AddrPortFrom(dst, 2408)})
+	}
+	if got := i1For(down); got != "<b 02>" {
+		t.Errorf("failing destination uses %q, want the second entry", got)
+	}
+	if got := i1For(up); got != "<b 01>" {
+		t.Errorf("working destination uses %q, want the first entry", got)
+	}
+
+	// A handshake response resets the destination to the first entry
+	resp := make([]byte, device.MessageResponseSize)
+	resp[0] = byte(device.MessageResponseType)
+	fake.Recv <- testutil.FakeRecv{Packet: resp, Endpoint: &testutil.FakeEndpoint{Dst: netip.AddrPortFrom(down, 2408)}}
+	bufs, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+	if _, err := fns[0](bufs, sizes, eps); err != nil {
+		t.Fatal(err)
+	}
+	if got := i1For(down); got != "<b 01>" {
+		t.Errorf("after a response the destination uses %q, want the first entry", got)
+	}
+
+	// ApplyConfig replaces the chain
+	if err := b.ApplyConfig(&AtomicNoizeConfig{I1: "<b 03>"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := i1For(up); got != "<b 03>" {
+		t.Errorf("after ApplyConfig the destination uses %q, want the applied config", got)
+	}
+}
+
+func TestAdaptiveJunkMeasuresHandshakes(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{Jc: 4, Jmin: 10, Jmax: 20, AdaptiveJunk: true}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ep := &testutil.FakeEndpoint{Dst: netip.MustParseAddrPort("192.0.2.1:2408")}
+
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, device.MessageResponseSize)
+	resp[0] = byte(device.MessageResponseType)
+	fake.Recv <- testutil.FakeRecv{Packet: resp, Endpoint: ep}
+	bufs, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+	if _, err := fns[0](bufs, sizes, eps); err != nil {
+		t.Fatal(err)
+	}
+
+	rtt, ok := b.AverageRTT(ep.Dst.Addr())
+	if !ok || rtt > adaptiveFastRTT {
+		t.Fatalf("AverageRTT = %v, %v; want a fast sample from the handshake", rtt, ok)
+	}
+	if got := b.adaptJunkCount(cfg, ep.Dst.Addr(), 4); got != 8 {
+		t.Errorf("fast path: got %d junk packets, want 8", got)
+	}
+	if got := b.adaptJunkCount(cfg, ep.Dst.Addr(), 200); got != 200 {
+		t.Errorf("count above the cap: got %d, want it left at 200", got)
+	}
+}
+
+func TestJunkCompression(t *testing.T) {
+	entropy := func(p []byte) float64 {
+		var counts [256]int
+		for _, c := range p {
+			counts[c]++
+		}
+		e := 0.0
+		for _, n := range counts {
+			if n > 0 {
+				f := float64(n) / float64(len(p))
+				e -= f * math.Log2(f)
+			}
+		}
+		return e
+	}
+
+	b := &Bind{compressJunk: true}
+	const size, runs = 1000, 40
+	prefixes := make(map[[4]byte]bool)
+	var compressed, random float64
+	for range runs {
+		junk := make([]byte, size)
+		if _, err := crand.Read(junk); err != nil {
+			t.Fatal(err)
+		}
+		random += entropy(junk)
+		out := b.compressJunkPayload(slices.Clone(junk))
+		if len(out) != size {
+			t.Fatalf("compressed junk is %d bytes, want %d", len(out), size)
+		}
+		if bytes.HasPrefix(out, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+			t.Fatal("compressed junk starts with the zstd magic")
+		}
+		prefixes[[4]byte(out)] = true
+		compressed += entropy(out)
+	}
+	if len(prefixes) < runs/2 {
+		t.Errorf("only %d distinct 4-byte prefixes in %d payloads", len(prefixes), runs)
+	}
+	if compressed >= random {
+		t.Errorf("mean entropy %.3f bits/byte is not below random junk's %.3f", compressed/runs, random/runs)
+	}
+}
+
+func TestPacketHMACRoundTrip(t *testing.T) {
+	key := []byte("preflight hmac key")
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{
+		I1: "<b 0102030405060708><r 16><h>",
+		I2: "<b aabb><t><h>",
+	}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPacketHMAC(key, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+	sends := fake.Sends()
+	if len(sends) != 3 {
+		t.Fatalf("got %d packets, want I1, I2 and the initiation", len(sends))
+	}
+
+	// I1 goes out inside IKEv2 framing added after the MAC; I2 is sent bare
+	for i, name := range []string{"I1", "I2"} {
+		packet := sends[i].Packet
+		if !VerifyPacketHMAC(packet, key, "") {
+			t.Errorf("%s %x does not verify", name, packet)
+		}
+		if VerifyPacketHMAC(packet, []byte("other key"), "") {
+			t.Errorf("%s verifies with the wrong key", name)
+		}
+		tampered := bytes.Clone(packet)
+		tampered[len(tampered)-packetMACSize-1] ^= 1
+		if VerifyPacketHMAC(tampered, key, "") {
+			t.Errorf("tampered %s verifies", name)
+		}
+	}
+	if _, ok := ikev2Payload(sends[0].Packet); !ok {
+		t.Errorf("I1 %x is not IKEv2-framed", sends[0].Packet)
+	}
+}
+
+func TestDedupeWindow(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Millisecond, WithDedupeWindow(time.Hour), WithConfigDefaults(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	epA, _ := b.ParseEndpoint("192.0.2.1:2408")
+	epB, _ := b.ParseEndpoint("192.0.2.2:2408")
+	initWithSender := func(sender uint32) []byte {
+		buf := handshakeInitPacket()
+		binary.LittleEndian.PutUint32(buf[initSenderOffset:], sender)
+		return buf
+	}
+
+	for _, tt := range []struct {
+		name    string
+		ep      conn.Endpoint
+		sender  uint32
+		packets int
+	}{
+		{"first initiation", epA, 1, 2},
+		{"same message resent", epA, 1, 1},
+		{"same sender to another destination", epB, 1, 2},
+		{"new initiation", epA, 2, 2},
+	} {
+		// Step past the rate-limit interval so only the dedupe check applies
+		time.Sleep(5 * time.Millisecond)
+		fake.Reset()
+		if err := b.Send([][]byte{initWithSender(tt.sender)}, tt.ep); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(fake.Sends()); got != tt.packets {
+			t.Errorf("%s: got %d packets, want %d", tt.name, got, tt.packets)
+		}
+	}
+}
+
+func TestPruneRateLimiterKeepsInterval(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, 50*time.Millisecond, WithIntervalOverrides(map[netip.Prefix]time.Duration{
+		netip.MustParsePrefix("192.0.2.0/24"): time.Hour,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"192.0.2.1:2408", "198.51.100.1:2408"} {
+		ep, err := b.ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither destination's interval has passed yet
+	if n := b.PruneRateLimiter(0); n != 0 {
+		t.Fatalf("pruned %d fresh entries, want 0", n)
+	}
+	seedDstState(b, netip.MustParseAddr("198.51.100.1"))
+
+	// The Bind's 50ms interval has passed, the 1h override has not
+	time.Sleep(60 * time.Millisecond)
+	if n := b.PruneRateLimiter(0); n != 1 {
+		t.Fatalf("pruned %d entries, want 1", n)
+	}
+	if held := heldState(b, netip.MustParseAddr("192.0.2.1")); !slices.Contains(held, "lastSent") {
+		t.Errorf("override entry not kept, state left: %v", held)
+	}
+	if held := heldState(b, netip.MustParseAddr("198.51.100.1")); len(held) != 0 {
+		t.Errorf("pruning left state for the plain entry: %v", held)
+	}
+}
+
+// seedDstState gives dst an entry in every per-destination map.
+func seedDstState(b *Bind, dst netip.Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	seed := func(m any) {
+		v := reflect.ValueOf(m).Elem()
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(reflect.ValueOf(dst), reflect.Zero(v.Type().Elem()))
+	}
+	seed(&b.postHandshakeSent)
+	seed(&b.cookied)
+	seed(&b.history)
+	seed(&b.rtt)
+	seed(&b.junkSeq)
+	seed(&b.initTimes)
+	seed(&b.fallbackIdx)
+	seed(&b.initSent)
+	seed(&b.seenInits)
+	b.lastSent[dst] = now
+	b.sessions.record(sessionKey{dst: dst, sender: 1}, now)
+}
+
+// heldState names the per-destination maps that hold an entry for dst.
+func heldState(b *Bind, dst netip.Addr) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var held []string
+	for name, m := range map[string]any{
+		"lastSent": b.lastSent, "history": b.history, "rtt": b.rtt,
+		"postHandshakeSent": b.postHandshakeSent, "cookied": b.cookied,
+		"junkSeq": b.junkSeq, "initTimes": b.initTimes, "fallbackIdx": b.fallbackIdx,
+		"initSent": b.initSent, "seenInits": b.seenInits,
+	} {
+		if reflect.ValueOf(m).MapIndex(reflect.ValueOf(dst)).IsValid() {
+			held = append(held, name)
+		}
+	}
+	for key := range b.sessions.entries {
+		if key.dst == dst {
+			held = append(held, "sessions")
+			break
+		}
+	}
+	slices.Sort(held)
+	return held
+}
+
+// TestStateOverlappingSequences checks that the state reflects every running
+// sequence, not whichever one started or finished last.
+func TestStateOverlappingSequences(t *testing.T) {
+	ch := make(chan PreflightState, 16)
+	b, err := New(testutil.NewFakeBind(), "", 443, time.Hour, WithStateChannel(ch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		enter bool
+		s     PreflightState
+		want  PreflightState
+	}{
+		{true, StatePreHandshake, StatePreHandshake},
+		{true, StatePreHandshake, StatePreHandshake},
+		{true, StatePostHandshake, StatePreHandshake},
+		{false, StatePreHandshake, StatePreHandshake}, // one preflight still running
+		{false, StatePreHandshake, StatePostHandshake},
+		{false, StatePostHandshake, StateIdle},
+	}
+	for i, step := range steps {
+		if step.enter {
+			b.enterState(step.s)
+		} else {
+			b.leaveState(step.s)
+		}
+		if got := b.State(); got != step.want {
+			t.Fatalf("step %d: state %s, want %s", i, got, step.want)
+		}
+	}
+	var got []PreflightState
+	for len(ch) > 0 {
+		got = append(got, <-ch)
+	}
+	if want := []PreflightState{StatePreHandshake, StatePostHandshake, StateIdle}; !slices.Equal(got, want) {
+		t.Errorf("transitions %v, want %v", got, want)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := StatePreHandshake + PreflightState(i%2)
+			b.enterState(s)
+			b.leaveState(s)
+		}()
+	}
+	wg.Wait()
+	if got := b.State(); got != StateIdle {
+		t.Errorf("state %s after all sequences finished, want idle", got)
+	}
+}
+
+func TestQUICBind(t *testing.T) {
+	// Borrow httptest's loopback certificate for the QUIC server
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSrv.Close()
+	serverTLS := certSrv.TLS.Clone()
+	serverTLS.NextProtos = []string{"wg"}
+	clientTLS := certSrv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	clientTLS.NextProtos = []string{"wg"}
+
+	ln, err := quic.ListenAddr("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The server echoes the packets of every stream back on a stream of its
+	// own, and hands each connection to the test so it can drop it
+	conns := make(chan *quic.Conn, 4)
+	go func() {
+		for {
+			c, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns <- c
+			go func() {
+				for {
+					s, err := c.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					data, err := io.ReadAll(s)
+					if err != nil {
+						return
+					}
+					out, err := c.OpenStream()
+					if err != nil {
+						return
+					}
+					out.Write(data)
+					out.Close()
+				}
+			}()
+		}
+	}()
+
+	if _, err := QUICBind("no-port", clientTLS); err == nil {
+		t.Error("QUICBind accepted an address without a port")
+	}
+	inner, err := QUICBind(ln.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewWithAtomicNoize(inner, &AtomicNoizeConfig{}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ep, err := b.ParseEndpoint(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := [][]byte{make([]byte, 1500), make([]byte, 1500)}
+	sizes := make([]int, len(bufs))
+	eps := make([]conn.Endpoint, len(bufs))
+	echo := func(want [][]byte) {
+		t.Helper()
+		if err := b.Send(want, ep); err != nil {
+			t.Fatal(err)
+		}
+		var got [][]byte
+		for len(got) < len(want) {
+			n, err := fns[0](bufs, sizes, eps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range n {
+				got = append(got, slices.Clone(bufs[i][:sizes[i]]))
+			}
+		}
+		if !slices.EqualFunc(got, want, bytes.Equal) {
+			t.Errorf("echoed %q, want %q", got, want)
+		}
+	}
+	echo([][]byte{[]byte("first"), []byte("second")})
+
+	// Once the server drops the connection, Send dials a new one
+	first := <-conns
+	first.CloseWithError(0, "")
+	q := inner.(*quicBind)
+	q.mu.Lock()
+	lost := q.conn.Context()
+	q.mu.Unlock()
+	<-lost.Done()
+	echo([][]byte{[]byte("after redial")})
+	select {
+	case <-conns:
+	default:
+		t.Error("Send did not redial")
+	}
+}
+
+func TestWSBind(t *testing.T) {
+	// The server echoes binary messages and hands each connection to the
+	// test so it can drop it
+	conns := make(chan *websocket.Conn, 4)
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "missing token", http.StatusForbidden)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- ws
+		for {
+			typ, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(typ, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	if _, err := WSBind(srv.URL, nil, nil); err == nil {
+		t.Error("WSBind accepted an http:// URL")
+	}
+	inner, err := WSBind(wsURL, nil, http.Header{"X-Token": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewWithAtomicNoize(inner, &AtomicNoizeConfig{}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, tt := range []struct {
+		s     string
+		ok    bool
+		dstIP string
+	}{
+		{wsURL, true, "127.0.0.1"},
+		{"wss://example.com/wg", true, "invalid IP"},
+		{"192.0.2.1:2408", true, "192.0.2.1"},
+		{"https://example.com", false, ""},
+		{"example.com", false, ""},
+	} {
+		ep, err := b.ParseEndpoint(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseEndpoint(%q) error %v, want ok %v", tt.s, err, tt.ok)
+			continue
+		}
+		if err == nil && ep.DstIP().String() != tt.dstIP {
+			t.Errorf("ParseEndpoint(%q).DstIP() = %s, want %s", tt.s, ep.DstIP(), tt.dstIP)
+		}
+	}
+
+	ep, err := b.ParseEndpoint(wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufs := [][]byte{make([]byte, 1500), make([]byte, 1500)}
+	sizes := make([]int, len(bufs))
+	eps := make([]conn.Endpoint, len(bufs))
+	echo := func(want [][]byte) {
+		t.Helper()
+		if err := b.Send(want, ep); err != nil {
+			t.Fatal(err)
+		}
+		var got [][]byte
+		for len(got) < len(want) {
+			n, err := fns[0](bufs, sizes, eps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range n {
+				got = append(got, slices.Clone(bufs[i][:sizes[i]]))
+				if eps[i].DstToString() != wsURL {
+					t.Errorf("received from %s, want %s", eps[i].DstToString(), wsURL)
+				}
+			}
+		}
+		if !slices.EqualFunc(got, want, bytes.Equal) {
+			t.Errorf("echoed %q, want %q", got, want)
+		}
+	}
+	echo([][]byte{[]byte("first"), []byte("second")})
+
+	// Once the server drops the connection, Send dials a new one
+	(<-conns).Close()
+	w := inner.(*wsBind)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		lost := w.ws == nil
+		w.mu.Unlock()
+		if lost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dropped connection was not noticed")
+		}
+	}
+	echo([][]byte{[]byte("after redial")})
+	select {
+	case <-conns:
+	default:
+		t.Error("Send did not redial")
+	}
+}
+
+func TestPortKnockSequence(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	const delay = 5 * time.Millisecond
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour,
+		WithPortKnockSequence([]int{1000, 0, 2000, 70000, 3000}, delay),
+		WithPortKnockPayload([]byte("knock")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	init := handshakeInitPacket()
+	if err := b.Send([][]byte{init}, ep); err != nil {
+		t.Fatal(err)
+	}
+	// Two pauses between the three knocks, and one before I1
+	if elapsed := time.Since(start); elapsed < 3*delay {
+		t.Errorf("knock sequence took %v, want at least %v", elapsed, 3*delay)
+	}
+
+	sends := fake.Sends()
+	want := []string{"192.0.2.1:1000", "192.0.2.1:2000", "192.0.2.1:3000", "192.0.2.1:2408", "192.0.2.1:2408"}
+	if len(sends) != len(want) {
+		t.Fatalf("got %d packets, want 3 knocks, I1 and the initiation", len(sends))
+	}
+	for i, s := range sends {
+		if got := s.Endpoint.DstToString(); got != want[i] {
+			t.Errorf("packet %d sent to %s, want %s", i, got, want[i])
+		}
+	}
+	for _, s := range sends[:3] {
+		if string(s.Packet) != "knock" {
+			t.Errorf("knock payload %q, want %q", s.Packet, "knock")
+		}
+	}
+	if !bytes.HasSuffix(sends[3].Packet, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("packet after the knocks %x is not I1", sends[3].Packet)
+	}
+	if !bytes.Equal(sends[4].Packet, init) {
+		t.Error("last packet is not the handshake initiation")
+	}
+}
+
+func TestInterpolateVars(t *testing.T) {
+	env := map[string]string{"ID": "c0ffee", "HOST": "example.com"}
+	cfg := &AtomicNoizeConfig{
+		I1: "<b ${ID}><r 8>",
+		I2: "<s ${HOST}>${HOST}",
+		I3: "<b 00>",
+		I5: "$ID ${ ID } {ID}",
+		Jc: 3,
+	}
+	out, err := InterpolateVars(cfg, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ got, want string }{
+		{out.I1, "<b c0ffee><r 8>"},
+		{out.I2, "<s example.com>example.com"},
+		{out.I3, "<b 00>"},
+		{out.I4, ""},
+		{out.I5, "$ID ${ ID } {ID}"}, // not placeholders
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+	if out.Jc != 3 {
+		t.Errorf("Jc = %d, not carried over", out.Jc)
+	}
+	if cfg.I1 != "<b ${ID}><r 8>" {
+		t.Errorf("input config modified: I1 = %q", cfg.I1)
+	}
+
+	_, err = InterpolateVars(&AtomicNoizeConfig{I1: "<b ${ID}>", I3: "<b ${MISSING}>"}, env)
+	if err == nil || !strings.Contains(err.Error(), "I3") || !strings.Contains(err.Error(), `"MISSING"`) {
+		t.Errorf("got error %v, want one naming I3 and MISSING", err)
+	}
+	if out, err := InterpolateVars(nil, env); out != nil || err != nil {
+		t.Errorf("InterpolateVars(nil) = %v, %v; want nil, nil", out, err)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{
+		I1:         "<b 0102030405060708>",
+		Jmin:       10,
+		Jmax:       10,
+		JcAfterI1:  2,
+		JcBeforeHS: 1,
+	}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithSequenceNumbers(true), WithConfigDefaults(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	epA, _ := b.ParseEndpoint("192.0.2.1:2408")
+	epB, _ := b.ParseEndpoint("192.0.2.2:2408")
+	junkSeqs := func(ep conn.Endpoint) []uint32 {
+		t.Helper()
+		fake.Reset()
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		sends := fake.Sends()
+		if len(sends) != 5 {
+			t.Fatalf("got %d packets, want I1, 3 junk packets and the initiation", len(sends))
+		}
+		var seqs []uint32
+		for _, s := range sends[1:4] {
+			seq, payload, ok := ParseSequenceNumber(s.Packet)
+			if !ok || len(payload) != cfg.Jmin {
+				t.Fatalf("junk packet %x does not carry a sequence number and %d bytes", s.Packet, cfg.Jmin)
+			}
+			seqs = append(seqs, seq)
+		}
+		return seqs
+	}
+
+	want := []uint32{0, 1, 2}
+	if got := junkSeqs(epA); !slices.Equal(got, want) {
+		t.Errorf("first preflight numbered %v, want %v", got, want)
+	}
+	// Numbers count per destination
+	if got := junkSeqs(epB); !slices.Equal(got, want) {
+		t.Errorf("other destination numbered %v, want %v", got, want)
+	}
+	// Resetting the rate limiter lets epA preflight again from zero
+	b.ResetRateLimiter()
+	if got := junkSeqs(epA); !slices.Equal(got, want) {
+		t.Errorf("preflight after reset numbered %v, want %v", got, want)
+	}
+
+	if _, _, ok := ParseSequenceNumber([]byte{1, 2, 3}); ok {
+		t.Error("ParseSequenceNumber accepted a 3-byte packet")
+	}
+}
+
+func TestBuildPayloadFromProfile(t *testing.T) {
+	t.Run("tls13-chrome", func(t *testing.T) {
+		p, err := BuildPayloadFromProfile(FingerprintTLS13Chrome, ProfileOptions{SNI: "example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Record header, ClientHello header, legacy_version, random, then
+		// the session ID and Chrome's cipher suites
+		if p[0] != 0x16 || int(binary.BigEndian.Uint16(p[3:])) != len(p)-5 || p[5] != 0x01 {
+			t.Fatalf("not a TLS handshake record holding a ClientHello: %x", p[:10])
+		}
+		sid := 5 + 4 + 2 + 32
+		if p[sid] != 32 {
+			t.Fatalf("session ID of %d bytes, want 32", p[sid])
+		}
+		suites := p[sid+1+32:]
+		if n := int(binary.BigEndian.Uint16(suites)); n != 2*len(chromeCipherSuites) {
+			t.Fatalf("%d bytes of cipher suites, want %d", n, 2*len(chromeCipherSuites))
+		}
+		for i, cs := range chromeCipherSuites {
+			if got := binary.BigEndian.Uint16(suites[2+2*i:]); got != cs {
+				t.Errorf("cipher suite %d is %#04x, want %#04x", i, got, cs)
+			}
+		}
+		if !bytes.Contains(p, []byte("example.com")) {
+			t.Error("SNI missing from ClientHello")
+		}
+
+		again, err := BuildPayloadFromProfile(FingerprintTLS13Chrome, ProfileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(again, []byte("example.com")) || len(again) >= len(p) {
+			t.Error("ClientHello without SNI still carries a server name")
+		}
+		if bytes.Equal(p[11:43], again[11:43]) {
+			t.Error("two ClientHellos share a client random")
+		}
+	})
+
+	t.Run("quic-initial", func(t *testing.T) {
+		for _, tt := range []struct{ size, want int }{
+			{0, quicMinInitialSize},
+			{100, quicMinInitialSize},
+			{1350, 1350},
+		} {
+			p, err := BuildPayloadFromProfile(FingerprintQUICInitial, ProfileOptions{Size: tt.size})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p) != tt.want {
+				t.Errorf("Size %d: got %d bytes, want %d", tt.size, len(p), tt.want)
+			}
+			if p[0] != 0xc3 || binary.BigEndian.Uint32(p[1:]) != 1 || p[5] != 8 || p[14] != 8 || p[23] != 0 {
+				t.Errorf("Size %d: not a QUIC v1 Initial header: %x", tt.size, p[:26])
+			}
+			if n := int(binary.BigEndian.Uint16(p[24:]) &^ 0x4000); n != len(p)-26 {
+				t.Errorf("Size %d: length field %d, want %d", tt.size, n, len(p)-26)
+			}
+		}
+		if _, err := BuildPayloadFromProfile(FingerprintQUICInitial, ProfileOptions{Size: 0x4000}); !errors.Is(err, ErrPacketTooBig) {
+			t.Errorf("oversized Initial: got %v, want ErrPacketTooBig", err)
+		}
+	})
+
+	t.Run("wireguard-native", func(t *testing.T) {
+		if p, err := BuildPayloadFromProfile(FingerprintWireGuardNative, ProfileOptions{}); p != nil || err != nil {
+			t.Errorf("got %x, %v; want no payload", p, err)
+		}
+	})
+
+	if _, err := BuildPayloadFromProfile("netscape", ProfileOptions{}); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+func TestReplacePeer(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", Jmin: 10, Jmax: 10, JcAfterI1: 2}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithSequenceNumbers(true), WithHistory(8), WithConfigDefaults(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldAddr, newAddr := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("198.51.100.1")
+	oldEp, _ := b.ParseEndpoint("192.0.2.1:2408")
+	newEp, _ := b.ParseEndpoint("198.51.100.1:2408")
+	send := func(ep conn.Endpoint) int {
+		t.Helper()
+		fake.Reset()
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		return len(fake.Sends())
+	}
+
+	if n := send(oldEp); n != 4 {
+		t.Fatalf("got %d packets, want I1, 2 junk packets and the initiation", n)
+	}
+	b.ReplacePeer(oldAddr, oldAddr) // no-op
+
+	// Stale state for the new address is replaced, not merged, and junk
+	// loops to the old address stop
+	seedDstState(b, newAddr)
+	moved := heldState(b, oldAddr)
+	if _, err := b.StartBackgroundJunk(context.Background(), netip.AddrPortFrom(oldAddr, 2408), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	b.ReplacePeer(oldAddr, newAddr)
+	if held := heldState(b, newAddr); !slices.Equal(held, moved) {
+		t.Errorf("new address holds %v, want only the moved %v", held, moved)
+	}
+	if held := heldState(b, oldAddr); len(held) != 0 {
+		t.Errorf("old address kept %v", held)
+	}
+	b.mu.Lock()
+	loops := len(b.bgJunk)
+	b.mu.Unlock()
+	if loops != 0 {
+		t.Errorf("%d background junk loops still registered for the old address", loops)
+	}
+
+	// The roamed peer is still inside its interval; its old address is not
+	if n := send(newEp); n != 1 {
+		t.Errorf("got %d packets to the new address, want only the rate-limited initiation", n)
+	}
+	if h := b.GetHistory(newAddr); len(h) != 2 || h[0].Kind != EventPreflightSent || h[1].Kind != EventRateLimited {
+		t.Errorf("history of the new address %v, want the moved preflight then a rate-limited one", h)
+	}
+	b.mu.Lock()
+	seq := b.junkSeq[newAddr]
+	b.mu.Unlock()
+	if seq != 2 {
+		t.Errorf("junk sequence of the new address is %d, want 2 carried over", seq)
+	}
+	if h := b.GetHistory(oldAddr); len(h) != 0 {
+		t.Errorf("old address kept %d history events", len(h))
+	}
+	if n := send(oldEp); n != 4 {
+		t.Errorf("got %d packets to the old address, want a fresh preflight", n)
+	}
+}
+
+// firesPreflight reports whether sending pkt through b triggers a preflight,
+// starting from a clean rate limiter.
+func firesPreflight(t *testing.T, b *Bind, fake *testutil.FakeBind, pkt []byte) bool {
+	t.Helper()
+	b.ResetRateLimiter()
+	fake.Reset()
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{pkt}, ep); err != nil {
+		t.Fatal(err)
+	}
+	return len(fake.Sends()) > 1
+}
+
+func TestHandshakeInitSize(t *testing.T) {
+	initOfSize := func(n int) []byte {
+		buf := make([]byte, n)
+		buf[0] = byte(device.MessageInitiationType)
+		return buf
+	}
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+
+	fake := testutil.NewFakeBind()
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithHandshakeInitSize(100, 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		size int
+		want bool
+	}{
+		{99, false},
+		{100, true},
+		{120, true},
+		{121, false},
+		{device.MessageInitiationSize, false},
+	} {
+		if got := firesPreflight(t, b, fake, initOfSize(tt.size)); got != tt.want {
+			t.Errorf("%d-byte initiation fired a preflight: %v, want %v", tt.size, got, tt.want)
+		}
+	}
+	wrongType := initOfSize(110)
+	wrongType[0] = byte(device.MessageTransportType)
+	if firesPreflight(t, b, fake, wrongType) {
+		t.Error("transport packet in the size range fired a preflight")
+	}
+
+	// A zero max leaves the size unbounded
+	b, err = NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithHandshakeInitSize(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firesPreflight(t, b, fake, initOfSize(1)) || !firesPreflight(t, b, fake, initOfSize(1400)) {
+		t.Error("unbounded size range rejected an initiation")
+	}
+
+	// The option leaves a custom classifier alone
+	custom := struct{ PacketClassifier }{DefaultPacketClassifier()}
+	b, err = NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPacketClassifier(custom), WithHandshakeInitSize(100, 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firesPreflight(t, b, fake, initOfSize(110)) {
+		t.Error("WithHandshakeInitSize changed a classifier set with WithPacketClassifier")
+	}
+}
+
+func TestChain(t *testing.T) {
+	if _, err := Chain(); err == nil {
+		t.Error("empty chain accepted")
+	}
+	if _, err := Chain(testutil.NewFakeBind(), testutil.NewFakeBind()); err == nil {
+		t.Error("chain accepted a non-Layer in front of another Bind")
+	}
+
+	// Both layers are built on a placeholder that Chain replaces
+	placeholder := testutil.NewFakeBind()
+	b, err := NewWithAtomicNoize(placeholder, &AtomicNoizeConfig{I1: "<b 0102030405060708>"}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewXORBind(placeholder, []byte("key"))
+	fake := testutil.NewFakeBind()
+	chain, err := Chain(b, x, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain != b {
+		t.Fatal("chain does not start at the first layer")
+	}
+	fns, _, err := chain.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	ep, err := chain.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handshakes pass the XOR layer untouched, so the preflight layer's I1
+	// reaches the transport ahead of the initiation
+	init := handshakeInitPacket()
+	if err := chain.Send([][]byte{init}, ep); err != nil {
+		t.Fatal(err)
+	}
+	sends := fake.Sends()
+	if len(sends) != 2 || !bytes.HasSuffix(sends[0].Packet, []byte{1, 2, 3, 4, 5, 6, 7, 8}) || !bytes.Equal(sends[1].Packet, init) {
+		t.Fatalf("transport got %d packets, want I1 and the initiation", len(sends))
+	}
+	if len(placeholder.Sends()) != 0 {
+		t.Error("placeholder inner Bind was used")
+	}
+
+	// Transport messages are masked on the way down and unmasked on the way up
+	transport := make([]byte, device.MessageTransportHeaderSize+16)
+	transport[0] = byte(device.MessageTransportType)
+	copy(transport[device.MessageTransportHeaderSize:], "wireguard data..")
+	fake.Reset()
+	if err := chain.Send([][]byte{transport}, ep); err != nil {
+		t.Fatal(err)
+	}
+	masked := fake.Sends()[0].Packet
+	if bytes.Equal(masked, transport) {
+		t.Fatal("transport message reached the transport unmasked")
+	}
+	fake.Recv <- testutil.FakeRecv{Packet: masked, Endpoint: ep}
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fns[0](bufs, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(bufs[0][:sizes[0]], transport) {
+		t.Errorf("received %x, want the unmasked %x", bufs[0][:sizes[0]], transport)
+	}
+}
+
+func TestRecvObserver(t *testing.T) {
+	type observed struct {
+		src netip.AddrPort
+		buf []byte
+	}
+	seen := make(chan observed, 4)
+	release := make(chan struct{})
+	observer := func(src netip.AddrPort, buf []byte) {
+		if string(buf) == "slow" {
+			<-release
+		}
+		seen <- observed{src, buf}
+	}
+	var logs bytes.Buffer
+	fake := testutil.NewFakeBind()
+	b, err := New(fake, "", 443, time.Hour, WithRecvObserver(observer),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	recv := func(packet string) {
+		t.Helper()
+		fake.Recv <- testutil.FakeRecv{Packet: []byte(packet), Endpoint: ep}
+		if n, err := fns[0](bufs, sizes, eps); err != nil || n != 1 {
+			t.Fatalf("receive returned %d, %v", n, err)
+		}
+	}
+
+	recv("hello")
+	got := <-seen
+	if got.src != netip.MustParseAddrPort("192.0.2.1:2408") || string(got.buf) != "hello" {
+		t.Errorf("observer saw %q from %s, want %q from 192.0.2.1:2408", got.buf, got.src, "hello")
+	}
+	// The observer holds a copy, not the receive buffer
+	bufs[0][0] = 'j'
+	if string(got.buf) != "hello" {
+		t.Errorf("observer's copy changed to %q with the receive buffer", got.buf)
+	}
+
+	// A blocked observer never delays receives; once its queue is full
+	// further batches are dropped and counted
+	start := time.Now()
+	recv("slow")
+	for range recvObserverQueue + 5 {
+		recv("x")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("receive waited %v for a blocked observer", elapsed)
+	}
+	if string(bufs[0][:sizes[0]]) != "x" {
+		t.Errorf("delivered %q, want %q", bufs[0][:sizes[0]], "x")
+	}
+	// "slow" may or may not have left the queue before the observer blocked
+	if dropped := b.Stats().RecvObserverDropped; dropped != 5 && dropped != 6 {
+		t.Errorf("dropped %d packets, want 5 or 6", dropped)
+	}
+	if !strings.Contains(logs.String(), "receive observer is falling behind") {
+		t.Errorf("no warning about the lagging observer in %q", logs.String())
+	}
+	close(release)
+	deadline := time.After(5 * time.Second)
+	for got := ""; got != "slow"; {
+		select {
+		case o := <-seen:
+			got = string(o.buf)
+		case <-deadline:
+			t.Fatal("observer never finished after unblocking")
+		}
+	}
+
+	// Close stops the observer goroutine
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	running := b.recvObserved != nil || b.recvObserverStop != nil
+	b.mu.Unlock()
+	if running {
+		t.Error("observer still running after Close")
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := &AtomicNoizeConfig{I1: "<b 0x01>"}
+	b, err := NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Config(); got.Jc != 4 || got.Jmin != 40 || got.Jmax != 70 || got.JunkInterval != 5*time.Millisecond {
+		t.Errorf("constructor left junk settings %+v, want SetDefaults values", got)
+	}
+	if cfg.Jc != 0 {
+		t.Error("constructor modified the caller's config")
+	}
+
+	// A zero Jc keeps meaning no junk with the defaults turned off
+	b, err = NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Hour, WithConfigDefaults(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Config(); got.Jc != 0 || got.Jmin != 0 {
+		t.Errorf("WithConfigDefaults(false) filled in %+v", got)
+	}
+	if err := b.ApplyConfig(&AtomicNoizeConfig{Jc: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Config(); got.Jmin != 0 {
+		t.Errorf("ApplyConfig filled in Jmin %d with defaults off", got.Jmin)
+	}
+
+	if _, err := NewWithAtomicNoize(testutil.NewFakeBind(), &AtomicNoizeConfig{Jmin: 20, Jmax: 10}, 443, time.Hour); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("constructor with Jmax below Jmin: got %v, want ErrConfigInvalid", err)
+	}
+}
+
+func TestFreezeThaw(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	b, err := NewWithAtomicNoize(fake, &AtomicNoizeConfig{I1: "<b 0102030405060708>"}, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func() []testutil.FakeSend {
+		t.Helper()
+		fake.Reset()
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		return fake.Sends()
+	}
+
+	b.Freeze()
+	if !b.Frozen() {
+		t.Fatal("Frozen reports false after Freeze")
+	}
+	if sends := send(); len(sends) != 1 {
+		t.Fatalf("frozen Bind sent %d packets, want only the initiation", len(sends))
+	}
+
+	// An invalid config is rejected and leaves the Bind frozen
+	if err := b.Thaw(&AtomicNoizeConfig{Jmin: 20, Jmax: 10}); !errors.Is(err, ErrConfigInvalid) {
+		t.Fatalf("Thaw with an invalid config: got %v, want ErrConfigInvalid", err)
+	}
+	if !b.Frozen() {
+		t.Fatal("failed Thaw unfroze the Bind")
+	}
+	if sends := send(); len(sends) != 1 {
+		t.Fatalf("Bind still frozen sent %d packets, want only the initiation", len(sends))
+	}
+
+	// Thaw applies the new config before the next preflight; the frozen
+	// sends did not use up the rate limit
+	if err := b.Thaw(&AtomicNoizeConfig{I1: "<b aabbccddeeff0011>"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.Frozen() {
+		t.Fatal("Frozen reports true after Thaw")
+	}
+	sends := send()
+	if len(sends) != 2 || !bytes.HasSuffix(sends[0].Packet, []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}) {
+		t.Fatalf("got %d packets after Thaw, want the new I1 and the initiation", len(sends))
+	}
+	b.Freeze()
+	if err := b.Thaw(nil); err != nil || b.Frozen() {
+		t.Errorf("Thaw(nil) = %v, frozen %v; want nil, false", err, b.Frozen())
+	}
+}
+
+func TestStartBackgroundJunk(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{Jmin: 10, Jmax: 20}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := netip.MustParseAddrPort("192.0.2.1:2408")
+	if _, err := b.StartBackgroundJunk(context.Background(), dst, 0); err == nil {
+		t.Error("zero interval accepted")
+	}
+	// waitSends waits until at least n packets have been sent
+	waitSends := func(n int) []testutil.FakeSend {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if sends := fake.Sends(); len(sends) >= n {
+				return sends
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("fewer than %d background junk packets sent", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	quiet := func(what string) {
+		t.Helper()
+		time.Sleep(10 * time.Millisecond) // let a tick already in flight finish
+		before := len(fake.Sends())
+		time.Sleep(20 * time.Millisecond)
+		if after := len(fake.Sends()); after != before {
+			t.Errorf("%d junk packets sent after %s", after-before, what)
+		}
+	}
+
+	stop, err := b.StartBackgroundJunk(context.Background(), dst, 2*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range waitSends(3) {
+		if s.Endpoint.DstToString() != dst.String() {
+			t.Errorf("junk sent to %s, want %s", s.Endpoint.DstToString(), dst)
+		}
+		if n := len(s.Packet); n < cfg.Jmin || n > cfg.Jmax {
+			t.Errorf("junk packet of %d bytes outside [%d, %d]", n, cfg.Jmin, cfg.Jmax)
+		}
+	}
+	stop()
+	stop()
+	quiet("stop")
+
+	// Cancelling ctx and removing the peer end a loop too
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := b.StartBackgroundJunk(ctx, dst, 2*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	fake.Reset()
+	waitSends(1)
+	cancel()
+	quiet("ctx was cancelled")
+
+	if _, err := b.StartBackgroundJunk(context.Background(), dst, 2*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	fake.Reset()
+	waitSends(1)
+	b.RemovePeer(dst.Addr())
+	quiet("RemovePeer")
+
+	if _, err := b.StartBackgroundJunk(context.Background(), dst, 2*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	fake.Reset()
+	waitSends(1)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	quiet("Close")
+
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.activeBackgroundJunk.Load(); n != 0 {
+		t.Errorf("%d background junk loops still running after Shutdown", n)
+	}
+	if _, err := b.StartBackgroundJunk(context.Background(), dst, time.Millisecond); err == nil {
+		t.Error("StartBackgroundJunk succeeded after Shutdown")
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	base := &AtomicNoizeConfig{I1: "<b 01>", Jc: 3, Jmin: 10, Jmax: 20, JunkInterval: time.Millisecond}
+	h := base.Hash()
+	if len(h) != 64 {
+		t.Fatalf("hash %q is not hex SHA-256", h)
+	}
+	if (*AtomicNoizeConfig)(nil).Hash() != (&AtomicNoizeConfig{}).Hash() {
+		t.Error("nil config does not hash like the zero config")
+	}
+
+	// Macros inserted in different orders hash the same
+	keys := []string{"host", "path", "agent", "token", "zone", "id", "proto", "port"}
+	forward, backward := map[string]string{}, map[string]string{}
+	for i, k := range keys {
+		forward[k] = strconv.Itoa(i)
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		backward[keys[i]] = strconv.Itoa(i)
+	}
+	a, b := *base, *base
+	a.Macros, b.Macros = forward, backward
+	if a.Hash() != b.Hash() {
+		t.Error("hash depends on the order macros were added")
+	}
+	if a.Hash() == h {
+		t.Error("macros do not change the hash")
+	}
+
+	// Every field takes part in the hash
+	seen := map[string]string{h: "base"}
+	typ := reflect.TypeOf(*base)
+	for i := range typ.NumField() {
+		c := *base
+		f := reflect.ValueOf(&c).Elem().Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString("<b ff>")
+		case reflect.Int, reflect.Int64:
+			f.SetInt(f.Int() + 7)
+		case reflect.Uint32:
+			f.SetUint(7)
+		case reflect.Float64:
+			f.SetFloat(0.5)
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Map:
+			f.Set(reflect.ValueOf(map[string]string{"k": "v"}))
+		default:
+			t.Fatalf("test does not know how to change field %s of kind %s", typ.Field(i).Name, f.Kind())
+		}
+		name := typ.Field(i).Name
+		if prev, dup := seen[c.Hash()]; dup {
+			t.Errorf("changing %s gives the same hash as %s", name, prev)
+		}
+		seen[c.Hash()] = name
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>", Jc: 3, JcBeforeHS: 1, Jmin: 10, Jmax: 10}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithTraceProvider(tp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := b.ParseEndpoint("192.0.2.1:2408")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown waits for the post-handshake junk, ending its span
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	preflight, post := spans["preflightbind.preflight"], spans["preflightbind.post_handshake"]
+	if len(spans) != 2 || preflight == nil || post == nil {
+		t.Fatalf("got spans %v, want preflightbind.preflight and preflightbind.post_handshake", slices.Collect(maps.Keys(spans)))
+	}
+	for _, tt := range []struct {
+		span sdktrace.ReadOnlySpan
+		want []attribute.KeyValue
+	}{
+		{preflight, []attribute.KeyValue{
+			attribute.String("dst", "192.0.2.1"), attribute.Bool("i1_present", true), attribute.Int("jc", 3),
+		}},
+		{post, []attribute.KeyValue{
+			attribute.String("dst", "192.0.2.1"), attribute.Int("junk", 2),
+		}},
+	} {
+		if got := tt.span.Attributes(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s attributes %v, want %v", tt.span.Name(), got, tt.want)
+		}
+	}
+	if post.Parent().SpanID() != preflight.SpanContext().SpanID() {
+		t.Error("post-handshake span is not a child of the preflight span")
+	}
+}
+
+func TestPreflightProbability(t *testing.T) {
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPreflightProbability(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const trials = 400
+	fired := 0
+	for range trials {
+		if firesPreflight(t, b, fake, handshakeInitPacket()) {
+			fired++
+		}
+	}
+	// Five standard deviations either side of 200
+	if fired < 150 || fired > 250 {
+		t.Errorf("%d of %d initiations fired a preflight, want about half", fired, trials)
+	}
+
+	// A skipped draw leaves the rate limiter untouched, so the next
+	// initiation draws again until one fires
+	b.ResetRateLimiter()
+	dst := netip.MustParseAddr("192.0.2.1")
+	ep, _ := b.ParseEndpoint("192.0.2.1:2408")
+	for i := 0; ; i++ {
+		fake.Reset()
+		if err := b.Send([][]byte{handshakeInitPacket()}, ep); err != nil {
+			t.Fatal(err)
+		}
+		b.mu.Lock()
+		_, limited := b.lastSent[dst]
+		b.mu.Unlock()
+		if fired := len(fake.Sends()) > 1; fired != limited {
+			t.Fatalf("preflight fired %v but rate limiter entry present %v", fired, limited)
+		} else if fired {
+			break
+		}
+		if i == 100 {
+			t.Fatal("no preflight after 100 initiations")
+		}
+	}
+
+	// Values outside (0, 1] are ignored
+	for _, p := range []float64{0, -0.5, 1.5, math.NaN(), 1} {
+		b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour,
+			WithLogger(slog.New(slog.DiscardHandler)), WithPreflightProbability(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 20 {
+			if !firesPreflight(t, b, fake, handshakeInitPacket()) {
+				t.Fatalf("probability %v: initiation did not fire a preflight", p)
+			}
+		}
+	}
+}
+
+func TestInitTypes(t *testing.T) {
+	initOfType := func(typ byte) []byte {
+		buf := handshakeInitPacket()
+		buf[0] = typ
+		return buf
+	}
+	fake := testutil.NewFakeBind()
+	cfg := &AtomicNoizeConfig{I1: "<b 0102030405060708>"}
+	b, err := NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithInitTypes([]byte{0x11, 0x22}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		typ  byte
+		want bool
+	}{
+		{0x11, true},
+		{0x22, true},
+		{byte(device.MessageInitiationType), false},
+		{0x33, false},
+	} {
+		if got := firesPreflight(t, b, fake, initOfType(tt.typ)); got != tt.want {
+			t.Errorf("type %#x fired a preflight: %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+	short := initOfType(0x11)[:device.MessageInitiationSize-1]
+	if firesPreflight(t, b, fake, short) {
+		t.Error("short packet of an initiation type fired a preflight")
+	}
+
+	// Types combine with WithHandshakeInitSize, and an empty list restores type 1
+	b, err = NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithInitTypes([]byte{0x11}), WithHandshakeInitSize(40, 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firesPreflight(t, b, fake, initOfType(0x11)[:50]) || firesPreflight(t, b, fake, initOfType(0x11)) {
+		t.Error("initiation types ignored the size range")
+	}
+	b, err = NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithInitTypes([]byte{0x11}), WithInitTypes(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firesPreflight(t, b, fake, handshakeInitPacket()) || firesPreflight(t, b, fake, initOfType(0x11)) {
+		t.Error("empty WithInitTypes did not restore type 1")
+	}
+
+	// The option leaves a custom classifier alone
+	custom := struct{ PacketClassifier }{DefaultPacketClassifier()}
+	b, err = NewWithAtomicNoize(fake, cfg, 443, time.Hour, WithPacketClassifier(custom), WithInitTypes([]byte{0x11}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firesPreflight(t, b, fake, initOfType(0x11)) {
+		t.Error("WithInitTypes changed a classifier set with WithPacketClassifier")
+	}
+}
+
+// TestRunScheduleAbsoluteTimes checks that packets go out at their offsets
+// from the start, not at offsets from the previous packet.
+func TestRunScheduleAbsoluteTimes(t *testing.T) {
+	const step = 100 * time.Millisecond
+	packet := func(b byte) func() []byte { return func() []byte { return []byte{b} } }
+	run := func(start time.Time, schedule []TimedPacket) ([]time.Duration, bool) {
+		var sent []time.Duration
+		ok := runSchedule(context.Background(), start, schedule, func([]byte) {
+			sent = append(sent, time.Since(start))
+		})
+		return sent, ok
+	}
+
+	// Building the first packet takes most of a step; relative sleeps would
+	// push every later packet back by that much
+	slow := func() []byte { time.Sleep(step * 8 / 10); return []byte{0} }
+	sent, ok := run(time.Now(), []TimedPacket{{0, slow}, {step, packet(1)}, {2 * step, packet(2)}})
+	if !ok || len(sent) != 3 {
+		t.Fatalf("sent %d packets, completed %v; want 3, true", len(sent), ok)
+	}
+	for i := 1; i < 3; i++ {
+		if want := time.Duration(i) * step; sent[i] < want || sent[i] >= want+step*6/10 {
+			t.Errorf("packet %d sent after %v, want %v", i, sent[i], want)
+		}
+	}
+
+	// A schedule that starts late catches up instead of shifting
+	const late = 3 * step / 2
+	sent, _ = run(time.Now().Add(-late), []TimedPacket{{0, packet(0)}, {step, packet(1)}, {2 * step, packet(2)}})
+	if sent[1] >= late+step*6/10 {
+		t.Errorf("overdue packet sent %v into the run, want at once", sent[1]-late)
+	}
+	if want := 2 * step; sent[2] < want || sent[2] >= want+step*6/10 {
+		t.Errorf("last packet sent after %v, want %v", sent[2], want)
+	}
+
+	// A nil payload or a done context ends the schedule early
+	sent, ok = run(time.Now(), []TimedPacket{{0, packet(0)}, {0, func() []byte { return nil }}, {0, packet(2)}})
+	if ok || len(sent) != 1 {
+		t.Errorf("nil payload: sent %d packets, completed %v; want 1, false", len(sent), ok)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if runSchedule(ctx, time.Now(), []TimedPacket{{step, packet(0)}}, func([]byte) { t.Error("sent after cancel") }) {
+		t.Error("cancelled schedule reported completion")
+	}
+}
+
+// TestWSBindSlowRedial checks that a redial stuck on a slow server does not
+// hold up Close.
+func TestWSBindSlowRedial(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	release := make(chan struct{})
+	var upgrader websocket.Upgrader
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			<-release // every redial hangs before the upgrade
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- ws
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	inner, err := WSBind("ws"+strings.TrimPrefix(srv.URL, "http"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := inner.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	w := inner.(*wsBind)
+	(<-conns).Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		lost := w.ws == nil
+		w.mu.Unlock()
+		if lost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dropped connection was not noticed")
+		}
+	}
+
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- inner.Send([][]byte{[]byte("x")}, &wsEndpoint{uri: srv.URL}) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		dialing := w.dialing != nil
+		w.mu.Unlock()
+		if dialing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Send did not start a redial")
+		}
+	}
+
+	start := time.Now()
+	if err := inner.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close waited %v for the redial", elapsed)
+	}
+	release <- struct{}{}
+	if err := <-sendErr; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send racing Close returned %v, want net.ErrClosed", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ws != nil {
+		t.Error("connection dialed during Close was kept")
+	}
+}
+
+// TestH2BindSlowRedial checks that a redial stuck on a slow server does not
+// hold up Close, and that a stream it opens afterwards is not kept.
+func TestH2BindSlowRedial(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			<-release // every redial hangs before the response headers
+		}
+		// The first stream ends as soon as it opens, forcing a redial
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	defer close(release)
+
+	inner, err := H2Bind(srv.URL, srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := inner.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	h := inner.(*h2Bind)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		lost := h.stream == nil
+		h.mu.Unlock()
+		if lost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ended stream was not noticed")
+		}
+	}
+
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- inner.Send([][]byte{[]byte("x")}, &wsEndpoint{uri: srv.URL}) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		dialing := h.dialing != nil
+		h.mu.Unlock()
+		if dialing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Send did not start a redial")
+		}
+	}
+
+	start := time.Now()
+	if err := inner.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close waited %v for the redial", elapsed)
+	}
+	release <- struct{}{}
+	if err := <-sendErr; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send racing Close returned %v, want net.ErrClosed", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stream != nil {
+		t.Error("stream dialed during Close was kept")
+	}
+}
@@ -0,0 +1,112 @@
+package preflightbind
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// FingerprintProfile names a ready-made I1 payload that imitates a common
+// protocol, for users who do not want to write CPS strings by hand.
+type FingerprintProfile string
+
+const (
+	// FingerprintTLS13Chrome is a TLS 1.3 ClientHello shaped like Chrome's,
+	// as sent to port 443.
+	FingerprintTLS13Chrome FingerprintProfile = "tls13-chrome"
+	// FingerprintQUICInitial is a QUIC v1 client Initial packet padded to
+	// the minimum datagram size clients must use.
+	FingerprintQUICInitial FingerprintProfile = "quic-initial"
+	// FingerprintWireGuardNative sends no I1 at all, leaving the handshake
+	// as plain WireGuard.
+	FingerprintWireGuardNative FingerprintProfile = "wireguard-native"
+)
+
+// quicMinInitialSize is the smallest UDP payload a QUIC client may use for
+// an Initial packet (RFC 9000, section 14.1).
+const quicMinInitialSize = 1200
+
+// ProfileOptions tunes BuildPayloadFromProfile.
+type ProfileOptions struct {
+	// SNI is the server name for FingerprintTLS13Chrome. Empty omits the
+	// server_name extension.
+	SNI string
+	// Size is the total length of a FingerprintQUICInitial packet. Zero or
+	// anything below 1200 means 1200.
+	Size int
+}
+
+// Chrome's TLS 1.3 offer, without the GREASE values it randomises.
+var (
+	chromeCipherSuites = []uint16{
+		0x1301, 0x1302, 0x1303,
+		0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+		0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	}
+	chromeExtensions = []TLSExtension{
+		{Type: 23},                             // extended_master_secret
+		{Type: 0xff01, Data: []byte{0}},        // renegotiation_info
+		{Type: 11, Data: []byte{1, 0}},         // ec_point_formats: uncompressed
+		{Type: 35},                             // session_ticket
+		{Type: 5, Data: []byte{1, 0, 0, 0, 0}}, // status_request: OCSP
+		{Type: 18},                             // signed_certificate_timestamp
+		{Type: 27, Data: []byte{2, 0, 2}},      // compress_certificate: brotli
+		{Type: tlsExtSupportedGroups, Data: []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}},
+		{Type: tlsExtSignatureAlgorithms, Data: []byte{0x00, 0x10,
+			0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03,
+			0x08, 0x05, 0x05, 0x01, 0x08, 0x06, 0x06, 0x01}},
+		{Type: tlsExtALPN, Data: []byte{0x00, 0x0c, 0x02, 'h', '2', 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'}},
+	}
+)
+
+// BuildPayloadFromProfile returns an I1 payload for profile. Random fields
+// are fresh on every call. FingerprintWireGuardNative yields a nil payload.
+func BuildPayloadFromProfile(profile FingerprintProfile, opts ProfileOptions) ([]byte, error) {
+	switch profile {
+	case FingerprintTLS13Chrome:
+		return BuildTLSClientHelloPayload(opts.SNI, chromeCipherSuites, chromeExtensions)
+	case FingerprintQUICInitial:
+		return buildQUICInitial(opts.Size)
+	case FingerprintWireGuardNative:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown fingerprint profile %q", ErrConfigInvalid, profile)
+	}
+}
+
+// buildQUICInitial returns a QUIC v1 long-header Initial packet of size
+// bytes. The protected payload is random, which is indistinguishable from
+// real header-protected ciphertext.
+func buildQUICInitial(size int) ([]byte, error) {
+	if size < quicMinInitialSize {
+		size = quicMinInitialSize
+	}
+	if size > 0x3fff {
+		return nil, fmt.Errorf("%w: QUIC Initial size %d exceeds 16383 bytes", ErrPacketTooBig, size)
+	}
+
+	pkt := make([]byte, size)
+	if _, err := rand.Read(pkt); err != nil {
+		return nil, err
+	}
+	// Long header, Initial, 4-byte packet number, version 1, then an
+	// 8-byte DCID at 6:14, an 8-byte SCID at 15:23 and an empty token
+	pkt[0] = 0xc3
+	binary.BigEndian.PutUint32(pkt[1:], 1)
+	pkt[5] = 8
+	pkt[14] = 8
+	pkt[23] = 0
+	// Length covers the packet number and payload, as a 2-byte varint
+	binary.BigEndian.PutUint16(pkt[24:], 0x4000|uint16(size-26))
+	return pkt, nil
+}
+
+// WithFingerprintProfile replaces I1 with a payload built from profile each
+// time the config is compiled. It takes precedence over WithSNI; when
+// opts.SNI is empty the WithSNI name is used for FingerprintTLS13Chrome.
+func WithFingerprintProfile(profile FingerprintProfile, opts ProfileOptions) Option {
+	return func(b *Bind) {
+		b.cps.profile = profile
+		b.cps.profileOpts = opts
+	}
+}
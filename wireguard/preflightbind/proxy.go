@@ -0,0 +1,205 @@
+package preflightbind
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// WithHTTPConnectProxy sends every preflight, signature and junk packet
+// through an HTTP CONNECT proxy instead of as UDP, for networks where all
+// port-443 traffic must cross such a proxy. proxyURL is "http://host:port"
+// or "https://host:port", optionally with user:password for Basic auth. An
+// unparsable URL is logged and ignored. WireGuard's own packets are not
+// affected.
+//
+// One CONNECT tunnel is kept per destination, and each datagram is written
+// to it as a 2-byte big-endian length followed by the datagram, as in DNS
+// over TCP. The destination therefore has to accept TCP on the WireGuard
+// port and unwrap this framing itself (or through a relay in front of it);
+// a plain WireGuard server never sees these packets.
+func WithHTTPConnectProxy(proxyURL string) Option {
+	return func(b *Bind) {
+		u, err := url.Parse(proxyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			b.log.Warn("ignoring invalid HTTP CONNECT proxy URL", "url", proxyURL, "error", err)
+			return
+		}
+		p := &connectProxy{url: u, userAgent: func() string { return b.userAgent }}
+		b.proxy = newFramedTunnels(p.dial)
+	}
+}
+
+// packetProxy carries preflight packets to their destination in place of
+// plain UDP; see WithHTTPConnectProxy and WithSOCKS5Proxy.
+type packetProxy interface {
+	// send delivers one datagram to dst
+	send(dst netip.AddrPort, data []byte) error
+	// close releases every connection the proxy holds open
+	close()
+}
+
+// connectProxy opens tunnels through an HTTP CONNECT proxy.
+type connectProxy struct {
+	url       *url.URL
+	userAgent func() string // read at dial time, since options may follow
+}
+
+// framedTunnels sends datagrams over stream tunnels, one per destination,
+// each datagram preceded by its 2-byte big-endian length.
+type framedTunnels struct {
+	dial func(ctx context.Context, target string) (net.Conn, error)
+
+	mu      sync.Mutex
+	tunnels map[netip.AddrPort]net.Conn
+}
+
+func newFramedTunnels(dial func(ctx context.Context, target string) (net.Conn, error)) *framedTunnels {
+	return &framedTunnels{dial: dial, tunnels: make(map[netip.AddrPort]net.Conn)}
+}
+
+// sendPacketProxy sends packet to ep's destination through the proxy.
+func (b *Bind) sendPacketProxy(packet []byte, ep conn.Endpoint, what string) bool {
+	dst, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		dst = netip.AddrPortFrom(ep.DstIP(), uint16(b.port443))
+	}
+	if err := b.proxy.send(dst, packet); err != nil {
+		b.sendFailures.Add(1)
+		b.reportError(err, what)
+		return false
+	}
+	b.bytesWritten.Add(int64(len(packet)))
+	b.captureEndpoint(ep, packet)
+	return true
+}
+
+// send writes one length-prefixed datagram to dst's tunnel, redialing once
+// if the cached tunnel has broken.
+func (p *framedTunnels) send(dst netip.AddrPort, data []byte) error {
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("%w: %d bytes for proxy framing", ErrPacketTooBig, len(data))
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	frame = append(frame, data...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		c, err := p.tunnelLocked(dst)
+		if err != nil {
+			return err
+		}
+		_ = c.SetWriteDeadline(time.Now().Add(preflightDialTimeout))
+		_, err = c.Write(frame)
+		if err == nil {
+			return nil
+		}
+		c.Close()
+		delete(p.tunnels, dst)
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// tunnelLocked returns the tunnel to dst, opening it if needed. p.mu must be
+// held.
+func (p *framedTunnels) tunnelLocked(dst netip.AddrPort) (net.Conn, error) {
+	if c, ok := p.tunnels[dst]; ok {
+		return c, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), preflightDialTimeout)
+	defer cancel()
+	c, err := p.dial(ctx, dst.String())
+	if err != nil {
+		return nil, wrapIn(ErrDialFailed, fmt.Errorf("tunnel to %s: %w", dst, err))
+	}
+	p.tunnels[dst] = c
+	return c, nil
+}
+
+// dial opens a connection to the proxy and issues CONNECT for target.
+func (p *connectProxy) dial(ctx context.Context, target string) (net.Conn, error) {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		if p.url.Scheme == "https" {
+			host = net.JoinHostPort(p.url.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(p.url.Hostname(), "80")
+		}
+	}
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if p.url.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: p.url.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	setUserAgent(req.Header, p.userAgent())
+	if u := p.url.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("%w: proxy answered %s", ErrDialFailed, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		c.Close()
+		return nil, io.ErrUnexpectedEOF // proxy sent data before the tunnel was used
+	}
+	_ = c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// close shuts every open tunnel.
+func (p *framedTunnels) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dst, c := range p.tunnels {
+		c.Close()
+		delete(p.tunnels, dst)
+	}
+}
@@ -0,0 +1,114 @@
+package preflightbind
+
+import (
+	"context"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultPreflightQueueDepth is the queue depth used when
+// WithPreflightQueueDepth is given n <= 0.
+const defaultPreflightQueueDepth = 8
+
+// preflightJob is a preflight sequence that passed the rate limit and waits
+// for the queue worker.
+type preflightJob struct {
+	ctx      context.Context // carries the span and junk budget
+	ep       conn.Endpoint
+	config   *AtomicNoizeConfig
+	compiled compiledConfig
+	at       time.Time     // when the initiation was seen
+	span     trace.Span    // ended once the sequence has been sent
+	ready    chan struct{} // closed once the sequence has been sent
+}
+
+// WithPreflightQueueDepth runs preflight sequences on a background worker
+// instead of inside Send, so data packets queued behind a handshake are not
+// held up by junk intervals and handshake delays. Jobs that pass the rate
+// limit wait in a queue of n entries (8 if n <= 0); when it is full the
+// sequence runs inline as before. The worker starts in Open and stops in
+// Close, which drops any sequences still queued.
+//
+// Because Send returns before the preflight has gone out, the handshake
+// initiation usually reaches the peer first. Only use this where the
+// preflight does not need to precede the handshake, which is why it is off
+// by default.
+func WithPreflightQueueDepth(n int) Option {
+	return func(b *Bind) {
+		if n <= 0 {
+			n = defaultPreflightQueueDepth
+		}
+		b.preflightQueueDepth = n
+	}
+}
+
+// startPreflightWorker starts the queue worker if WithPreflightQueueDepth
+// was used. It must be called with b.mu held.
+func (b *Bind) startPreflightWorker() {
+	if b.preflightQueueDepth <= 0 || b.preflightJobs != nil {
+		return
+	}
+	jobs := make(chan preflightJob, b.preflightQueueDepth)
+	stop := make(chan struct{})
+	b.preflightJobs = jobs
+	b.preflightStop = stop
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		for {
+			select {
+			case job := <-jobs:
+				b.runPreflight(job)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopPreflightWorker stops the worker started by startPreflightWorker,
+// dropping queued jobs. It must be called with b.mu held.
+func (b *Bind) stopPreflightWorker() {
+	if b.preflightStop == nil {
+		return
+	}
+	close(b.preflightStop)
+	jobs := b.preflightJobs
+	b.preflightStop = nil
+	b.preflightJobs = nil
+	// enqueuePreflight sends under b.mu, so nothing is added after this
+	for {
+		select {
+		case job := <-jobs:
+			b.dropPreflight(job)
+		default:
+			return
+		}
+	}
+}
+
+// dropPreflight discards a queued job that will not run, ending its span
+// and releasing anything waiting on it.
+func (b *Bind) dropPreflight(job preflightJob) {
+	job.span.AddEvent("preflight dropped, bind closed")
+	job.span.End()
+	close(job.ready)
+}
+
+// enqueuePreflight hands job to the worker, reporting false if there is no
+// worker or its queue is full.
+func (b *Bind) enqueuePreflight(job preflightJob) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.preflightJobs == nil {
+		return false
+	}
+	select {
+	case b.preflightJobs <- job:
+		return true
+	default:
+		return false
+	}
+}
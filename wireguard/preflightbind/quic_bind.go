@@ -0,0 +1,277 @@
+package preflightbind
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+const (
+	quicDialTimeout = 10 * time.Second
+	quicRecvQueue   = 1024
+)
+
+// quicBind carries WireGuard packets over QUIC streams to a single server.
+// Each Send opens a stream, writes every packet of the burst as a 2-byte
+// big-endian length followed by the packet, and closes the stream. Streams
+// opened by the server are read the same way.
+type quicBind struct {
+	addr     string
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+
+	mu      sync.Mutex
+	conn    *quic.Conn
+	dialing chan struct{} // closed when the dial in progress, if any, ends
+	closed  chan struct{}
+	recv    chan []byte
+}
+
+// QUICBind returns a conn.Bind that tunnels WireGuard through QUIC to
+// quicAddr ("host:port"). The connection is dialed on Open and redialed by
+// Send if it has been lost. Every endpoint maps to the same QUIC server, so
+// the server side is responsible for delivering packets to the WireGuard
+// peer. The result can be wrapped by New or NewWithAtomicNoize like any
+// other Bind; raw preflight sockets still send plain UDP to the server.
+func QUICBind(quicAddr string, tlsConfig *tls.Config) (conn.Bind, error) {
+	if _, _, err := net.SplitHostPort(quicAddr); err != nil {
+		return nil, fmt.Errorf("invalid QUIC address %q: %w", quicAddr, err)
+	}
+	if tlsConfig == nil {
+		return nil, errors.New("QUIC requires a TLS config")
+	}
+	return &quicBind{
+		addr:     quicAddr,
+		tlsConf:  tlsConfig,
+		quicConf: &quic.Config{KeepAlivePeriod: 15 * time.Second},
+	}, nil
+}
+
+func (q *quicBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	q.mu.Lock()
+	if q.closed != nil {
+		q.mu.Unlock()
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	q.closed = closed
+	q.recv = make(chan []byte, quicRecvQueue)
+	q.mu.Unlock()
+
+	c, err := q.current()
+	if err != nil {
+		q.mu.Lock()
+		if q.closed == closed {
+			q.closed = nil
+		}
+		q.mu.Unlock()
+		return nil, 0, err
+	}
+	actualPort := port
+	if a, ok := c.LocalAddr().(*net.UDPAddr); ok {
+		actualPort = uint16(a.Port)
+	}
+	return []conn.ReceiveFunc{q.receive}, actualPort, nil
+}
+
+// current returns a live connection, redialing if the previous one closed.
+// The dial happens without q.mu held, so receive and Close are not stalled
+// by an unreachable server; concurrent callers wait for the same dial.
+func (q *quicBind) current() (*quic.Conn, error) {
+	q.mu.Lock()
+	for {
+		if q.closed == nil {
+			q.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if q.conn != nil && q.conn.Context().Err() == nil {
+			c := q.conn
+			q.mu.Unlock()
+			return c, nil
+		}
+		if q.dialing == nil {
+			break
+		}
+		dialing := q.dialing
+		q.mu.Unlock()
+		<-dialing
+		q.mu.Lock()
+	}
+	dialing := make(chan struct{})
+	q.dialing = dialing
+	closed, recv := q.closed, q.recv
+	q.mu.Unlock()
+
+	c, err := q.dial()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dialing = nil
+	close(dialing)
+	if err != nil {
+		return nil, err
+	}
+	if q.closed != closed {
+		// Closed, and maybe reopened, while dialing
+		c.CloseWithError(0, "")
+		return nil, net.ErrClosed
+	}
+	q.conn = c
+	go q.acceptStreams(c, closed, recv)
+	return c, nil
+}
+
+// dial connects to the server.
+func (q *quicBind) dial() (*quic.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, q.addr, q.tlsConf, q.quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDialFailed, err)
+	}
+	return c, nil
+}
+
+func (q *quicBind) acceptStreams(c *quic.Conn, closed chan struct{}, recv chan []byte) {
+	for {
+		s, err := c.AcceptStream(c.Context())
+		if err != nil {
+			return
+		}
+		go readQUICStream(s, closed, recv)
+	}
+}
+
+// readQUICStream queues every length-prefixed packet on s until it ends.
+func readQUICStream(s *quic.Stream, closed chan struct{}, recv chan []byte) {
+	defer s.CancelRead(0)
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(s, hdr[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(s, packet); err != nil {
+			return
+		}
+		select {
+		case recv <- packet:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (q *quicBind) receive(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	q.mu.Lock()
+	closed, recv, c := q.closed, q.recv, q.conn
+	q.mu.Unlock()
+	if closed == nil {
+		return 0, net.ErrClosed
+	}
+
+	var packet []byte
+	select {
+	case packet = <-recv:
+	case <-closed:
+		return 0, net.ErrClosed
+	}
+	ep := &quicEndpoint{}
+	if c != nil {
+		if a, ok := c.RemoteAddr().(*net.UDPAddr); ok {
+			ep.dst = a.AddrPort()
+		}
+	}
+
+	n := 0
+	for {
+		sizes[n] = copy(packets[n], packet)
+		eps[n] = ep
+		n++
+		if n == len(packets) {
+			return n, nil
+		}
+		select {
+		case packet = <-recv:
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (q *quicBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	c, err := q.current()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.Context(), quicDialTimeout)
+	defer cancel()
+	s, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+
+	var frame []byte
+	for _, buf := range bufs {
+		if len(buf) > 0xFFFF {
+			s.CancelWrite(0)
+			return fmt.Errorf("%w: %d bytes for QUIC framing", ErrPacketTooBig, len(buf))
+		}
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(buf)))
+		frame = append(frame, buf...)
+	}
+	if _, err := s.Write(frame); err != nil {
+		s.CancelWrite(0)
+		return err
+	}
+	return s.Close()
+}
+
+func (q *quicBind) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed == nil {
+		return nil
+	}
+	close(q.closed)
+	q.closed = nil
+	var err error
+	if q.conn != nil {
+		err = q.conn.CloseWithError(0, "")
+		q.conn = nil
+	}
+	return err
+}
+
+func (q *quicBind) SetMark(uint32) error { return nil }
+func (q *quicBind) BatchSize() int       { return conn.IdealBatchSize }
+
+func (q *quicBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &quicEndpoint{dst: ap}, nil
+}
+
+// quicEndpoint is the WireGuard peer address as seen through a quicBind.
+type quicEndpoint struct {
+	dst netip.AddrPort
+}
+
+func (e *quicEndpoint) ClearSrc()           {}
+func (e *quicEndpoint) SrcToString() string { return "" }
+func (e *quicEndpoint) DstToString() string { return e.dst.String() }
+func (e *quicEndpoint) DstToBytes() []byte  { b, _ := e.dst.MarshalBinary(); return b }
+func (e *quicEndpoint) DstIP() netip.Addr   { return e.dst.Addr() }
+func (e *quicEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
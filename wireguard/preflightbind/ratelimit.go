@@ -0,0 +1,274 @@
+package preflightbind
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultPruneInterval is how often Open's background goroutine drops stale
+// rate-limiter entries.
+const defaultPruneInterval = 10 * time.Minute
+
+// WithPruneInterval sets how often stale rate-limiter entries are removed.
+// A non-positive d disables background pruning.
+func WithPruneInterval(d time.Duration) Option {
+	return func(b *Bind) {
+		b.pruneInterval = d
+	}
+}
+
+// ResetRateLimiter forgets when preflights were last sent, so the next
+// handshake to every destination triggers a new preflight. Junk sequence
+// numbers restart as well.
+func (b *Bind) ResetRateLimiter() {
+	b.mu.Lock()
+	clear(b.lastSent)
+	clear(b.junkSeq)
+	b.mu.Unlock()
+	b.rateLimiterChanged()
+}
+
+// PruneRateLimiter removes rate-limiter entries whose last preflight is older
+// than olderThan and returns the number of entries removed. An entry is kept
+// until the rate-limit interval for its destination, the Bind's own or one
+// set by WithIntervalOverrides, has passed too, so pruning never lets a
+// destination be preflighted early. A pruned destination loses all the state
+// RemovePeer drops, except that its background junk loops keep running.
+func (b *Bind) PruneRateLimiter(olderThan time.Duration) int {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for dst, last := range b.lastSent {
+		age := max(olderThan, b.intervalFor(dst))
+		if last.Before(now.Add(-age)) {
+			b.forgetDst(dst)
+			n++
+		}
+	}
+	if n > 0 {
+		b.rateLimiterChanged()
+	}
+	return n
+}
+
+// WithPreflightProbability fires a preflight for only a fraction p of the
+// handshakes that pass the rate limiter, so preflights do not pair up with
+// handshakes one to one, a regularity DPI could learn. Skipped handshakes
+// leave the rate limiter untouched, so the next initiation draws again. p
+// must be in (0, 1]; other values are logged and ignored.
+func WithPreflightProbability(p float64) Option {
+	return func(b *Bind) {
+		if !(p > 0 && p <= 1) {
+			b.log.Warn("ignoring preflight probability outside (0, 1]", "p", p)
+			return
+		}
+		b.probability = p
+	}
+}
+
+// preflightChance draws from crypto/rand whether a preflight should fire.
+func (b *Bind) preflightChance() bool {
+	if b.probability == 0 || b.probability == 1 {
+		return true
+	}
+	return randFloat64() < b.probability
+}
+
+// SharedRateLimiter rate limits preflights across several Binds in one
+// process, e.g. one per WireGuard interface, so that only one of them
+// preflights a given server per interval. Create it with
+// NewSharedRateLimiter and pass it to each Bind with WithSharedRateLimiter.
+// Each Bind still applies its own interval and keeps its own state; the
+// shared limiter only adds the cross-Bind check.
+type SharedRateLimiter struct {
+	mu       sync.Mutex
+	lastSent map[netip.Addr]time.Time
+}
+
+// NewSharedRateLimiter returns an empty SharedRateLimiter.
+func NewSharedRateLimiter() *SharedRateLimiter {
+	return &SharedRateLimiter{lastSent: make(map[netip.Addr]time.Time)}
+}
+
+// WithSharedRateLimiter makes the Bind consult s before each preflight.
+func WithSharedRateLimiter(s *SharedRateLimiter) Option {
+	return func(b *Bind) {
+		b.shared = s
+	}
+}
+
+// claim records a preflight to dst at now and reports true, unless another
+// Bind preflighted dst less than interval ago. A nil s always allows.
+func (s *SharedRateLimiter) claim(dst netip.Addr, now time.Time, interval time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSent[dst]) < interval {
+		return false
+	}
+	s.lastSent[dst] = now
+	return true
+}
+
+// Prune removes entries older than olderThan and returns how many were
+// removed. Binds do not prune the shared limiter themselves.
+func (s *SharedRateLimiter) Prune(olderThan time.Duration) int {
+	cutoff := time.Now().Add(-olderThan)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for dst, last := range s.lastSent {
+		if last.Before(cutoff) {
+			delete(s.lastSent, dst)
+			n++
+		}
+	}
+	return n
+}
+
+// intervalOverride is one entry of WithIntervalOverrides.
+type intervalOverride struct {
+	prefix   netip.Prefix
+	interval time.Duration
+}
+
+// WithIntervalOverrides sets the minimum interval between preflights per
+// destination prefix, in place of the Bind-wide one, e.g. at most every 30s
+// to a CDN range but every second to a single peer. The longest prefix
+// containing the destination wins; invalid prefixes are ignored.
+func WithIntervalOverrides(overrides map[netip.Prefix]time.Duration) Option {
+	return func(b *Bind) {
+		b.intervalOverrides = b.intervalOverrides[:0]
+		for prefix, interval := range overrides {
+			if !prefix.IsValid() {
+				continue
+			}
+			b.intervalOverrides = append(b.intervalOverrides, intervalOverride{prefix.Masked(), interval})
+		}
+		sort.Slice(b.intervalOverrides, func(i, j int) bool {
+			return b.intervalOverrides[i].prefix.Bits() > b.intervalOverrides[j].prefix.Bits()
+		})
+	}
+}
+
+// intervalOverride returns the override interval for dst, if any.
+func (b *Bind) intervalOverride(dst netip.Addr) (time.Duration, bool) {
+	dst = dst.Unmap()
+	for _, o := range b.intervalOverrides {
+		if o.prefix.Contains(dst) {
+			return o.interval, true
+		}
+	}
+	return 0, false
+}
+
+// intervalFor returns the minimum interval between preflights to dst.
+func (b *Bind) intervalFor(dst netip.Addr) time.Duration {
+	if interval, ok := b.intervalOverride(dst); ok {
+		return interval
+	}
+	return b.interval
+}
+
+// startPruner launches the background prune loop. It must be called with
+// b.mu held.
+func (b *Bind) startPruner() {
+	if b.pruneInterval <= 0 || b.pruneStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	b.pruneStop = stop
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.PruneRateLimiter(interval)
+			case <-stop:
+				return
+			}
+		}
+	}(b.pruneInterval)
+}
+
+// stopPruner stops the loop started by startPruner. It must be called with
+// b.mu held.
+func (b *Bind) stopPruner() {
+	if b.pruneStop != nil {
+		close(b.pruneStop)
+		b.pruneStop = nil
+	}
+}
+
+// ReplacePeer moves the per-destination state of oldAddr to newAddr when a
+// peer roams, so the first handshake to the new address is rate limited as
+// if the peer had not moved instead of triggering a second preflight burst.
+// The rate-limiter entry, event history, RTT estimate, post-handshake and
+// cookie flags, junk sequence number, handshake failure count and tracked
+// sessions are all carried over, replacing any state already held for
+// newAddr. Background junk loops sending to oldAddr are stopped, since the
+// peer is no longer there.
+func (b *Bind) ReplacePeer(oldAddr, newAddr netip.Addr) {
+	if oldAddr == newAddr {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forgetDst(newAddr)
+	moveKey(b.lastSent, oldAddr, newAddr)
+	b.rateLimiterChanged()
+	moveKey(b.history, oldAddr, newAddr)
+	moveKey(b.rtt, oldAddr, newAddr)
+	moveKey(b.postHandshakeSent, oldAddr, newAddr)
+	moveKey(b.cookied, oldAddr, newAddr)
+	moveKey(b.junkSeq, oldAddr, newAddr)
+	moveKey(b.initTimes, oldAddr, newAddr)
+	moveKey(b.fallbackIdx, oldAddr, newAddr)
+	moveKey(b.initSent, oldAddr, newAddr)
+	moveKey(b.seenInits, oldAddr, newAddr)
+	b.sessions.moveDst(oldAddr, newAddr)
+	b.stopJunkLoops(oldAddr)
+}
+
+// RemovePeer drops all state held for dst: its rate-limiter entry, event
+// history, RTT estimate, flags, sequence numbers, handshake failure count
+// and tracked sessions. Background junk loops sending to dst are stopped.
+// Call it when the peer is removed from the WireGuard device, since nothing
+// else frees this state until the rate limiter prunes it.
+func (b *Bind) RemovePeer(dst netip.Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forgetDst(dst)
+	b.stopJunkLoops(dst)
+	b.rateLimiterChanged()
+}
+
+// forgetDst drops every per-destination entry held for dst. It must be
+// called with b.mu held.
+func (b *Bind) forgetDst(dst netip.Addr) {
+	delete(b.lastSent, dst)
+	delete(b.history, dst)
+	delete(b.rtt, dst)
+	delete(b.postHandshakeSent, dst)
+	delete(b.cookied, dst)
+	delete(b.junkSeq, dst)
+	delete(b.initTimes, dst)
+	delete(b.fallbackIdx, dst)
+	delete(b.initSent, dst)
+	delete(b.seenInits, dst)
+	b.sessions.removeDst(dst)
+}
+
+// moveKey renames m[from] to m[to] if from is present.
+func moveKey[V any](m map[netip.Addr]V, from, to netip.Addr) {
+	if v, ok := m[from]; ok {
+		m[to] = v
+		delete(m, from)
+	}
+}
@@ -0,0 +1,133 @@
+package preflightbind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ReachabilityResult is the outcome of ProbeReachability. The ICMP and UDP
+// probes are independent: a host that answers pings but not UDP on the
+// preflight port is up behind a filter, and a host that answers neither
+// may simply drop both.
+type ReachabilityResult struct {
+	ICMPReachable bool          // the host answered an ICMP Echo
+	ICMPRTT       time.Duration // round-trip time of that Echo
+	ICMPErr       error         // why the ICMP probe failed, e.g. os.ErrPermission
+
+	UDPReachable bool          // a datagram came back from the preflight port
+	UDPRTT       time.Duration // round-trip time of that datagram
+	UDPRefused   bool          // the host reported the port closed (ICMP port unreachable)
+}
+
+// HostUp reports whether the host answered either probe, including by
+// refusing the UDP port.
+func (r ReachabilityResult) HostUp() bool {
+	return r.ICMPReachable || r.UDPReachable || r.UDPRefused
+}
+
+// ProbeReachability checks whether dst can be reached before a preflight is
+// sent to it. It first sends an ICMP Echo, through an unprivileged ICMP
+// socket where the system allows one and a raw socket otherwise, and then
+// a timestamped UDP datagram to the preflight port, whose round trip, if
+// it is answered, is recorded in AverageRTT. Many servers, WireGuard included, never
+// answer unknown datagrams, so a silent UDP port is not proof of filtering;
+// callers weigh the result against their own fallback policy.
+//
+// Failures of either probe are reported in the result. The error is only
+// set when ctx ends before the probes finish or the UDP probe cannot be
+// sent at all.
+func (b *Bind) ProbeReachability(ctx context.Context, dst netip.Addr) (ReachabilityResult, error) {
+	var res ReachabilityResult
+	dst = dst.Unmap()
+
+	icmpCtx, cancel := context.WithTimeout(ctx, preflightDialTimeout/2)
+	res.ICMPRTT, res.ICMPErr = icmpEcho(icmpCtx, dst)
+	cancel()
+	res.ICMPReachable = res.ICMPErr == nil
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	udpCtx, cancel := context.WithTimeout(ctx, preflightDialTimeout/2)
+	defer cancel()
+	rtt, err := b.latencyProbe(udpCtx, netip.AddrPortFrom(dst, uint16(b.port443)).String())
+	var netErr net.Error
+	switch {
+	case err == nil:
+		res.UDPReachable, res.UDPRTT = true, rtt
+	case errors.Is(err, syscall.ECONNREFUSED):
+		res.UDPRefused = true
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		// No answer; a parent deadline is reported below
+	default:
+		return res, err
+	}
+	return res, ctx.Err()
+}
+
+// icmpEcho sends one ICMP Echo to dst and waits for the matching reply.
+func icmpEcho(ctx context.Context, dst netip.Addr) (time.Duration, error) {
+	network, rawNetwork, proto := "udp4", "ip4:icmp", 1
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	listen := "0.0.0.0"
+	if dst.Is6() {
+		network, rawNetwork, proto = "udp6", "ip6:ipv6-icmp", 58
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		listen = "::"
+	}
+
+	// Unprivileged ICMP sockets need net.ipv4.ping_group_range on Linux;
+	// raw sockets need root or CAP_NET_RAW
+	var peer net.Addr = &net.UDPAddr{IP: dst.AsSlice()}
+	c, err := icmp.ListenPacket(network, listen)
+	if err != nil {
+		peer = &net.IPAddr{IP: dst.AsSlice()}
+		if c, err = icmp.ListenPacket(rawNetwork, listen); err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+				err = fmt.Errorf("ICMP sockets not permitted: %w", os.ErrPermission)
+			}
+			return 0, err
+		}
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+
+	// Unprivileged sockets replace the ID with their own port, so replies
+	// are matched on the sequence number
+	seq := int(randFloat64() * 0xFFFF)
+	msg := icmp.Message{Type: echoType, Body: &icmp.Echo{ID: os.Getpid() & 0xFFFF, Seq: seq, Data: []byte("preflightbind")}}
+	wire, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := c.WriteTo(wire, peer); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return 0, fmt.Errorf("no ICMP echo reply from %s: %w", dst, err)
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package preflightbind
+
+import (
+	"net/netip"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
+)
+
+// cookieReply reports whether buf is a WireGuard cookie reply (type 3).
+func cookieReply(buf []byte) bool {
+	return len(buf) == device.MessageCookieReplySize && buf[0] == byte(device.MessageCookieReplyType)
+}
+
+// wrapReceiveFuncs wraps the inner bind's receive functions so the Bind can
+// observe inbound traffic.
+func (b *Bind) wrapReceiveFuncs(fns []conn.ReceiveFunc) []conn.ReceiveFunc {
+	wrapped := make([]conn.ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		wrapped[i] = b.wrapReceiveFunc(fn)
+	}
+	return wrapped
+}
+
+func (b *Bind) wrapReceiveFunc(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, err := fn(packets, sizes, eps)
+		b.stripPrefixes(packets, sizes, eps, n)
+		b.observeRecv(packets, sizes, eps, n)
+		for i := 0; i < n; i++ {
+			if b.classifier.IsHandshakeResponse(packets[i][:sizes[i]]) {
+				if eps[i] != nil {
+					b.resetFallback(eps[i].DstIP())
+					b.handshakeRTT(eps[i].DstIP())
+					b.handshakeAnswered(eps[i].DstIP())
+				}
+			}
+			if cookieReply(packets[i][:sizes[i]]) && eps[i] != nil {
+				// The device answers a cookie reply with a fresh initiation;
+				// that retry must not trigger another preflight burst.
+				b.mu.Lock()
+				b.cookied[eps[i].DstIP()] = true
+				b.mu.Unlock()
+			}
+		}
+		return n, err
+	}
+}
+
+// stripPrefixes removes S1/S2 prefixes from received handshake messages when
+// WithHandshakePrefixes is enabled.
+func (b *Bind) stripPrefixes(packets [][]byte, sizes []int, eps []conn.Endpoint, n int) {
+	if !b.handshakePrefixes {
+		return
+	}
+	for i := 0; i < n; i++ {
+		if eps[i] == nil {
+			continue
+		}
+		dst := eps[i].DstIP()
+		config, _ := b.configFor(dst)
+		known := func(receiver uint32) bool { return b.sentSender(dst, receiver) }
+		if k := stripAtomicNoizePrefix(packets[i][:sizes[i]], config, known); k > 0 {
+			sizes[i] = copy(packets[i], packets[i][k:sizes[i]])
+		}
+	}
+}
+
+// recvObserverQueue is how many received batches may wait for the observer
+// before further batches are dropped.
+const recvObserverQueue = 64
+
+// RecvObserver is called for every packet the Bind receives. buf is a copy
+// the observer may keep.
+type RecvObserver func(src netip.AddrPort, buf []byte)
+
+// WithRecvObserver calls observer for each received packet before it is
+// handed to WireGuard, e.g. to log handshake responses. The observer runs on
+// its own goroutine, started in Open and stopped in Close, so the receive
+// path never waits for it. If it falls behind by more than a few dozen
+// batches, further packets are not passed to it; Stats reports how many.
+func WithRecvObserver(observer RecvObserver) Option {
+	return func(b *Bind) {
+		b.recvObserver = observer
+	}
+}
+
+type observedPacket struct {
+	src netip.AddrPort
+	buf []byte
+}
+
+// startRecvObserver starts the goroutine that feeds the observer set by
+// WithRecvObserver. It must be called with b.mu held.
+func (b *Bind) startRecvObserver() {
+	if b.recvObserver == nil || b.recvObserved != nil {
+		return
+	}
+	batches := make(chan []observedPacket, recvObserverQueue)
+	stop := make(chan struct{})
+	b.recvObserved = batches
+	b.recvObserverStop = stop
+	go func() {
+		for {
+			select {
+			case batch := <-batches:
+				for _, p := range batch {
+					b.recvObserver(p.src, p.buf)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopRecvObserver stops the goroutine started by startRecvObserver,
+// dropping batches it has not reached. It must be called with b.mu held.
+func (b *Bind) stopRecvObserver() {
+	if b.recvObserverStop != nil {
+		close(b.recvObserverStop)
+		b.recvObserverStop = nil
+		b.recvObserved = nil
+	}
+}
+
+// observeRecv queues copies of the first n received packets for the
+// observer, dropping them if its queue is full.
+func (b *Bind) observeRecv(packets [][]byte, sizes []int, eps []conn.Endpoint, n int) {
+	if b.recvObserver == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	batches := b.recvObserved
+	b.mu.Unlock()
+	if batches == nil {
+		return
+	}
+	batch := make([]observedPacket, n)
+	for i := 0; i < n; i++ {
+		batch[i].buf = append([]byte(nil), packets[i][:sizes[i]]...)
+		if eps[i] != nil {
+			src, err := netip.ParseAddrPort(eps[i].DstToString())
+			if err != nil {
+				src = netip.AddrPortFrom(eps[i].DstIP(), 0)
+			}
+			batch[i].src = src
+		}
+	}
+
+	select {
+	case batches <- batch:
+		b.recvObserverLagging.Store(false)
+	default:
+		b.recvObserverDropped.Add(uint64(n))
+		if !b.recvObserverLagging.Swap(true) {
+			b.log.Warn("receive observer is falling behind, dropping packets", "queue", recvObserverQueue)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package preflightbind
+
+import (
+	"context"
+	"time"
+)
+
+// TimedPacket is one packet of a timed sequence, such as the junk packets
+// of a preflight. Each packet is sent at AbsoluteDelay after the sequence
+// started, not after the previous packet, so spacing stays accurate when
+// building or sending a packet takes time.
+type TimedPacket struct {
+	AbsoluteDelay time.Duration // send time, relative to the start of the sequence
+	Payload       func() []byte // builds the packet when it is due; nil ends the sequence
+}
+
+// runSchedule sends each packet of schedule at start plus its offset. Waits
+// target absolute times rather than sleeping between packets, so time spent
+// building and sending one packet does not push back the next, and a late
+// wakeup on a busy system does not delay the rest of the sequence. It
+// reports false if ctx ended or a payload returned nil before the schedule
+// completed.
+func runSchedule(ctx context.Context, start time.Time, schedule []TimedPacket, send func([]byte)) bool {
+	for _, p := range schedule {
+		sleepUntil(ctx, start.Add(p.AbsoluteDelay))
+		if ctx.Err() != nil {
+			return false
+		}
+		packet := p.Payload()
+		if packet == nil {
+			return false
+		}
+		send(packet)
+	}
+	return true
+}
+
+// sleepUntil pauses until t or until ctx is done, whichever comes first.
+func sleepUntil(ctx context.Context, t time.Time) {
+	if d := time.Until(t); d > 0 {
+		sleepContext(ctx, d)
+	}
+}
@@ -0,0 +1,74 @@
+package preflightbind
+
+import (
+	"context"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// defaultGateTimeout bounds how long PreflightScheduler holds a handshake
+// when NewPreflightScheduler is given no timeout.
+const defaultGateTimeout = 2 * time.Second
+
+// PreflightScheduler is a conn.Bind that holds each handshake initiation
+// back until the preflight sequence it triggered has been sent, including
+// its HandshakeDelay. This matters when preflights run on the queue worker
+// (WithPreflightQueueDepth), where Bind.Send would otherwise pass the
+// initiation on while the preflight is still going out. With inline
+// preflights the sequence is already complete when the gate is checked.
+//
+// The gate opens on its own after the scheduler's timeout, so a stalled
+// preflight delays the handshake rather than blocking it.
+type PreflightScheduler struct {
+	*Bind
+	timeout time.Duration
+}
+
+var _ conn.Bind = (*PreflightScheduler)(nil)
+
+// NewPreflightScheduler wraps b. timeout is the longest a handshake waits
+// for its preflight; if it is <= 0, two seconds are used.
+func NewPreflightScheduler(b *Bind, timeout time.Duration) *PreflightScheduler {
+	if timeout <= 0 {
+		timeout = defaultGateTimeout
+	}
+	return &PreflightScheduler{Bind: b, timeout: timeout}
+}
+
+// Send is Bind.Send, except that the WireGuard packets wait for the
+// preflight started on their behalf.
+func (s *PreflightScheduler) Send(bufs [][]byte, ep conn.Endpoint) error {
+	return s.Bind.send(bufs, ep, s.wait)
+}
+
+// wait blocks until the preflight carried by ctx is ready or the timeout
+// expires.
+func (s *PreflightScheduler) wait(ctx context.Context) {
+	ready := preflightReady(ctx)
+	if ready == nil {
+		return
+	}
+	t := time.NewTimer(s.timeout)
+	defer t.Stop()
+	select {
+	case <-ready:
+	case <-t.C:
+		s.log.Debug("handshake gate timed out before the preflight finished", "timeout", s.timeout)
+	}
+}
+
+type preflightReadyKey struct{}
+
+// withPreflightReady returns ctx carrying the channel that is closed once
+// the preflight has been sent.
+func withPreflightReady(ctx context.Context, ready <-chan struct{}) context.Context {
+	return context.WithValue(ctx, preflightReadyKey{}, ready)
+}
+
+// preflightReady returns the channel stored by withPreflightReady, or nil
+// if no preflight was started.
+func preflightReady(ctx context.Context) <-chan struct{} {
+	ready, _ := ctx.Value(preflightReadyKey{}).(<-chan struct{})
+	return ready
+}
@@ -0,0 +1,49 @@
+package preflightbind
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// seqNumSize is the length of the sequence number prepended to junk packets.
+const seqNumSize = 4
+
+// WithSequenceNumbers prepends a 4-byte big-endian sequence number to every
+// junk packet so a capture on the server can be matched against what the
+// client sent. Numbers count per destination and restart when the rate
+// limiter forgets that destination. The counter makes junk trivially
+// recognisable, so use this only in test environments.
+func WithSequenceNumbers(enabled bool) Option {
+	return func(b *Bind) {
+		b.sequenceNumbers = enabled
+	}
+}
+
+// numberJunk prepends the next sequence number for dst to junk when
+// WithSequenceNumbers is enabled.
+func (b *Bind) numberJunk(dst netip.Addr, junk []byte) []byte {
+	if !b.sequenceNumbers {
+		return junk
+	}
+	b.mu.Lock()
+	if b.junkSeq == nil {
+		b.junkSeq = make(map[netip.Addr]uint32)
+	}
+	seq := b.junkSeq[dst]
+	b.junkSeq[dst] = seq + 1
+	b.mu.Unlock()
+
+	out := make([]byte, seqNumSize, seqNumSize+len(junk))
+	binary.BigEndian.PutUint32(out, seq)
+	return append(out, junk...)
+}
+
+// ParseSequenceNumber splits a junk packet sent with WithSequenceNumbers into
+// its sequence number and original payload. ok is false if pkt is too short
+// to carry a sequence number.
+func ParseSequenceNumber(pkt []byte) (seq uint32, payload []byte, ok bool) {
+	if len(pkt) < seqNumSize {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(pkt), pkt[seqNumSize:], true
+}
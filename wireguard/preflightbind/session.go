@@ -0,0 +1,107 @@
+package preflightbind
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// sessionTrackerSize bounds how many (destination, sender index) pairs are
+// remembered for GetSessionPreflight.
+const sessionTrackerSize = 1024
+
+type sessionKey struct {
+	dst    netip.Addr
+	sender uint32
+}
+
+type sessionEntry struct {
+	key  sessionKey
+	time time.Time
+}
+
+// sessionTracker is a small LRU of preflight times keyed by WireGuard
+// session. It is guarded by Bind.mu.
+type sessionTracker struct {
+	entries map[sessionKey]*list.Element
+	order   list.List // front is most recently used
+}
+
+func (t *sessionTracker) record(key sessionKey, at time.Time) {
+	if e, ok := t.entries[key]; ok {
+		e.Value.(*sessionEntry).time = at
+		t.order.MoveToFront(e)
+		return
+	}
+	if t.entries == nil {
+		t.entries = make(map[sessionKey]*list.Element)
+	}
+	t.entries[key] = t.order.PushFront(&sessionEntry{key: key, time: at})
+	if t.order.Len() > sessionTrackerSize {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*sessionEntry).key)
+	}
+}
+
+func (t *sessionTracker) lookup(key sessionKey) (time.Time, bool) {
+	e, ok := t.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	t.order.MoveToFront(e)
+	return e.Value.(*sessionEntry).time, true
+}
+
+// removeDst forgets every session with dst.
+func (t *sessionTracker) removeDst(dst netip.Addr) {
+	for key, e := range t.entries {
+		if key.dst == dst {
+			t.order.Remove(e)
+			delete(t.entries, key)
+		}
+	}
+}
+
+// moveDst reassigns every session with from to the destination to, keeping
+// their place in the LRU. Sessions already held for to are not removed.
+func (t *sessionTracker) moveDst(from, to netip.Addr) {
+	for key, e := range t.entries {
+		if key.dst == from {
+			delete(t.entries, key)
+			key.dst = to
+			e.Value.(*sessionEntry).key = key
+			t.entries[key] = e
+		}
+	}
+}
+
+// senderIndex returns the sender_index field of a handshake initiation.
+func senderIndex(buf []byte) (uint32, bool) {
+	if len(buf) < initSenderOffset+4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(buf[initSenderOffset:]), true
+}
+
+// recordSession notes that a preflight for the initiation in buf was sent to
+// dst at the given time. It must be called with b.mu held.
+func (b *Bind) recordSession(dst netip.Addr, buf []byte, at time.Time) {
+	sender, ok := senderIndex(buf)
+	if !ok {
+		return
+	}
+	b.sessions.record(sessionKey{dst: dst, sender: sender}, at)
+	b.log.Debug("preflight sent for session", "dst", dst, "sender_index", sender)
+}
+
+// GetSessionPreflight returns when a preflight was sent for the handshake
+// initiation to dst carrying senderIndex, so WireGuard session logs can be
+// matched against preflight activity. Only the most recent sessions are
+// kept; ok is false for unknown or evicted sessions.
+func (b *Bind) GetSessionPreflight(dst netip.Addr, senderIndex uint32) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sessions.lookup(sessionKey{dst: dst, sender: senderIndex})
+}
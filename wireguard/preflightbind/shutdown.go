@@ -0,0 +1,28 @@
+package preflightbind
+
+import "context"
+
+// Shutdown closes the Bind and waits for background post-handshake junk
+// goroutines to exit. No new goroutines are started once Shutdown has been
+// called. If ctx expires first, Shutdown returns ctx.Err() and the remaining
+// goroutines finish on their own.
+func (b *Bind) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	err := b.Close()
+
+	done := make(chan struct{})
+	go func() {
+		b.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
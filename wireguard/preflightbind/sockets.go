@@ -0,0 +1,58 @@
+package preflightbind
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// defaultMaxOpenSockets is the socket limit used unless WithMaxOpenSockets
+// sets another.
+const defaultMaxOpenSockets = 32
+
+// WithMaxOpenSockets caps the preflight sockets open at once at n, so that
+// a flood of handshake retransmissions cannot make the Bind open sockets
+// without bound. Sends beyond the cap wait for a socket to be closed, up to
+// their usual dial timeout. The cap covers every socket dialed for raw
+// sends, probes and latency measurements; the sticky preflight socket is a
+// single long-lived one and is not counted. n <= 0 removes the cap. The
+// default is 32.
+func WithMaxOpenSockets(n int) Option {
+	return func(b *Bind) {
+		if n <= 0 {
+			b.socketSem = nil
+			return
+		}
+		b.socketSem = make(chan struct{}, n)
+	}
+}
+
+// acquireSocket reserves one of the open-socket slots, reporting an error if
+// ctx ends or preflightDialTimeout passes first. The returned function gives
+// the slot back.
+func (b *Bind) acquireSocket(ctx context.Context) (func(), error) {
+	if b.socketSem == nil {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, preflightDialTimeout)
+	defer cancel()
+	select {
+	case b.socketSem <- struct{}{}:
+		return func() { <-b.socketSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitedConn gives its socket slot back when it is closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
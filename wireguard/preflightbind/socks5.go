@@ -0,0 +1,253 @@
+package preflightbind
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// WithSOCKS5Proxy sends every preflight, signature and junk packet through
+// the SOCKS5 proxy at proxyAddr ("host:port"), such as Tor's SocksPort.
+// auth may be nil for proxies without authentication. WireGuard's own
+// packets are not affected.
+//
+// Packets are relayed as UDP through a UDP ASSOCIATE session when the proxy
+// allows one. Many proxies, Tor among them, refuse UDP; the first refusal
+// switches the Bind for good to TCP tunnels opened with CONNECT, carrying
+// the same 2-byte length framing as WithHTTPConnectProxy, so the
+// destination must then accept TCP and unwrap it.
+func WithSOCKS5Proxy(proxyAddr string, auth *proxy.Auth) Option {
+	return func(b *Bind) {
+		if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+			b.log.Warn("ignoring invalid SOCKS5 proxy address", "addr", proxyAddr, "error", err)
+			return
+		}
+		p := &socks5Proxy{addr: proxyAddr, auth: auth}
+		p.tcp = newFramedTunnels(p.dialTCP)
+		b.proxy = p
+	}
+}
+
+// socks5Proxy relays datagrams through a SOCKS5 proxy, over UDP while the
+// proxy supports it and over framed TCP tunnels after that.
+type socks5Proxy struct {
+	addr string
+	auth *proxy.Auth
+	tcp  *framedTunnels
+
+	mu        sync.Mutex
+	assoc     *socks5Association // nil until the first UDP send
+	udpFailed bool               // the proxy refused UDP ASSOCIATE
+}
+
+// socks5Association is an open UDP ASSOCIATE session. The relay accepts
+// datagrams only while ctrl stays open.
+type socks5Association struct {
+	ctrl  net.Conn
+	relay net.Conn
+}
+
+// errNoSOCKS5UDP reports that the proxy refused UDP ASSOCIATE.
+var errNoSOCKS5UDP = errors.New("SOCKS5 proxy does not relay UDP")
+
+func (p *socks5Proxy) send(dst netip.AddrPort, data []byte) error {
+	if err := p.sendUDP(dst, data); err != errNoSOCKS5UDP {
+		return err
+	}
+	return p.tcp.send(dst, data)
+}
+
+// sendUDP sends data through the UDP relay, associating first if needed.
+func (p *socks5Proxy) sendUDP(dst netip.AddrPort, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.udpFailed {
+		return errNoSOCKS5UDP
+	}
+	if p.assoc == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), preflightDialTimeout)
+		assoc, err := p.associate(ctx)
+		cancel()
+		var refused socks5ReplyError
+		if errors.As(err, &refused) {
+			p.udpFailed = true
+			return errNoSOCKS5UDP
+		}
+		if err != nil {
+			return wrapIn(ErrDialFailed, fmt.Errorf("SOCKS5 UDP association: %w", err))
+		}
+		p.assoc = assoc
+	}
+
+	_ = p.assoc.relay.SetWriteDeadline(time.Now().Add(preflightDialTimeout))
+	if _, err := p.assoc.relay.Write(socks5Datagram(dst, data)); err != nil {
+		p.assoc.close()
+		p.assoc = nil
+		return err
+	}
+	return nil
+}
+
+func (p *socks5Proxy) close() {
+	p.mu.Lock()
+	if p.assoc != nil {
+		p.assoc.close()
+		p.assoc = nil
+	}
+	p.mu.Unlock()
+	p.tcp.close()
+}
+
+func (a *socks5Association) close() {
+	a.relay.Close()
+	a.ctrl.Close()
+}
+
+// dialTCP opens a CONNECT tunnel to target for the TCP fallback.
+func (p *socks5Proxy) dialTCP(ctx context.Context, target string) (net.Conn, error) {
+	d, err := proxy.SOCKS5("tcp", p.addr, p.auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+}
+
+// socks5ReplyError is a failure code the proxy answered a request with.
+type socks5ReplyError byte
+
+func (e socks5ReplyError) Error() string {
+	return fmt.Sprintf("SOCKS5 proxy refused UDP ASSOCIATE with code %d", byte(e))
+}
+
+// associate negotiates a UDP ASSOCIATE session as described in RFC 1928,
+// with username/password authentication (RFC 1929) when p.auth is set.
+// golang.org/x/net/proxy only implements CONNECT.
+func (p *socks5Proxy) associate(ctx context.Context) (*socks5Association, error) {
+	var d net.Dialer
+	ctrl, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(deadline)
+	}
+	relayAddr, err := p.negotiateAssociate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	relay, err := d.DialContext(ctx, "udp", relayAddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+	return &socks5Association{ctrl: ctrl, relay: relay}, nil
+}
+
+// negotiateAssociate runs the handshake on ctrl and returns the address of
+// the proxy's UDP relay.
+func (p *socks5Proxy) negotiateAssociate(ctrl net.Conn) (string, error) {
+	greeting := []byte{5, 1, 0}
+	if p.auth != nil {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err := ctrl.Write(greeting); err != nil {
+		return "", err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(ctrl, resp[:]); err != nil {
+		return "", err
+	}
+	switch {
+	case resp[0] != 5:
+		return "", fmt.Errorf("%w: SOCKS version %d in reply", ErrDialFailed, resp[0])
+	case resp[1] == 2 && p.auth != nil:
+		if len(p.auth.User) > 255 || len(p.auth.Password) > 255 {
+			return "", fmt.Errorf("%w: SOCKS5 credentials too long", ErrDialFailed)
+		}
+		req := append([]byte{1, byte(len(p.auth.User))}, p.auth.User...)
+		req = append(append(req, byte(len(p.auth.Password))), p.auth.Password...)
+		if _, err := ctrl.Write(req); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(ctrl, resp[:]); err != nil {
+			return "", err
+		}
+		if resp[1] != 0 {
+			return "", fmt.Errorf("%w: SOCKS5 authentication failed", ErrDialFailed)
+		}
+	case resp[1] != 0:
+		return "", fmt.Errorf("%w: SOCKS5 proxy accepts none of our authentication methods", ErrDialFailed)
+	}
+
+	// The client address is left unspecified, as it is not known before
+	// the relay socket is dialed
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(ctrl, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[1] != 0 {
+		return "", socks5ReplyError(hdr[1])
+	}
+	var host string
+	switch hdr[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if hdr[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(ctrl, ip); err != nil {
+			return "", err
+		}
+		if addr, _ := netip.AddrFromSlice(ip); !addr.IsUnspecified() {
+			host = addr.Unmap().String()
+		}
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(ctrl, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(ctrl, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("%w: SOCKS5 address type %d in reply", ErrDialFailed, hdr[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(ctrl, port[:]); err != nil {
+		return "", err
+	}
+	if host == "" {
+		// An unspecified relay address means the proxy's own
+		host, _, _ = net.SplitHostPort(p.addr)
+	}
+	return net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port[:]))), nil
+}
+
+// socks5Datagram wraps data in the UDP request header for dst.
+func socks5Datagram(dst netip.AddrPort, data []byte) []byte {
+	addr := dst.Addr().Unmap()
+	out := make([]byte, 0, 4+16+2+len(data))
+	if addr.Is4() {
+		out = append(out, 0, 0, 0, 1)
+	} else {
+		out = append(out, 0, 0, 0, 4)
+	}
+	out = append(out, addr.AsSlice()...)
+	out = binary.BigEndian.AppendUint16(out, dst.Port())
+	return append(out, data...)
+}
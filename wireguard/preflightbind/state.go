@@ -0,0 +1,77 @@
+package preflightbind
+
+// PreflightState describes what a Bind is currently doing.
+type PreflightState int32
+
+const (
+	StateIdle          PreflightState = iota // no preflight activity
+	StatePreHandshake                        // sending I1-I5 and pre-handshake junk
+	StatePostHandshake                       // sending post-handshake junk
+)
+
+func (s PreflightState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StatePreHandshake:
+		return "pre-handshake"
+	case StatePostHandshake:
+		return "post-handshake"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the Bind's current preflight state. Preflights to several
+// destinations can overlap, so the state is StatePreHandshake while any
+// preflight sequence runs, otherwise StatePostHandshake while any
+// post-handshake junk is being sent, and StateIdle once none of either is.
+func (b *Bind) State() PreflightState {
+	return PreflightState(b.state.Load())
+}
+
+// WithStateChannel delivers every state transition to ch. Sends never block:
+// transitions are dropped while ch is full, so use a buffered channel.
+func WithStateChannel(ch chan PreflightState) Option {
+	return func(b *Bind) {
+		b.stateCh = ch
+	}
+}
+
+// enterState notes the start of a sequence in state s, which is one of
+// StatePreHandshake and StatePostHandshake. Every call must be paired with a
+// leaveState(s) once the sequence is done.
+func (b *Bind) enterState(s PreflightState) {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	b.stateActive[s]++
+	b.updateStateLocked()
+}
+
+// leaveState notes the end of a sequence started with enterState(s).
+func (b *Bind) leaveState(s PreflightState) {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	b.stateActive[s]--
+	b.updateStateLocked()
+}
+
+// updateStateLocked derives the Bind-wide state from the active sequence
+// counts and reports a change on stateCh. b.stateMu must be held, which also
+// keeps transitions on stateCh in order.
+func (b *Bind) updateStateLocked() {
+	s := StateIdle
+	switch {
+	case b.stateActive[StatePreHandshake] > 0:
+		s = StatePreHandshake
+	case b.stateActive[StatePostHandshake] > 0:
+		s = StatePostHandshake
+	}
+	if PreflightState(b.state.Swap(int32(s))) == s || b.stateCh == nil {
+		return
+	}
+	select {
+	case b.stateCh <- s:
+	default:
+	}
+}
@@ -0,0 +1,76 @@
+package preflightbind
+
+import "time"
+
+// Stats is a snapshot of a Bind's runtime counters, see Bind.Stats.
+type Stats struct {
+	RateLimiterEntries            int       // destinations tracked by the rate limiter
+	TotalPreflightsFired          uint64    // preflight sequences started
+	TotalJunkPacketsSent          uint64    // junk packets accepted by the inner Bind
+	TotalJunkBytesSent            uint64    // bytes in those junk packets
+	LastPreflightTime             time.Time // zero if no preflight has fired
+	ActivePostHandshakeGoroutines int32     // post-handshake junk senders still running
+	ActiveBackgroundJunk          int32     // StartBackgroundJunk loops still running
+	HandshakeInitsSent            uint64    // handshake initiations passed to Send
+	HandshakeResponsesSent        uint64    // handshake responses passed to Send
+	TransportMsgsSent             uint64    // transport (data) messages passed to Send
+	RecvObserverDropped           uint64    // received packets not passed to a lagging RecvObserver
+}
+
+// Stats returns the current counters. Only the rate-limiter size needs the
+// Bind's lock; everything else is read atomically, so the fields may be
+// from slightly different instants.
+func (b *Bind) Stats() Stats {
+	b.mu.Lock()
+	entries := len(b.lastSent)
+	b.mu.Unlock()
+
+	s := Stats{
+		RateLimiterEntries:            entries,
+		TotalPreflightsFired:          b.preflightsFired.Load(),
+		TotalJunkPacketsSent:          b.junkPackets.Load(),
+		TotalJunkBytesSent:            b.junkBytes.Load(),
+		ActivePostHandshakeGoroutines: b.activePostHandshake.Load(),
+		ActiveBackgroundJunk:          b.activeBackgroundJunk.Load(),
+		HandshakeInitsSent:            b.initsSent.Load(),
+		HandshakeResponsesSent:        b.responsesSent.Load(),
+		TransportMsgsSent:             b.transportSent.Load(),
+		RecvObserverDropped:           b.recvObserverDropped.Load(),
+	}
+	if ns := b.lastPreflight.Load(); ns != 0 {
+		s.LastPreflightTime = time.Unix(0, ns)
+	}
+	return s
+}
+
+// countJunk records a junk packet of n bytes as sent.
+func (b *Bind) countJunk(n int) {
+	b.junkPackets.Add(1)
+	b.junkBytes.Add(uint64(n))
+}
+
+// countMessages records the WireGuard messages in bufs by type, as given by
+// PacketClassify. Packets this package adds itself are not counted.
+func (b *Bind) countMessages(bufs [][]byte) {
+	for _, buf := range bufs {
+		switch PacketClassify(buf) {
+		case MessageInit:
+			b.initsSent.Add(1)
+		case MessageResponse:
+			b.responsesSent.Add(1)
+		case MessageTransport:
+			b.transportSent.Add(1)
+		}
+	}
+}
+
+// DataToControlRatio returns the number of transport messages sent per
+// handshake message (initiation or response), or 0 before any handshake
+// message has been sent.
+func (b *Bind) DataToControlRatio() float64 {
+	control := b.initsSent.Load() + b.responsesSent.Load()
+	if control == 0 {
+		return 0
+	}
+	return float64(b.transportSent.Load()) / float64(control)
+}
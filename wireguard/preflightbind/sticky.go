@@ -0,0 +1,78 @@
+package preflightbind
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// WithStickyPreflightPort makes raw preflight sends share one UDP socket,
+// opened on an ephemeral port in Open and closed in Close, instead of
+// dialing a new socket, and so a new source port, for every packet. Some
+// firewalls treat the stream of fresh ports as a port scan. The socket
+// honours WithSourceIP, WithInterfaceName and WithDSCP; WithEndpointDialer
+// and WithHTTPConnectProxy take precedence over it. Multipath I1 copies
+// still leave from ports of their own, as that is their purpose.
+func WithStickyPreflightPort(sticky bool) Option {
+	return func(b *Bind) {
+		b.stickyPort = sticky
+	}
+}
+
+// openStickySocket opens the shared preflight socket if
+// WithStickyPreflightPort is set. It must be called with b.mu held.
+func (b *Bind) openStickySocket() {
+	if !b.stickyPort || b.stickyConn != nil || b.dialer != nil || b.proxy != nil {
+		return
+	}
+	var lc net.ListenConfig
+	if b.ifname != "" {
+		control, err := interfaceControl(b.ifname)
+		if err != nil {
+			b.log.Warn("not binding preflight socket to interface", "interface", b.ifname, "error", err)
+		} else {
+			lc.Control = control
+		}
+	}
+	laddr := ":0"
+	if b.sourceAddr != nil {
+		laddr = b.sourceAddr.String()
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		b.log.Warn("cannot open sticky preflight socket, using a socket per packet", "error", err)
+		return
+	}
+	c := pc.(*net.UDPConn)
+	b.applyDSCP(c)
+	b.stickyConn = c
+}
+
+// closeStickySocket closes the shared preflight socket. It must be called
+// with b.mu held.
+func (b *Bind) closeStickySocket() {
+	if b.stickyConn != nil {
+		b.stickyConn.Close()
+		b.stickyConn = nil
+	}
+}
+
+// stickySocket returns the shared preflight socket, or nil if there is none.
+func (b *Bind) stickySocket() *net.UDPConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stickyConn
+}
+
+// sendSticky writes data to dst from the shared preflight socket c.
+func (b *Bind) sendSticky(ctx context.Context, c *net.UDPConn, dst netip.AddrPort, data []byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetWriteDeadline(deadline)
+	}
+	n, err := c.WriteToUDPAddrPort(data, dst)
+	b.bytesWritten.Add(int64(n))
+	if n > 0 && b.capture != nil {
+		b.writeCapture(addrPortOf(c.LocalAddr()), dst, data[:n])
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+// Package testutil provides in-memory helpers for testing code built on
+// conn.Bind without touching the network.
+package testutil
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// FakeSend is one packet passed to FakeBind.Send.
+type FakeSend struct {
+	Packet   []byte        // copy of the sent bytes
+	Endpoint conn.Endpoint // destination given to Send
+	Call     int           // index of the Send call the packet belonged to
+}
+
+// FakeRecv is a packet to be delivered by FakeBind's receive function.
+type FakeRecv struct {
+	Packet   []byte
+	Endpoint conn.Endpoint
+}
+
+// FakeBind is a conn.Bind that records everything sent through it and
+// delivers packets written to Recv. It is safe for concurrent use.
+type FakeBind struct {
+	// Recv feeds the receive function returned by Open.
+	Recv chan FakeRecv
+	// SendErr, if set, is returned by every Send call after recording.
+	SendErr error
+	// Batch is reported by BatchSize; zero means 1.
+	Batch int
+	// ExactBatch makes Send fail, without recording anything, unless it is
+	// given exactly BatchSize buffers, as some drivers require.
+	ExactBatch bool
+
+	mu     sync.Mutex
+	sends  []FakeSend
+	calls  int
+	open   bool
+	closed chan struct{}
+}
+
+// NewFakeBind returns an empty FakeBind with a buffered Recv channel.
+func NewFakeBind() *FakeBind {
+	return &FakeBind{Recv: make(chan FakeRecv, 64)}
+}
+
+// Sends returns a copy of everything sent so far.
+func (f *FakeBind) Sends() []FakeSend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeSend(nil), f.sends...)
+}
+
+// Reset forgets all recorded sends.
+func (f *FakeBind) Reset() {
+	f.mu.Lock()
+	f.sends = nil
+	f.calls = 0
+	f.mu.Unlock()
+}
+
+func (f *FakeBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	f.open = true
+	closed := make(chan struct{})
+	f.closed = closed
+
+	recv := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case r := <-f.Recv:
+			sizes[0] = copy(packets[0], r.Packet)
+			eps[0] = r.Endpoint
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{recv}, port, nil
+}
+
+func (f *FakeBind) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open {
+		close(f.closed)
+		f.open = false
+	}
+	return nil
+}
+
+func (f *FakeBind) SetMark(uint32) error { return nil }
+
+func (f *FakeBind) BatchSize() int {
+	if f.Batch > 0 {
+		return f.Batch
+	}
+	return 1
+}
+
+func (f *FakeBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	if f.ExactBatch && len(bufs) != f.BatchSize() {
+		return fmt.Errorf("got %d buffers, want exactly %d", len(bufs), f.BatchSize())
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, buf := range bufs {
+		f.sends = append(f.sends, FakeSend{
+			Packet:   append([]byte(nil), buf...),
+			Endpoint: ep,
+			Call:     f.calls,
+		})
+	}
+	f.calls++
+	return f.SendErr
+}
+
+func (f *FakeBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &FakeEndpoint{Dst: ap}, nil
+}
+
+// FakeEndpoint is the conn.Endpoint produced by FakeBind.ParseEndpoint.
+type FakeEndpoint struct {
+	Dst netip.AddrPort
+	Src netip.AddrPort
+}
+
+func (e *FakeEndpoint) ClearSrc()           { e.Src = netip.AddrPort{} }
+func (e *FakeEndpoint) SrcToString() string { return e.Src.String() }
+func (e *FakeEndpoint) DstToString() string { return e.Dst.String() }
+func (e *FakeEndpoint) DstToBytes() []byte  { b, _ := e.Dst.MarshalBinary(); return b }
+func (e *FakeEndpoint) DstIP() netip.Addr   { return e.Dst.Addr() }
+func (e *FakeEndpoint) SrcIP() netip.Addr   { return e.Src.Addr() }
+
+var _ conn.Bind = (*FakeBind)(nil)
@@ -0,0 +1,114 @@
+// Package randconfig generates random but valid AtomicNoizeConfigs for
+// property-based tests and fuzz targets of code built on preflightbind.
+// It lives apart from testutil because it imports preflightbind, which
+// testutil must not.
+package randconfig
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
+)
+
+// Config returns a random config that passes Validate and that
+// preflightbind's constructors accept: Jmin <= Jmax <= 1280, S1 and S2 in
+// [0, 64], intervals and delays under 50ms and I1-I5 built from the CPS
+// tags that need no key (everything but <h>), sometimes through a macro.
+// The same r state always gives the same config.
+func Config(r *rand.Rand) *preflightbind.AtomicNoizeConfig {
+	jmin := r.Intn(200)
+	cfg := &preflightbind.AtomicNoizeConfig{
+		Jc:             r.Intn(11),
+		Jmin:           jmin,
+		Jmax:           jmin + r.Intn(1281-jmin),
+		S1:             r.Intn(65),
+		S2:             r.Intn(65),
+		JunkInterval:   time.Duration(r.Intn(20)) * time.Millisecond,
+		HandshakeDelay: time.Duration(r.Intn(50)) * time.Millisecond,
+		JitterFraction: float64(r.Intn(51)) / 100,
+		AllowZeroSize:  r.Intn(2) == 0,
+		AdaptiveJunk:   r.Intn(2) == 0,
+	}
+	cfg.JcAfterI1 = r.Intn(cfg.Jc + 1)
+	cfg.JcBeforeHS = r.Intn(cfg.Jc - cfg.JcAfterI1 + 1)
+	cfg.JcAfterHS = cfg.Jc - cfg.JcAfterI1 - cfg.JcBeforeHS
+	if r.Intn(2) == 0 {
+		cfg.H1, cfg.H2, cfg.H3, cfg.H4 = r.Uint32(), r.Uint32(), r.Uint32(), r.Uint32()
+	}
+
+	if r.Intn(4) == 0 {
+		cfg.Macros = map[string]string{"hdr": cps(r, 2)}
+	}
+	cfg.I1 = signature(r, cfg)
+	for _, sig := range []*string{&cfg.I2, &cfg.I3, &cfg.I4, &cfg.I5} {
+		if r.Intn(2) == 0 {
+			*sig = signature(r, cfg)
+		}
+	}
+	return cfg
+}
+
+// Seeded returns Config for a generator seeded with seed, so that a
+// failing case can be reproduced from its seed alone.
+func Seeded(seed int64) *preflightbind.AtomicNoizeConfig {
+	return Config(rand.New(rand.NewSource(seed)))
+}
+
+// signature returns a CPS string for one of I1-I5, starting with a
+// reference to cfg's macro if it has one.
+func signature(r *rand.Rand, cfg *preflightbind.AtomicNoizeConfig) string {
+	s := cps(r, 1+r.Intn(6))
+	if cfg.Macros != nil && r.Intn(2) == 0 {
+		s = "<ref hdr>" + s
+	}
+	return s
+}
+
+// protocols are the names <p> accepts.
+var protocols = []string{"quic", "tls_hello", "dns_query"}
+
+// cps returns a CPS string of n random tags, at least one of them.
+func cps(r *rand.Rand, n int) string {
+	var sb strings.Builder
+	for i := 0; i < max(n, 1); i++ {
+		switch r.Intn(9) {
+		case 0:
+			b := make([]byte, 1+r.Intn(16))
+			r.Read(b)
+			fmt.Fprintf(&sb, "<b 0x%s>", hex.EncodeToString(b))
+		case 1:
+			fmt.Fprintf(&sb, "<r %d>", r.Intn(256))
+		case 2:
+			fmt.Fprintf(&sb, "<e %d>", 8+r.Intn(9))
+		case 3:
+			fmt.Fprintf(&sb, "<z %d>", r.Intn(32))
+		case 4:
+			sb.WriteString("<c>")
+		case 5:
+			sb.WriteString("<t>")
+		case 6:
+			fmt.Fprintf(&sb, "<s %s>", randomText(r))
+		case 7:
+			fmt.Fprintf(&sb, "<p %s>", protocols[r.Intn(len(protocols))])
+		case 8:
+			width := 2 + 2*r.Intn(2)
+			fmt.Fprintf(&sb, "<g%d>%s</g%d>", width, cps(r, 1+r.Intn(2)), width)
+		}
+	}
+	return sb.String()
+}
+
+// randomText returns 1-16 ASCII letters and digits, which need no escaping
+// in <s>.
+func randomText(r *rand.Rand) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 1+r.Intn(16))
+	for i := range b {
+		b[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(b)
+}
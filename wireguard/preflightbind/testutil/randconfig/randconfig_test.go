@@ -0,0 +1,30 @@
+package randconfig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind/testutil"
+)
+
+func TestConfigIsAccepted(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		cfg := Seeded(seed)
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("seed %d: Validate: %v\n%+v", seed, err, cfg)
+		}
+		if cfg.Jmax < cfg.Jmin {
+			t.Fatalf("seed %d: Jmax %d below Jmin %d", seed, cfg.Jmax, cfg.Jmin)
+		}
+		if _, err := preflightbind.NewWithAtomicNoize(testutil.NewFakeBind(), cfg, 443, time.Hour); err != nil {
+			t.Fatalf("seed %d: NewWithAtomicNoize: %v\n%+v", seed, err, cfg)
+		}
+	}
+}
+
+func TestSeededIsReproducible(t *testing.T) {
+	if a, b := Seeded(42), Seeded(42); !a.Equal(b) {
+		t.Fatalf("same seed gave different configs: %v", preflightbind.ConfigDiff(a, b))
+	}
+}
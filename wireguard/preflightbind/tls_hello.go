@@ -0,0 +1,135 @@
+package preflightbind
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLSExtension is a raw TLS extension added to a generated ClientHello.
+type TLSExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// TLS extension types used by BuildTLSClientHelloPayload.
+const (
+	tlsExtServerName          uint16 = 0
+	tlsExtSupportedGroups     uint16 = 10
+	tlsExtSignatureAlgorithms uint16 = 13
+	tlsExtALPN                uint16 = 16
+	tlsExtSupportedVersions   uint16 = 43
+	tlsExtPSKModes            uint16 = 45
+	tlsExtKeyShare            uint16 = 51
+)
+
+// defaultTLSCipherSuites are the TLS 1.3 suites offered when none are given.
+var defaultTLSCipherSuites = []uint16{0x1301, 0x1302, 0x1303}
+
+// BuildTLSClientHelloPayload returns a TLS 1.3 ClientHello record suitable
+// for use as the I1 payload. The hello carries fresh random, session ID and
+// X25519 key share values on every call. sni may be empty to omit the
+// server_name extension. A nil cipherSuites offers the standard TLS 1.3
+// suites. extensions are appended after the built-in ones; an extension with
+// the same type as a built-in one replaces it.
+func BuildTLSClientHelloPayload(sni string, cipherSuites []uint16, extensions []TLSExtension) ([]byte, error) {
+	if len(sni) > 253 {
+		return nil, fmt.Errorf("%w: SNI %q is longer than 253 bytes", ErrPacketTooBig, sni)
+	}
+	if len(cipherSuites) == 0 {
+		cipherSuites = defaultTLSCipherSuites
+	}
+
+	random := make([]byte, 32+32+32) // client random, session ID, X25519 key
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	exts := defaultTLSExtensions(sni, random[64:])
+	for _, ext := range extensions {
+		replaced := false
+		for i := range exts {
+			if exts[i].Type == ext.Type {
+				exts[i] = ext
+				replaced = true
+			}
+		}
+		if !replaced {
+			exts = append(exts, ext)
+		}
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(0x16)    // record type: handshake
+	b.AddUint16(0x0301) // legacy record version
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0x01) // handshake type: ClientHello
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0303) // legacy_version
+			b.AddBytes(random[:32])
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(random[32:64]) })
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, cs := range cipherSuites {
+					b.AddUint16(cs)
+				}
+			})
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) }) // null compression
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, ext := range exts {
+					b.AddUint16(ext.Type)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(ext.Data) })
+				}
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+// defaultTLSExtensions returns the extensions every generated ClientHello
+// carries, in the order browsers commonly send them.
+func defaultTLSExtensions(sni string, keyShare []byte) []TLSExtension {
+	var exts []TLSExtension
+	if sni != "" {
+		var b cryptobyte.Builder
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0) // name type: host_name
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(sni)) })
+		})
+		exts = append(exts, TLSExtension{Type: tlsExtServerName, Data: b.BytesOrPanic()})
+	}
+
+	var ks cryptobyte.Builder
+	ks.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x001d) // x25519
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyShare) })
+	})
+
+	return append(exts,
+		TLSExtension{Type: tlsExtSupportedGroups, Data: []byte{0x00, 0x04, 0x00, 0x1d, 0x00, 0x17}},
+		TLSExtension{Type: tlsExtSignatureAlgorithms, Data: []byte{0x00, 0x06, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01}},
+		TLSExtension{Type: tlsExtALPN, Data: []byte{0x00, 0x03, 0x02, 'h', '2'}},
+		TLSExtension{Type: tlsExtSupportedVersions, Data: []byte{0x02, 0x03, 0x04}},
+		TLSExtension{Type: tlsExtPSKModes, Data: []byte{0x01, 0x01}},
+		TLSExtension{Type: tlsExtKeyShare, Data: ks.BytesOrPanic()},
+	)
+}
+
+// ToHexPayload formats payload as a CPS string ("<b 0x...>") that can be
+// used for I1-I5 in config files.
+func ToHexPayload(payload []byte) string {
+	return "<b 0x" + hex.EncodeToString(payload) + ">"
+}
+
+// WithSNI replaces I1 with a TLS ClientHello whose server_name is sni.
+//
+// This supports CDN fronting: when the WireGuard server sits behind a CDN,
+// the SNI seen by on-path filters has to be the fronting domain rather than
+// the server's IP. The name is only written into the payload; it is never
+// resolved, and preflight packets still go to the WireGuard endpoint's IP.
+func WithSNI(sni string) Option {
+	return func(b *Bind) {
+		b.cps.sni = sni
+	}
+}
@@ -0,0 +1,32 @@
+package preflightbind
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
+
+// WithTraceProvider records every preflight as an OpenTelemetry span named
+// "preflightbind.preflight", with the post-handshake junk that follows it as
+// a child span. Without this option spans go to a no-op tracer, so nothing
+// needs to be set up when tracing is not in use.
+func WithTraceProvider(tp trace.TracerProvider) Option {
+	return func(b *Bind) {
+		if tp != nil {
+			b.tracer = tp.Tracer(tracerName)
+		}
+	}
+}
+
+// startSpan starts a span on the configured tracer, or a no-op one.
+func (b *Bind) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := b.tracer
+	if tracer == nil {
+		tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
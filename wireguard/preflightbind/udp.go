@@ -0,0 +1,219 @@
+package preflightbind
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+// preflightDialTimeout bounds dialing and writing on raw preflight sockets.
+const preflightDialTimeout = 2 * time.Second
+
+// sendUDPPacket sends data to dst from a fresh UDP socket, i.e. from a new
+// ephemeral source port rather than the WireGuard socket. With
+// WithHTTPConnectProxy it goes through the proxy instead, and with
+// WithStickyPreflightPort from the shared preflight socket.
+func (b *Bind) sendUDPPacket(ctx context.Context, dst netip.AddrPort, data []byte) error {
+	if b.proxy != nil {
+		if err := b.proxy.send(dst, data); err != nil {
+			return err
+		}
+		b.bytesWritten.Add(int64(len(data)))
+		return nil
+	}
+	if c := b.stickySocket(); c != nil {
+		return b.sendSticky(ctx, c, dst, data)
+	}
+	return b.sendFreshUDPPacket(ctx, dst, data)
+}
+
+// sendFreshUDPPacket sends data to dst from a newly dialed socket.
+func (b *Bind) sendFreshUDPPacket(ctx context.Context, dst netip.AddrPort, data []byte) error {
+	c, err := b.dial(ctx, dst)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	b.applyDSCP(c)
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(preflightDialTimeout)
+	}
+	_ = c.SetWriteDeadline(deadline)
+	n, err := c.Write(data)
+	b.bytesWritten.Add(int64(n))
+	if n > 0 {
+		b.captureConn(c, data[:n])
+	}
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// TotalBytesSent returns the number of preflight, signature and junk bytes
+// written so far. Data packets forwarded by Send are not included.
+func (b *Bind) TotalBytesSent() int64 {
+	return b.bytesWritten.Load()
+}
+
+// dial opens the socket used for a raw preflight send to dst, waiting for a
+// slot if WithMaxOpenSockets' cap is reached. Closing the socket frees the
+// slot.
+func (b *Bind) dial(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+	release, err := b.acquireSocket(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: waiting for a preflight socket: %w", ErrDialFailed, err)
+	}
+	c, err := b.dialUnlimited(ctx, dst)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%w: %w", ErrDialFailed, err)
+	}
+	return &limitedConn{Conn: c, release: release}, nil
+}
+
+// dialUnlimited is dial without the open-socket cap.
+func (b *Bind) dialUnlimited(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+	if b.dialer != nil {
+		return b.dialer(dst.String())
+	}
+	d := net.Dialer{Timeout: preflightDialTimeout}
+	if b.ifname != "" {
+		control, err := interfaceControl(b.ifname)
+		if err != nil {
+			b.log.Warn("not binding preflight socket to interface", "interface", b.ifname, "error", err)
+		} else {
+			d.Control = control
+		}
+	}
+	if b.sourceAddr != nil {
+		if b.sourceAddr.AddrPort().Addr().Is4() == dst.Addr().Unmap().Is4() {
+			d.LocalAddr = b.sourceAddr
+		} else {
+			b.log.Debug("preflight source address family differs from destination, not binding",
+				"source", b.sourceAddr.IP, "destination", dst.Addr())
+		}
+	}
+	return d.DialContext(ctx, "udp", dst.String())
+}
+
+// WithSourceIP binds raw preflight sockets to addr, for multi-homed hosts
+// where preflight packets must leave from the WireGuard-facing interface.
+// Destinations of the other address family are dialed unbound.
+func WithSourceIP(addr netip.Addr) Option {
+	return func(b *Bind) {
+		if !addr.IsValid() {
+			b.sourceAddr = nil
+			return
+		}
+		b.sourceAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), 0))
+	}
+}
+
+// WithInterfaceName binds raw preflight sockets to the network interface
+// ifname (SO_BINDTODEVICE), so they follow the same route as the WireGuard
+// tunnel instead of being routed asymmetrically. Binding usually needs
+// CAP_NET_RAW. It is only supported on Linux; other platforms log a warning
+// and send unbound.
+func WithInterfaceName(ifname string) Option {
+	return func(b *Bind) {
+		b.ifname = ifname
+	}
+}
+
+// EndpointDialer opens a datagram connection for a preflight send to addr
+// ("ip:port"). See WithEndpointDialer.
+type EndpointDialer func(addr string) (net.Conn, error)
+
+// WithEndpointDialer replaces the UDP dialer used for preflight packets that
+// are not sent on the WireGuard socket.
+func WithEndpointDialer(dialer EndpointDialer) Option {
+	return func(b *Bind) {
+		b.dialer = dialer
+	}
+}
+
+// UnixSocketDialer returns an EndpointDialer that delivers every packet to the
+// unixgram socket at path, for userspace WireGuard daemons reachable over
+// local IPC. The requested address is ignored.
+func UnixSocketDialer(path string) EndpointDialer {
+	return func(string) (net.Conn, error) {
+		return net.DialTimeout("unixgram", path, preflightDialTimeout)
+	}
+}
+
+// sendMultipath sends payload to dst from b.multipathCount sockets at once.
+// It returns when every send finished, ctx is done or preflightDialTimeout
+// elapsed.
+func (b *Bind) sendMultipath(ctx context.Context, dst netip.AddrPort, payload []byte) {
+	if b.multipathCount <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, preflightDialTimeout)
+	defer cancel()
+
+	send := b.sendUDPPacket
+	if b.proxy == nil {
+		send = b.sendFreshUDPPacket // one source port per copy, even with a sticky port
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < b.multipathCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := send(ctx, dst, payload); err != nil {
+				b.reportError(err, "multipath I1")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// sendMode selects how sendPacket delivers preflight and junk packets.
+type sendMode int
+
+const (
+	sendInner             sendMode = iota // inner.Send only (default)
+	sendInnerWithFallback                 // inner.Send, raw socket on error
+	sendRawOnly                           // raw socket only
+)
+
+// WithUseInnerSend chooses how preflight, signature and junk packets are
+// sent. With true they go through the inner Bind, so they share its socket,
+// source address and routing mark, and a raw UDP socket is used only when
+// inner.Send fails. With false they always leave from a raw socket with its
+// own ephemeral port, honouring WithSourceIP and WithEndpointDialer. Without
+// the option packets use the inner Bind and send errors are reported.
+func WithUseInnerSend(useInner bool) Option {
+	return func(b *Bind) {
+		if useInner {
+			b.sendMode = sendInnerWithFallback
+		} else {
+			b.sendMode = sendRawOnly
+		}
+	}
+}
+
+// sendPacketRaw sends packet to ep's destination on a raw socket.
+func (b *Bind) sendPacketRaw(packet []byte, ep conn.Endpoint, what string) bool {
+	dst, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		b.reportError(err, what)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), preflightDialTimeout)
+	defer cancel()
+	if err := b.sendUDPPacket(ctx, dst, packet); err != nil {
+		b.reportError(err, what)
+		return false
+	}
+	return true
+}
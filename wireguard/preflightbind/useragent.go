@@ -0,0 +1,28 @@
+package preflightbind
+
+import "net/http"
+
+// User-Agent presets for WithHTTPUserAgent.
+const (
+	UserAgentChrome  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+	UserAgentFirefox = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:133.0) Gecko/20100101 Firefox/133.0"
+	UserAgentCurl    = "curl/8.11.0"
+)
+
+// WithHTTPUserAgent sets the User-Agent of every HTTP request the Bind
+// makes: CONNECT requests to a WithHTTPConnectProxy proxy and DoH queries
+// for WithDOHResolver. By default, and when ua is empty, the header is left
+// out instead of carrying Go's default, which identifies the client as a Go
+// program. The UserAgent constants are current browser and curl values.
+func WithHTTPUserAgent(ua string) Option {
+	return func(b *Bind) {
+		b.userAgent = ua
+	}
+}
+
+// setUserAgent sets h's User-Agent to ua. An empty value is kept, not
+// deleted, since net/http only omits the header when it is present and
+// empty.
+func setUserAgent(h http.Header, ua string) {
+	h["User-Agent"] = []string{ua}
+}
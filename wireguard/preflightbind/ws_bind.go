@@ -0,0 +1,284 @@
+package preflightbind
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+)
+
+const (
+	wsDialTimeout  = 10 * time.Second
+	wsWriteTimeout = 5 * time.Second
+	wsRecvQueue    = 1024
+)
+
+// wsBind carries WireGuard packets over a WebSocket connection, one binary
+// message per datagram.
+type wsBind struct {
+	url     string
+	dialer  websocket.Dialer
+	headers http.Header
+
+	mu      sync.Mutex
+	ws      *websocket.Conn
+	dialing chan struct{} // closed when the dial in progress, if any, ends
+	closed  chan struct{}
+	recv    chan []byte
+
+	writeMu sync.Mutex // gorilla/websocket allows one writer at a time
+}
+
+// WSBind returns a conn.Bind that tunnels WireGuard through a WebSocket at
+// wsURL (ws:// or wss://), for networks that pass WebSocket traffic but
+// block raw UDP. The connection is dialed on Open, with headers added to the
+// upgrade request, and redialed by Send if it has dropped. Every endpoint
+// maps to the same WebSocket, so the server side is responsible for
+// delivering packets to the WireGuard peer. The result can be wrapped by New
+// or NewWithAtomicNoize like any other Bind.
+func WSBind(wsURL string, tlsConfig *tls.Config, headers http.Header) (conn.Bind, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL %q: %w", wsURL, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("WebSocket URL %q must use ws:// or wss://", wsURL)
+	}
+	return &wsBind{
+		url: wsURL,
+		dialer: websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: wsDialTimeout,
+			TLSClientConfig:  tlsConfig,
+		},
+		headers: headers.Clone(),
+	}, nil
+}
+
+func (w *wsBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	w.mu.Lock()
+	if w.closed != nil {
+		w.mu.Unlock()
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	w.closed = closed
+	w.recv = make(chan []byte, wsRecvQueue)
+	w.mu.Unlock()
+
+	ws, err := w.current()
+	if err != nil {
+		w.mu.Lock()
+		if w.closed == closed {
+			w.closed = nil
+		}
+		w.mu.Unlock()
+		return nil, 0, err
+	}
+	actualPort := port
+	if a, ok := ws.LocalAddr().(*net.TCPAddr); ok {
+		actualPort = uint16(a.Port)
+	}
+	return []conn.ReceiveFunc{w.receive}, actualPort, nil
+}
+
+// current returns a live connection, redialing if the previous one dropped.
+// The dial happens without w.mu held, so Send, Close and the reader are not
+// stalled by a slow server; concurrent callers wait for the same dial.
+func (w *wsBind) current() (*websocket.Conn, error) {
+	w.mu.Lock()
+	for {
+		if w.closed == nil {
+			w.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if w.ws != nil {
+			ws := w.ws
+			w.mu.Unlock()
+			return ws, nil
+		}
+		if w.dialing == nil {
+			break
+		}
+		dialing := w.dialing
+		w.mu.Unlock()
+		<-dialing
+		w.mu.Lock()
+	}
+	dialing := make(chan struct{})
+	w.dialing = dialing
+	closed, recv := w.closed, w.recv
+	w.mu.Unlock()
+
+	ws, err := w.dial()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dialing = nil
+	close(dialing)
+	if err != nil {
+		return nil, err
+	}
+	if w.closed != closed {
+		// Closed, and maybe reopened, while dialing
+		ws.Close()
+		return nil, net.ErrClosed
+	}
+	w.ws = ws
+	go w.readMessages(ws, closed, recv)
+	return ws, nil
+}
+
+// dial connects to the server.
+func (w *wsBind) dial() (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wsDialTimeout)
+	defer cancel()
+	ws, _, err := w.dialer.DialContext(ctx, w.url, w.headers)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDialFailed, err)
+	}
+	return ws, nil
+}
+
+func (w *wsBind) readMessages(ws *websocket.Conn, closed chan struct{}, recv chan []byte) {
+	defer func() {
+		w.mu.Lock()
+		if w.ws == ws {
+			w.ws = nil
+		}
+		w.mu.Unlock()
+		ws.Close()
+	}()
+	for {
+		typ, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		select {
+		case recv <- data:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (w *wsBind) receive(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	w.mu.Lock()
+	closed, recv := w.closed, w.recv
+	w.mu.Unlock()
+	if closed == nil {
+		return 0, net.ErrClosed
+	}
+
+	var packet []byte
+	select {
+	case packet = <-recv:
+	case <-closed:
+		return 0, net.ErrClosed
+	}
+	ep := &wsEndpoint{uri: w.url}
+
+	n := 0
+	for {
+		sizes[n] = copy(packets[n], packet)
+		eps[n] = ep
+		n++
+		if n == len(packets) {
+			return n, nil
+		}
+		select {
+		case packet = <-recv:
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (w *wsBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	ws, err := w.current()
+	if err != nil {
+		return err
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	_ = ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	for _, buf := range bufs {
+		if err := ws.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+			ws.Close() // the reader notices and clears w.ws for a redial
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wsBind) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed == nil {
+		return nil
+	}
+	close(w.closed)
+	w.closed = nil
+	var err error
+	if w.ws != nil {
+		w.writeMu.Lock()
+		_ = w.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		w.writeMu.Unlock()
+		err = w.ws.Close()
+		w.ws = nil
+	}
+	return err
+}
+
+func (w *wsBind) SetMark(uint32) error { return nil }
+func (w *wsBind) BatchSize() int       { return conn.IdealBatchSize }
+
+// ParseEndpoint accepts a ws:// or wss:// URI, or a plain "ip:port" peer
+// address. Either way packets travel over the Bind's own WebSocket.
+func (w *wsBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if u, err := url.Parse(s); err == nil && (u.Scheme == "ws" || u.Scheme == "wss") {
+		return &wsEndpoint{uri: s}, nil
+	}
+	if _, err := netip.ParseAddrPort(s); err != nil {
+		return nil, errors.New("endpoint must be a ws:// or wss:// URI or an ip:port address")
+	}
+	return &wsEndpoint{uri: s}, nil
+}
+
+// wsEndpoint is a WireGuard peer reached through a wsBind or h2Bind.
+type wsEndpoint struct {
+	uri string
+}
+
+func (e *wsEndpoint) ClearSrc()           {}
+func (e *wsEndpoint) SrcToString() string { return "" }
+func (e *wsEndpoint) DstToString() string { return e.uri }
+func (e *wsEndpoint) DstToBytes() []byte  { return []byte(e.uri) }
+func (e *wsEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+// DstIP returns the peer's IP when the endpoint names one literally, so
+// per-destination state such as rate limiting keys on it.
+func (e *wsEndpoint) DstIP() netip.Addr {
+	host := e.uri
+	if u, err := url.Parse(e.uri); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if ap, err := netip.ParseAddrPort(host); err == nil {
+		return ap.Addr()
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr
+}
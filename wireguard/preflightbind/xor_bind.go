@@ -0,0 +1,93 @@
+package preflightbind
+
+import (
+	"crypto/sha256"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
+	"golang.org/x/crypto/chacha20"
+)
+
+// XORBind wraps a conn.Bind and masks the body of every WireGuard transport
+// message (type 4) with a keystream derived from a shared key and the
+// message's counter. Handshake and cookie messages pass through unchanged
+// because the server expects them in standard form. Both ends must use an
+// XORBind with the same key.
+//
+// The masking defeats byte-statistics fingerprinting only; it adds no
+// cryptographic protection on top of WireGuard.
+type XORBind struct {
+	inner conn.Bind
+	key   [32]byte
+}
+
+// NewXORBind returns an XORBind around inner. key may have any length; it is
+// hashed to derive the keystream key.
+func NewXORBind(inner conn.Bind, key []byte) *XORBind {
+	return &XORBind{inner: inner, key: sha256.Sum256(key)}
+}
+
+func (x *XORBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := x.inner.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	wrapped := make([]conn.ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		fn := fn
+		wrapped[i] = func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				x.mask(packets[j][:sizes[j]])
+			}
+			return n, err
+		}
+	}
+	return wrapped, actualPort, nil
+}
+
+func (x *XORBind) Close() error                                  { return x.inner.Close() }
+func (x *XORBind) SetMark(m uint32) error                        { return x.inner.SetMark(m) }
+func (x *XORBind) ParseEndpoint(s string) (conn.Endpoint, error) { return x.inner.ParseEndpoint(s) }
+func (x *XORBind) BatchSize() int                                { return x.inner.BatchSize() }
+
+// Send masks transport messages into fresh buffers, leaving bufs untouched.
+func (x *XORBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	var out [][]byte
+	for i, buf := range bufs {
+		if !isTransportMessage(buf) {
+			continue
+		}
+		if out == nil {
+			out = append([][]byte(nil), bufs...)
+		}
+		masked := append([]byte(nil), buf...)
+		x.mask(masked)
+		out[i] = masked
+	}
+	if out == nil {
+		out = bufs
+	}
+	return x.inner.Send(out, ep)
+}
+
+// mask XORs the body of a transport message in place; applying it twice
+// restores the original. Other messages are left alone.
+func (x *XORBind) mask(buf []byte) {
+	if !isTransportMessage(buf) {
+		return
+	}
+	var nonce [chacha20.NonceSize]byte
+	copy(nonce[4:], buf[8:16]) // the message counter
+	c, err := chacha20.NewUnauthenticatedCipher(x.key[:], nonce[:])
+	if err != nil {
+		return
+	}
+	body := buf[device.MessageTransportHeaderSize:]
+	c.XORKeyStream(body, body)
+}
+
+// isTransportMessage only checks the type byte; WARP sets the reserved bytes.
+func isTransportMessage(buf []byte) bool {
+	return len(buf) >= device.MessageTransportHeaderSize && buf[0] == byte(device.MessageTransportType)
+}